@@ -14,8 +14,15 @@ type Conf struct {
 	MongoDBHost     string `json:"mongodbhosts"`
 	AuthDatabase    string `json:"authdatabase"`
 	SessionStoreKey string `json:"sessionstorekey"`
+	// days deleted records stay in the trash before they are purged
+	TrashRetentionDays int `json:"trashretentiondays"`
+	// path to the table linking ISSNs to their ISSN-L, e.g. the ISSN-to-ISSN-L.txt file of the ISSN International Centre
+	ISSNLTable string `json:"issnltable"`
 }
 
+// defaultTrashRetentionDays applies when the conf file doesn't say
+const defaultTrashRetentionDays = 30
+
 // GetConfig generates a Conf object from a json file
 func GetConfig() Conf {
 
@@ -34,5 +41,9 @@ func GetConfig() Conf {
 		os.Exit(1)
 	}
 
+	if config.TrashRetentionDays <= 0 {
+		config.TrashRetentionDays = defaultTrashRetentionDays
+	}
+
 	return config
 }
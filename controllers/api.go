@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/nicomo/abacaxi/logger"
+)
+
+const (
+	apiDefaultLimit = 100  // number of items returned by a list, unless asked otherwise
+	apiMaxLimit     = 1000 // max number of items returned by a list
+	apiMaxBodySize  = 1 << 20
+)
+
+// apiPage wraps a paginated list returned by the JSON API
+type apiPage struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Items  interface{} `json:"items"`
+}
+
+// apiWriteJSON sends v as a json response with the given status
+func apiWriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error.Printf("couldn't encode json response: %v", err)
+	}
+}
+
+// apiWriteError sends an error message as a json response
+func apiWriteError(w http.ResponseWriter, status int, msg string) {
+	apiWriteJSON(w, status, map[string]string{"error": msg})
+}
+
+// apiReadJSON decodes the json body of a request into v
+func apiReadJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+	if err := dec.Decode(v); err != nil {
+		return errors.New("malformed json body: " + err.Error())
+	}
+	return nil
+}
+
+// apiGetPagination reads the offset & limit query params
+func apiGetPagination(r *http.Request) (int, int, error) {
+	offset, limit := 0, apiDefaultLimit
+
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return offset, limit, errors.New("offset must be a positive integer")
+		}
+		offset = n
+	}
+
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > apiMaxLimit {
+			return offset, limit, errors.New("limit must be an integer between 1 and " + strconv.Itoa(apiMaxLimit))
+		}
+		limit = n
+	}
+
+	return offset, limit, nil
+}
+
+// getBoolParam reads an optional boolean query or form param
+// returns nil if the param is absent or empty
+func getBoolParam(r *http.Request, name string) (*bool, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, errors.New(name + " must be true or false")
+	}
+	return &b, nil
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+)
+
+// apiGetJobFromVars retrieves the job whose ID is in the router variables
+// and writes the error response if there's none
+func apiGetJobFromVars(w http.ResponseWriter, r *http.Request) (models.Job, bool) {
+	jobID := mux.Vars(r)["jobID"]
+	if !bson.IsObjectIdHex(jobID) {
+		apiWriteError(w, http.StatusBadRequest, "invalid job ID")
+		return models.Job{}, false
+	}
+
+	job, err := models.JobGetByID(jobID)
+	if err != nil {
+		apiWriteError(w, http.StatusNotFound, "job not found")
+		return job, false
+	}
+
+	return job, true
+}
+
+// APIJobsHandler lists jobs, most recent first, paginated
+// and optionally filtered on their status
+func APIJobsHandler(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := apiGetPagination(r)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status := -1
+	if v := r.FormValue("status"); v != "" {
+		status, err = strconv.Atoi(v)
+		if err != nil || status < 0 {
+			apiWriteError(w, http.StatusBadRequest, "status must be a positive integer")
+			return
+		}
+	}
+
+	jobs, total, err := models.JobsGet(status, offset, limit)
+	if err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't retrieve jobs")
+		return
+	}
+	if jobs == nil {
+		jobs = []models.Job{}
+	}
+
+	apiWriteJSON(w, http.StatusOK, apiPage{
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+		Items:  jobs,
+	})
+}
+
+// APIJobGetHandler retrieves a single job
+func APIJobGetHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := apiGetJobFromVars(w, r)
+	if !ok {
+		return
+	}
+	apiWriteJSON(w, http.StatusOK, job)
+}
+
+// APIJobCreateHandler queues a job retrieving Sudoc records for a target service.
+// Upload jobs are created by posting a file to /upload
+func APIJobCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var in models.Job
+	if err := apiReadJSON(w, r, &in); err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if in.JobType != models.JobSudocRecords {
+		apiWriteError(w, http.StatusUnprocessableEntity, "only sudoc jobs can be created through the API")
+		return
+	}
+	if _, err := models.GetTargetService(in.TSName); err != nil {
+		apiWriteError(w, http.StatusUnprocessableEntity, "unknown target service")
+		return
+	}
+
+	job := models.Job{
+		JobType:     models.JobSudocRecords,
+		TSName:      in.TSName,
+		User:        getUsername(r),
+		MaxAttempts: jobSudocMaxAttempts,
+	}
+	if err := models.JobCreate(&job); err != nil {
+		if err == models.ErrJobDuplicate {
+			apiWriteError(w, http.StatusConflict, err.Error())
+			return
+		}
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't queue job")
+		return
+	}
+
+	apiWriteJSON(w, http.StatusCreated, job)
+}
+
+// APIJobCancelHandler cancels a queued job, or asks a running job to stop
+func APIJobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := apiGetJobFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	if err := models.JobCancel(job.ID.Hex()); err != nil {
+		apiWriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	job, _ = models.JobGetByID(job.ID.Hex())
+	apiWriteJSON(w, http.StatusOK, job)
+}
+
+// APIJobRetryHandler queues again a failed or cancelled job
+func APIJobRetryHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := apiGetJobFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	if err := models.JobRetry(job.ID.Hex()); err != nil {
+		apiWriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	job, _ = models.JobGetByID(job.ID.Hex())
+	apiWriteJSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,343 @@
+package controllers
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+)
+
+// getRecordsFilter builds a records filter from the query params of a request:
+// ts, q, acquired, active, unimarc, ppn
+func getRecordsFilter(r *http.Request) (models.RecordsFilter, error) {
+	var (
+		f   models.RecordsFilter
+		err error
+	)
+
+	f.TSName = r.FormValue("ts")
+	f.Text = r.FormValue("q")
+	f.Trash = r.FormValue("trash") == "true"
+
+	if f.Acquired, err = getBoolParam(r, "acquired"); err != nil {
+		return f, err
+	}
+	if f.Active, err = getBoolParam(r, "active"); err != nil {
+		return f, err
+	}
+	if f.HasUnimarc, err = getBoolParam(r, "unimarc"); err != nil {
+		return f, err
+	}
+	if f.HasPPN, err = getBoolParam(r, "ppn"); err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+// apiGetRecordFromVars retrieves the record whose ID is in the router variables
+// and writes the error response if there's none
+func apiGetRecordFromVars(w http.ResponseWriter, r *http.Request) (models.Record, bool) {
+	recordID := mux.Vars(r)["recordID"]
+	if !bson.IsObjectIdHex(recordID) {
+		apiWriteError(w, http.StatusBadRequest, "invalid record ID")
+		return models.Record{}, false
+	}
+
+	record, err := models.RecordGetByID(recordID)
+	if err != nil {
+		apiWriteError(w, http.StatusNotFound, "record not found")
+		return record, false
+	}
+
+	return record, true
+}
+
+// apiRecordTargetServices replaces the target services sent by the client
+// with the ones stored in DB, matched on name, keeping the coverage in each package sent by the client.
+// returns true if one of them is active
+func apiRecordTargetServices(record *models.Record) (bool, error) {
+	var (
+		targetServices []models.TargetService
+		active         bool
+	)
+	for _, v := range record.TargetServices {
+		ts, err := models.GetTargetService(v.Name)
+		if err != nil {
+			return active, err
+		}
+		if ts.Active {
+			active = true
+		}
+		ts.Coverage = v.Coverage
+		targetServices = append(targetServices, ts)
+	}
+	record.TargetServices = targetServices
+	return active, nil
+}
+
+// APIRecordsHandler lists records, paginated & filtered
+func APIRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := apiGetPagination(r)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f, err := getRecordsFilter(r)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	records, err := models.RecordsGet(f, offset, limit)
+	if err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't retrieve records")
+		return
+	}
+	if records == nil {
+		records = []models.Record{}
+	}
+
+	apiWriteJSON(w, http.StatusOK, apiPage{
+		Total:  models.RecordsCountFiltered(f),
+		Offset: offset,
+		Limit:  limit,
+		Items:  records,
+	})
+}
+
+// APIRecordGetHandler retrieves a single record
+func APIRecordGetHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := apiGetRecordFromVars(w, r)
+	if !ok {
+		return
+	}
+	apiWriteJSON(w, http.StatusOK, record)
+}
+
+// APIRecordRevisionsHandler retrieves the history of a record, most recent first.
+// The history of a deleted record is still available
+func APIRecordRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	recordID := mux.Vars(r)["recordID"]
+	if !bson.IsObjectIdHex(recordID) {
+		apiWriteError(w, http.StatusBadRequest, "invalid record ID")
+		return
+	}
+
+	revisions, err := models.RevisionsGetByRecordID(recordID)
+	if err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't retrieve revisions")
+		return
+	}
+	if revisions == nil {
+		revisions = []models.Revision{}
+	}
+	apiWriteJSON(w, http.StatusOK, revisions)
+}
+
+// APIRecordCreateHandler creates a record, or merges it into an existing record
+// having one of the same identifiers, the same way file uploads do
+func APIRecordCreateHandler(w http.ResponseWriter, r *http.Request) {
+	apiRecordCreate(w, r, "")
+}
+
+// APITargetServiceRecordCreateHandler adds a single title to a target service:
+// it creates the record, or merges it into an existing record as APIRecordCreateHandler does,
+// and attaches it to the target service
+func APITargetServiceRecordCreateHandler(w http.ResponseWriter, r *http.Request) {
+	tsname := mux.Vars(r)["targetservice"]
+	if _, err := models.GetTargetService(tsname); err != nil {
+		apiWriteError(w, http.StatusNotFound, "target service not found")
+		return
+	}
+	apiRecordCreate(w, r, tsname)
+}
+
+// apiRecordCreate creates or merges the record sent by the client,
+// attached to the target service tsname too if it isn't empty
+func apiRecordCreate(w http.ResponseWriter, r *http.Request, tsname string) {
+	var in models.Record
+	if err := apiReadJSON(w, r, &in); err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// clean up identifiers as we would for a file
+	record := in
+	record.ID = ""
+	record.Identifiers = nil
+	for _, v := range in.Identifiers {
+		if v.IDType == models.IDTypePrint || v.IDType == models.IDTypeOnline {
+			getIdentifiers(v.Identifier, &record, v.IDType)
+			continue
+		}
+		id, err := cleanIdentifier(v)
+		if err != nil {
+			apiWriteError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		record.Identifiers = append(record.Identifiers, id)
+	}
+	record.AddTitleIdentifiers()
+
+	if problems := record.Validate(); len(problems) > 0 {
+		apiWriteError(w, http.StatusUnprocessableEntity, apiProblems(problems))
+		return
+	}
+
+	if tsname != "" && !recordInTargetService(record, tsname) {
+		record.TargetServices = append(record.TargetServices, models.TargetService{Name: tsname})
+	}
+
+	// a record in an active target service is active, as with file uploads
+	active, err := apiRecordTargetServices(&record)
+	if err != nil {
+		apiWriteError(w, http.StatusUnprocessableEntity, "unknown target service")
+		return
+	}
+	if active {
+		record.Active = true
+	}
+
+	_, inserted, err := record.RecordUpsert(getChangeSource(r))
+	if err == models.ErrRecordInTrash {
+		apiWriteError(w, http.StatusConflict, err.Error()+": "+record.ID.Hex())
+		return
+	}
+	if err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't save record")
+		return
+	}
+
+	saved, err := models.RecordGetByID(record.ID.Hex())
+	if err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't retrieve saved record")
+		return
+	}
+
+	status := http.StatusOK
+	if inserted > 0 {
+		status = http.StatusCreated
+	}
+	apiWriteJSON(w, status, saved)
+}
+
+// recordInTargetService tells whether a record belongs to a target service
+func recordInTargetService(record models.Record, tsname string) bool {
+	for _, ts := range record.TargetServices {
+		if ts.Name == tsname {
+			return true
+		}
+	}
+	return false
+}
+
+// apiProblems joins the problems found in a record into a single error message
+func apiProblems(problems []models.FieldError) string {
+	var msg []string
+	for _, p := range problems {
+		msg = append(msg, p.Error())
+	}
+	return strings.Join(msg, " ; ")
+}
+
+// APIRecordUpdateHandler updates a record. Fields absent from the json body are left untouched.
+// A record in the trash can't be updated, and the fields of the trash can only be changed by deleting & restoring the record
+func APIRecordUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := apiGetRecordFromVars(w, r)
+	if !ok {
+		return
+	}
+	if record.Deleted {
+		apiWriteError(w, http.StatusConflict, "only a record out of the trash can be updated")
+		return
+	}
+
+	// protected fields
+	before := record
+	record.FieldSources = nil
+
+	if err := apiReadJSON(w, r, &record); err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	record.ID, record.DateCreated = before.ID, before.DateCreated
+	record.Deleted, record.DateDeleted, record.DeletedBy = before.Deleted, before.DateDeleted, before.DeletedBy
+	record.MergedInto = before.MergedInto
+	record.EditCoverage(before)
+	record.SetManualSources(before)
+
+	for i, v := range record.Identifiers {
+		id, err := cleanIdentifier(v)
+		if err != nil {
+			apiWriteError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		record.Identifiers[i] = id
+	}
+
+	if problems := record.Validate(); len(problems) > 0 {
+		apiWriteError(w, http.StatusUnprocessableEntity, apiProblems(problems))
+		return
+	}
+
+	// an identifier belongs to a single record
+	taken, err := record.IdentifiersTaken()
+	if err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't check the identifiers")
+		return
+	}
+	if len(taken) > 0 {
+		var msg []string
+		for id, recordID := range taken {
+			msg = append(msg, id+" already belongs to the record "+recordID.Hex())
+		}
+		sort.Strings(msg)
+		apiWriteError(w, http.StatusUnprocessableEntity, strings.Join(msg, " ; "))
+		return
+	}
+
+	if _, err := apiRecordTargetServices(&record); err != nil {
+		apiWriteError(w, http.StatusUnprocessableEntity, "unknown target service")
+		return
+	}
+
+	if err := record.RecordUpdate(getChangeSource(r)); err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't save record")
+		return
+	}
+
+	apiWriteJSON(w, http.StatusOK, record)
+}
+
+// APIRecordDeleteHandler deletes a record
+func APIRecordDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := apiGetRecordFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	if err := models.RecordDelete(record.ID.Hex(), getChangeSource(r)); err != nil {
+		if err == models.ErrRecordDeleted {
+			apiWriteError(w, http.StatusConflict, err.Error())
+			return
+		}
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't delete record")
+		return
+	}
+
+	apiWriteJSON(w, http.StatusNoContent, nil)
+}
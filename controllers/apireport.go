@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+)
+
+// apiGetReportFromVars retrieves the report whose ID is in the router variables
+// and writes the error response if there's none
+func apiGetReportFromVars(w http.ResponseWriter, r *http.Request) (models.Report, bool) {
+	reportID := mux.Vars(r)["reportID"]
+	if !bson.IsObjectIdHex(reportID) {
+		apiWriteError(w, http.StatusBadRequest, "invalid report ID")
+		return models.Report{}, false
+	}
+
+	report, err := models.ReportGetByID(reportID)
+	if err != nil {
+		apiWriteError(w, http.StatusNotFound, "report not found")
+		return report, false
+	}
+
+	return report, true
+}
+
+// APIReportsHandler lists reports, most recent first, paginated
+// and optionally filtered on the type of batch operation
+func APIReportsHandler(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := apiGetPagination(r)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	reportType := -1
+	if v := r.FormValue("type"); v != "" {
+		reportType, err = strconv.Atoi(v)
+		if err != nil || reportType < 0 {
+			apiWriteError(w, http.StatusBadRequest, "type must be a positive integer")
+			return
+		}
+	}
+
+	reports, total, err := models.ReportsGetPage(reportType, offset, limit)
+	if err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't retrieve reports")
+		return
+	}
+	if reports == nil {
+		reports = []models.Report{}
+	}
+
+	apiWriteJSON(w, http.StatusOK, apiPage{
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+		Items:  reports,
+	})
+}
+
+// APIReportGetHandler retrieves a single report
+func APIReportGetHandler(w http.ResponseWriter, r *http.Request) {
+	report, ok := apiGetReportFromVars(w, r)
+	if !ok {
+		return
+	}
+	apiWriteJSON(w, http.StatusOK, report)
+}
+
+// APIReportCreateHandler saves a report, e.g. about a batch operation run by a script
+func APIReportCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var report models.Report
+	if err := apiReadJSON(w, r, &report); err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := report.ReportCreate(); err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't save report")
+		return
+	}
+
+	apiWriteJSON(w, http.StatusCreated, report)
+}
+
+// APIReportUpdateHandler updates a report. Fields absent from the json body are left untouched
+func APIReportUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	report, ok := apiGetReportFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	// protected fields
+	ID, dateCreated := report.ID, report.DateCreated
+
+	if err := apiReadJSON(w, r, &report); err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report.ID, report.DateCreated = ID, dateCreated
+
+	if err := report.ReportUpdate(); err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't save report")
+		return
+	}
+
+	apiWriteJSON(w, http.StatusOK, report)
+}
+
+// APIReportDeleteHandler deletes a report
+func APIReportDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	report, ok := apiGetReportFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	if err := models.ReportDelete(report.ID.Hex()); err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't delete report")
+		return
+	}
+
+	apiWriteJSON(w, http.StatusNoContent, nil)
+}
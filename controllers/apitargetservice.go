@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+)
+
+// apiTargetService is a target service as returned by the JSON API
+type apiTargetService struct {
+	models.TargetService
+	RecordsCount        int
+	RecordsUnimarcCount int
+}
+
+func newAPITargetService(ts models.TargetService) apiTargetService {
+	return apiTargetService{
+		TargetService:       ts,
+		RecordsCount:        models.TSCountRecords(ts.Name),
+		RecordsUnimarcCount: models.TSCountRecordsUnimarc(ts.Name),
+	}
+}
+
+// apiGetTargetServiceFromVars retrieves the target service whose name is in the router variables
+// and writes the error response if there's none
+func apiGetTargetServiceFromVars(w http.ResponseWriter, r *http.Request) (models.TargetService, bool) {
+	ts, err := models.GetTargetService(mux.Vars(r)["targetservice"])
+	if err != nil {
+		apiWriteError(w, http.StatusNotFound, "target service not found")
+		return ts, false
+	}
+	return ts, true
+}
+
+// APITargetServicesHandler lists target services, paginated
+func APITargetServicesHandler(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := apiGetPagination(r)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	TSListing, err := models.GetTargetServicesListing()
+	if err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't retrieve target services")
+		return
+	}
+
+	// the list of target services is short, we paginate in memory
+	items := []apiTargetService{}
+	for i := offset; i < len(TSListing) && i < offset+limit; i++ {
+		items = append(items, newAPITargetService(TSListing[i]))
+	}
+
+	apiWriteJSON(w, http.StatusOK, apiPage{
+		Total:  len(TSListing),
+		Offset: offset,
+		Limit:  limit,
+		Items:  items,
+	})
+}
+
+// APITargetServiceGetHandler retrieves a single target service
+func APITargetServiceGetHandler(w http.ResponseWriter, r *http.Request) {
+	ts, ok := apiGetTargetServiceFromVars(w, r)
+	if !ok {
+		return
+	}
+	apiWriteJSON(w, http.StatusOK, newAPITargetService(ts))
+}
+
+// APITargetServiceCreateHandler registers a new target service
+func APITargetServiceCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var ts models.TargetService
+	if err := apiReadJSON(w, r, &ts); err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ts.ID = ""
+
+	if ts.Name == "" || ts.DisplayName == "" {
+		apiWriteError(w, http.StatusUnprocessableEntity, "a target service needs a name and a display name")
+		return
+	}
+
+	if err := models.TSCreate(ts); err != nil {
+		apiWriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	created, err := models.GetTargetService(ts.Name)
+	if err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't retrieve saved target service")
+		return
+	}
+
+	apiWriteJSON(w, http.StatusCreated, newAPITargetService(created))
+}
+
+// APITargetServiceUpdateHandler updates a target service. The name can't be changed.
+// Changing "active" also changes the linked records, as in the UI
+func APITargetServiceUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	ts, ok := apiGetTargetServiceFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	// protected fields
+	ID, name, dateCreated, wasActive := ts.ID, ts.Name, ts.DateCreated, ts.Active
+
+	if err := apiReadJSON(w, r, &ts); err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ts.ID, ts.Name, ts.DateCreated = ID, name, dateCreated
+
+	if ts.DisplayName == "" {
+		apiWriteError(w, http.StatusUnprocessableEntity, "display name can't be empty")
+		return
+	}
+
+	if ts.Active != wasActive {
+		if err := models.TSSetRecordsActive(ts.Name, ts.Active, getChangeSource(r)); err != nil {
+			logger.Error.Println(err)
+		}
+	}
+
+	if err := models.TSUpdate(ts); err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't save target service")
+		return
+	}
+
+	apiWriteJSON(w, http.StatusOK, newAPITargetService(ts))
+}
+
+// APITargetServiceDeleteHandler deletes a target service
+// and de-activates the linked records if any
+func APITargetServiceDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	ts, ok := apiGetTargetServiceFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	if err := models.TSDelete(ts.Name); err != nil {
+		logger.Error.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "couldn't delete target service")
+		return
+	}
+
+	if err := models.TSDetachRecords(ts.Name, getChangeSource(r)); err != nil {
+		logger.Error.Printf("could not retrieve linked records: %v", err)
+	}
+
+	apiWriteJSON(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/marc"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+)
+
+// Bulk actions which aren't record updates
+const (
+	bulkSudoc         = "sudoc"
+	bulkExportKbart   = "exportkbart"
+	bulkExportUnimarc = "exportunimarc"
+	bulkExportMarc21  = "exportmarc21"
+)
+
+// getBulkBack returns the page a bulk action goes back to: the list the records were selected in,
+// or the reports if it can't be displayed again, e.g. search results
+func getBulkBack(r *http.Request) string {
+	back := r.PostFormValue("back")
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") {
+		return "/reports"
+	}
+	return back
+}
+
+// RecordsBulkHandler applies a bulk action to the records selected in a list of records:
+// set / clear Acquired & Active, attach to / detach from a target service, move to the trash,
+// fetch their Sudoc records in the background, or export them. Each action produces a report
+func RecordsBulkHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	if err := r.ParseForm(); err != nil {
+		logger.Error.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	back := getBulkBack(r)
+
+	var IDs []bson.ObjectId
+	for _, ID := range r.PostForm["id"] {
+		if bson.IsObjectIdHex(ID) {
+			IDs = append(IDs, bson.ObjectIdHex(ID))
+		}
+	}
+	if len(IDs) == 0 {
+		sess.AddFlash("No record selected")
+		sess.Save(r, w)
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	action := r.PostFormValue("action")
+	switch action {
+	case bulkExportKbart, bulkExportUnimarc, bulkExportMarc21:
+		bulkExport(w, r, action, IDs)
+		return
+	case bulkSudoc:
+		job := models.Job{
+			JobType:     models.JobSudocRecords,
+			RecordIDs:   IDs,
+			User:        getUsername(r),
+			MaxAttempts: jobSudocMaxAttempts,
+		}
+		if err := models.JobCreate(&job); err != nil {
+			logger.Error.Println(err)
+			sess.AddFlash(fmt.Sprintf("Request couldn't be queued: %v", err))
+			sess.Save(r, w)
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+		sess.AddFlash(fmt.Sprintf("Sudoc request for %d records is queued and will run in the background, result will be in the reports", len(IDs)))
+		sess.Save(r, w)
+		http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+		return
+	}
+
+	// the report ID is known up front, so that the changes made to records can be linked to it, and undone
+	tsname := r.PostFormValue("tsname")
+	report := models.Report{ID: bson.NewObjectId(), ReportType: models.Bulk}
+	src := getChangeSource(r)
+	src.ReportID = report.ID
+
+	result, err := models.RecordsBulkUpdate(IDs, action, tsname, src)
+	if err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("Bulk action failed: " + err.Error())
+		sess.Save(r, w)
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	label := models.BulkActionLabel(action, tsname)
+	report.Success = len(result.Failed) == 0
+	report.Text = append(report.Text,
+		fmt.Sprintf("Bulk action: %s, on %d records selected", label, len(IDs)),
+		fmt.Sprintf("%d records changed / %d records unchanged / %d records failed", result.Changed, result.Unchanged, len(result.Failed)))
+	report.Text = append(report.Text, result.Failed...)
+	if err := report.ReportCreate(); err != nil {
+		logger.Error.Printf("couldn't save the report to DB: %v", err)
+	}
+
+	sess.AddFlash(fmt.Sprintf("%s : %d records changed, %d unchanged, %d failed - see the reports", label, result.Changed, result.Unchanged, len(result.Failed)))
+	sess.Save(r, w)
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// bulkExport streams the records selected as a KBART file, or their Unimarc / MARC21 records,
+// with the package values & export rules of the target service of the list, if any
+func bulkExport(w http.ResponseWriter, r *http.Request, action string, IDs []bson.ObjectId) {
+	// none, gzip or zip
+	compression, err := getExportCompression(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tsname := r.PostFormValue("listts")
+	f := models.RecordsFilter{IDs: IDs, TSName: tsname}
+	hasMarc := true
+	name := "selection_" + time.Now().Format("2006-01-02_1504")
+
+	var (
+		label    string
+		filename string
+		write    func(io.Writer) (int, error)
+	)
+	switch action {
+	case bulkExportKbart:
+		label, filename = "KBART", name+".txt"
+		write = func(out io.Writer) (int, error) {
+			return models.WriteKbart(out, f)
+		}
+	default:
+		// iso2709, marcxml or json
+		format, err := getMarcExportFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// records without marc record have nothing to export
+		if action == bulkExportUnimarc {
+			f.HasUnimarc = &hasMarc
+			label, filename = "Unimarc "+format, name+marc.FormatExtension(format)
+			write = func(out io.Writer) (int, error) {
+				return models.WriteUnimarc(out, f, format, tsname)
+			}
+		} else {
+			label, filename = "MARC21 "+format, name+"_marc21"+marc.FormatExtension(format)
+			write = func(out io.Writer) (int, error) {
+				return models.WriteMarc21(out, f, format)
+			}
+		}
+	}
+
+	count, err := exportStream(w, filename, compression, write)
+
+	report := models.Report{ReportType: models.Export, Success: err == nil}
+	report.Text = append(report.Text,
+		fmt.Sprintf("%s export of a selection of %d records", label, len(IDs)),
+		fmt.Sprintf("%d records included / %d records excluded", count, len(IDs)-count))
+	if err != nil {
+		report.Text = append(report.Text, fmt.Sprintf("Export failed: %v", err))
+	}
+	if ErrReport := report.ReportCreate(); ErrReport != nil {
+		logger.Error.Printf("couldn't save the report to DB: %v", ErrReport)
+	}
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+	"github.com/nicomo/abacaxi/views"
+)
+
+// comparisonDisplayMax is the max number of titles listed in each part of a comparison page
+const comparisonDisplayMax = 500
+
+// getHoldings retrieves the holdings named by a request parameter, and a label for them:
+// the current holdings of a target service, given its name, or a snapshot, given as snapshot:{snapshotID}
+func getHoldings(r *http.Request, param string) (string, []models.Holding, error) {
+	tsname := r.FormValue(param)
+	if tsname == "" {
+		return "", nil, fmt.Errorf("%s: a target service is required", param)
+	}
+	if strings.HasPrefix(tsname, snapshotPrefix) {
+		return getSnapshotHoldings(param, tsname)
+	}
+	if _, err := models.GetTargetService(tsname); err != nil {
+		return tsname, nil, fmt.Errorf("%s: unknown target service %s", param, tsname)
+	}
+
+	holdings, err := models.TSHoldings(tsname)
+	return tsname, holdings, err
+}
+
+// getComparison compares the holdings named by the parameters a & b of a request
+func getComparison(r *http.Request) (string, string, models.HoldingsComparison, error) {
+	labelA, a, err := getHoldings(r, "a")
+	if err != nil {
+		return labelA, "", models.HoldingsComparison{}, err
+	}
+	labelB, b, err := getHoldings(r, "b")
+	if err != nil {
+		return labelA, labelB, models.HoldingsComparison{}, err
+	}
+
+	return labelA, labelB, models.CompareHoldings(a, b), nil
+}
+
+// CompareHandler displays the comparison of the holdings of 2 target services:
+// titles only in A, only in B, in both, and the differences of coverage
+func CompareHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	d["a"], d["b"] = r.FormValue("a"), r.FormValue("b")
+
+	// list of TS appearing in menu, and in the form
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	// nothing to compare yet: only the form
+	if r.FormValue("a") == "" && r.FormValue("b") == "" {
+		views.RenderTmpl(w, "compare", d)
+		return
+	}
+
+	labelA, labelB, c, err := getComparison(r)
+	if err != nil {
+		logger.Error.Println(err)
+		d["ErrCompare"] = err
+		views.RenderTmpl(w, "compare", d)
+		return
+	}
+	d["labelA"], d["labelB"] = labelA, labelB
+
+	// snapshots aren't in the target services of the form
+	if strings.HasPrefix(r.FormValue("a"), snapshotPrefix) {
+		d["snapshotA"] = labelA
+	}
+	if strings.HasPrefix(r.FormValue("b"), snapshotPrefix) {
+		d["snapshotB"] = labelB
+	}
+
+	changed := c.Changed()
+	d["onlyACount"], d["onlyBCount"], d["bothCount"], d["changedCount"] = len(c.OnlyA), len(c.OnlyB), len(c.Both), len(changed)
+	d["overlapA"], d["overlapB"] = c.OverlapA(), c.OverlapB()
+
+	// only display the first titles of large packages, the export has them all
+	if len(c.OnlyA) > comparisonDisplayMax {
+		c.OnlyA = c.OnlyA[:comparisonDisplayMax]
+	}
+	if len(c.OnlyB) > comparisonDisplayMax {
+		c.OnlyB = c.OnlyB[:comparisonDisplayMax]
+	}
+	if len(changed) > comparisonDisplayMax {
+		changed = changed[:comparisonDisplayMax]
+	}
+	d["onlyA"], d["onlyB"], d["changed"] = c.OnlyA, c.OnlyB, changed
+	d["displayMax"] = comparisonDisplayMax
+
+	views.RenderTmpl(w, "compare", d)
+}
+
+// CompareExportHandler exports the comparison of the holdings of 2 target services, as a tab delimited file
+func CompareExportHandler(w http.ResponseWriter, r *http.Request) {
+	// none, gzip or zip
+	compression, err := getExportCompression(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	labelA, labelB, c, err := getComparison(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// errors are logged by exportStream
+	filename := fmt.Sprintf("compare_%s_%s_%s.txt", filenameLabel(labelA), filenameLabel(labelB), time.Now().Format("2006-01-02"))
+	exportStream(w, filename, compression, func(out io.Writer) (int, error) {
+		return models.WriteComparison(out, c)
+	})
+}
+
+// filenameLabel turns the label of holdings into a part of a file name, e.g. "CAIRN 2017-03-15 08:30" into CAIRN_2017-03-15_0830
+func filenameLabel(label string) string {
+	return strings.NewReplacer(" ", "_", ":", "", "/", "-").Replace(label)
+}
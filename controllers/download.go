@@ -1,41 +1,192 @@
 package controllers
 
 import (
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
-	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
 
-	"github.com/nicomo/abacaxi/config"
 	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/marc"
+	"github.com/nicomo/abacaxi/models"
 )
 
-func exportFile(w http.ResponseWriter, r *http.Request, filename string, filesize int64) error {
+// Compression of the exports
+const (
+	compressionGzip = "gzip"
+	compressionZip  = "zip"
+)
 
-	// create a client with hostname from configuration
-	conf := config.GetConfig()
-	client := &http.Client{}
+// errUnknownCompression is returned when asked for a compression we don't know
+var errUnknownCompression = errors.New("unknown compression, expected gzip or zip")
 
-	resp, err := client.Get(conf.Hostname + "/static/downloads/" + filename)
-	if err != nil {
-		logger.Error.Println(err)
-		return err
+// getExportCompression reads the compression requested for an export: none by default, gzip or zip
+func getExportCompression(r *http.Request) (string, error) {
+	compression := r.FormValue("compression")
+	switch compression {
+	case "", compressionGzip, compressionZip:
+		return compression, nil
+	}
+	return "", errUnknownCompression
+}
+
+// countingWriter counts the bytes actually sent to the client
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// exportStream streams an export straight to the client, as write produces it, compressed or not.
+// Nothing is written to disk. It returns what write returns: the number of records exported.
+// The client gets an error page as long as nothing was sent yet, a truncated file otherwise
+func exportStream(w http.ResponseWriter, filename, compression string, write func(io.Writer) (int, error)) (int, error) {
+	cw := &countingWriter{w: w}
+	out := io.Writer(cw)
+	closeOut := func() error { return nil }
+
+	switch compression {
+	case compressionGzip:
+		gw := gzip.NewWriter(cw)
+		gw.Name = filename
+		out, closeOut = gw, gw.Close
+		filename += ".gz"
+	case compressionZip:
+		zw := zip.NewWriter(cw)
+		fw, err := zw.Create(filename)
+		if err != nil {
+			logger.Error.Printf("couldn't start the zip archive %s: %v", filename, err)
+			http.Error(w, "couldn't export the records", http.StatusInternalServerError)
+			return 0, err
+		}
+		out, closeOut = fw, zw.Close
+		filename = strings.TrimSuffix(filename, path.Ext(filename)) + ".zip"
 	}
-	defer resp.Body.Close()
 
-	//stream the body, which is a Reader, to the client without fully loading it into memory
-	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-	written, err := io.Copy(w, resp.Body)
+	setExportHeaders(w, filename)
+
+	count, err := write(out)
+	if err == nil {
+		err = closeOut()
+	}
 	if err != nil {
-		logger.Error.Println(err)
-		return err
+		exportFailed(w, cw, filename, err)
 	}
 
-	// make sure download went OK, then delete file on server
-	if filesize == written {
-		ErrFDelete := os.Remove("./static/downloads/" + filename)
-		if ErrFDelete != nil {
-			logger.Error.Println(ErrFDelete)
+	return count, err
+}
+
+// exportPart is one of the files of an export made of several files
+type exportPart struct {
+	name  string
+	write func(io.Writer) (int, error)
+}
+
+// exportZipStream streams the files of an export straight to the client, in a zip archive.
+// It returns the number of records exported in each file
+func exportZipStream(w http.ResponseWriter, zipname string, parts []exportPart) ([]int, error) {
+	cw := &countingWriter{w: w}
+	zw := zip.NewWriter(cw)
+	setExportHeaders(w, zipname)
+
+	counts := make([]int, len(parts))
+	var err error
+	for i, part := range parts {
+		var fw io.Writer
+		if fw, err = zw.Create(part.name); err != nil {
+			break
+		}
+		if counts[i], err = part.write(fw); err != nil {
+			break
 		}
 	}
-	return nil
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		exportFailed(w, cw, zipname, err)
+	}
+
+	return counts, err
+}
+
+// setExportHeaders tells the client an export is coming as a file to download
+func setExportHeaders(w http.ResponseWriter, filename string) {
+	contentType := mime.TypeByExtension(path.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+}
+
+// exportFailed logs an export which failed, and tells the client if nothing was sent yet
+func exportFailed(w http.ResponseWriter, cw *countingWriter, filename string, err error) {
+	logger.Error.Printf("couldn't stream the export %s: %v", filename, err)
+	if cw.n == 0 {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "couldn't export the records", http.StatusInternalServerError)
+	}
+}
+
+// getMarcExportFormat reads the marc export format requested, MarcXML by default
+func getMarcExportFormat(r *http.Request) (string, error) {
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		return marc.FormatMarcXML, nil
+	case marc.FormatISO2709, marc.FormatMarcXML, marc.FormatJSON:
+		return format, nil
+	}
+	return "", marc.ErrUnknownFormat
+}
+
+// exportFilters are the filters of the export forms: param name -> labels for any, true, false
+var exportFilters = map[string][]string{
+	"active":   {"Active or not", "Active", "Inactive"},
+	"acquired": {"Acquired or not", "Acquired", "Not acquired"},
+	"unimarc":  {"With or without Unimarc", "With Unimarc", "Without Unimarc"},
+	"ppn":      {"With or without PPN", "With PPN", "Without PPN"},
+}
+
+// getExportFilter reads the filters of an export of the records of a target service:
+// active, acquired, unimarc, ppn (true / false). Without any, all the records are exported.
+// The records in the trash are never exported
+func getExportFilter(r *http.Request, tsname string) (models.RecordsFilter, error) {
+	f, err := getRecordsFilter(r)
+	f.TSName, f.Text = tsname, ""
+	f.Trash, f.IDs = false, nil
+	return f, err
+}
+
+// exportReport saves a report telling how many records of a target service an export included, and how many it left out.
+// notes are added to the report, e.g. the file written. It returns the ID of the report
+func exportReport(exportType, tsname string, f models.RecordsFilter, included int, exportErr error, notes ...string) bson.ObjectId {
+	total := models.TSCountRecords(tsname)
+
+	report := models.Report{ReportType: models.Export, Success: exportErr == nil}
+	report.Text = append(report.Text,
+		fmt.Sprintf("%s export of %s : %s", exportType, tsname, f),
+		fmt.Sprintf("%d records included / %d records excluded", included, total-included))
+	report.Text = append(report.Text, notes...)
+	if exportErr != nil {
+		report.Text = append(report.Text, fmt.Sprintf("Export failed: %v", exportErr))
+	}
+
+	if err := report.ReportCreate(); err != nil {
+		logger.Error.Printf("couldn't save the report to DB: %v", err)
+	}
+	return report.ID
 }
@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+	"github.com/nicomo/abacaxi/views"
+)
+
+// duplicatesPageSize is the number of duplicate candidates reviewed per page
+const duplicatesPageSize = 50
+
+// runFindDuplicatesJob looks for the records which may be duplicates, and reports on it
+func runFindDuplicatesJob(job *models.Job) error {
+	compared, found, err := models.DuplicatesFind()
+
+	report := models.Report{ReportType: models.Duplicates, Success: err == nil}
+	report.Text = append(report.Text,
+		fmt.Sprintf("%d records compared", compared),
+		fmt.Sprintf("%d pairs of possible duplicates to review", found))
+	if err != nil {
+		report.Text = append(report.Text, fmt.Sprintf("Search for duplicates failed: %v", err))
+	}
+	if ErrReport := report.ReportCreate(); ErrReport != nil {
+		logger.Error.Printf("couldn't save the report to DB: %v", ErrReport)
+	}
+
+	return err
+}
+
+// DuplicatesHandler lists the pairs of possible duplicates waiting for a review, most similar first
+func DuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	// Get flash messages, if any.
+	if flashes := sess.Flashes(); len(flashes) > 0 {
+		d["Flashes"] = flashes
+	}
+	sess.Save(r, w)
+
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	pairs, err := models.DuplicatesGetPending((page-1)*duplicatesPageSize, duplicatesPageSize)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	d["pairs"] = pairs
+
+	count := models.DuplicatesCount(models.DuplicatePending)
+	d["count"] = count
+	if page > 1 {
+		d["prevPage"] = page - 1
+	}
+	if page*duplicatesPageSize < count {
+		d["nextPage"] = page + 1
+	}
+
+	// list of TS appearing in menu
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	views.RenderTmpl(w, "duplicates", d)
+}
+
+// DuplicatesFindHandler queues a job looking for the records which may be duplicates
+func DuplicatesFindHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	job := models.Job{JobType: models.JobFindDuplicates, User: getUsername(r)}
+	if err := models.JobCreate(&job); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash(fmt.Sprintf("Search for duplicates couldn't be queued: %v", err))
+		sess.Save(r, w)
+		http.Redirect(w, r, "/duplicates", http.StatusSeeOther)
+		return
+	}
+
+	sess.AddFlash("Search for duplicates queued, the pairs found will be listed here when it's done")
+	sess.Save(r, w)
+	http.Redirect(w, r, "/duplicates", http.StatusSeeOther)
+}
+
+// DuplicateMergeHandler merges a pair of duplicates into the record chosen
+func DuplicateMergeHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	keep := r.FormValue("keep")
+	if !bson.IsObjectIdHex(keep) {
+		http.Redirect(w, r, "/duplicates", http.StatusSeeOther)
+		return
+	}
+
+	merged, err := models.DuplicateMerge(mux.Vars(r)["duplicateID"], bson.ObjectIdHex(keep), getChangeSource(r))
+	if err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("Couldn't merge the records: " + err.Error())
+		sess.Save(r, w)
+		http.Redirect(w, r, "/duplicates", http.StatusSeeOther)
+		return
+	}
+
+	sess.AddFlash(fmt.Sprintf("Records merged into %s, the other one is in the trash", merged.PublicationTitle))
+	sess.Save(r, w)
+	http.Redirect(w, r, "/duplicates", http.StatusSeeOther)
+}
+
+// DuplicateDismissHandler marks a pair of possible duplicates as 2 different titles
+func DuplicateDismissHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	if err := models.DuplicateDismiss(mux.Vars(r)["duplicateID"], getChangeSource(r)); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("Couldn't dismiss the pair: " + err.Error())
+		sess.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/duplicates", http.StatusSeeOther)
+}
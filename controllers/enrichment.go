@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+	"github.com/nicomo/abacaxi/views"
+)
+
+// TargetServiceEnrichmentGetHandler displays the form to edit the rules
+// enriching the Unimarc records of a target service on export
+func TargetServiceEnrichmentGetHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	// Get flash messages, if any.
+	sess := session.Instance(r)
+	if flashes := sess.Flashes(); len(flashes) > 0 {
+		d["Flashes"] = flashes
+	}
+	sess.Save(r, w)
+
+	tsname := mux.Vars(r)["targetservice"]
+	myTS, err := models.GetTargetService(tsname)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	d["myTS"] = myTS
+
+	set, err := models.EnrichmentRulesGet(tsname)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	if len(set.Rules) > 0 {
+		d["rulesText"] = models.EnrichmentRulesText(set.Rules)
+	} else { // suggest the default rules
+		d["rulesText"] = models.DefaultEnrichmentRules
+		d["defaultRules"] = true
+	}
+
+	// list of TS appearing in menu
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	views.RenderTmpl(w, "tsenrichment", d)
+}
+
+// TargetServiceEnrichmentPostHandler saves the enrichment rules of a target service
+func TargetServiceEnrichmentPostHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	tsname := mux.Vars(r)["targetservice"]
+	myTS, err := models.GetTargetService(tsname)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	d["myTS"] = myTS
+
+	// list of TS appearing in menu
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	rulesText := r.PostFormValue("rules")
+	d["rulesText"] = rulesText
+
+	rules, err := models.ParseEnrichmentRules(rulesText)
+	if err != nil {
+		d["ErrRules"] = err
+		views.RenderTmpl(w, "tsenrichment", d)
+		return
+	}
+
+	set := models.EnrichmentRuleSet{TSName: tsname, Rules: rules}
+	if err := models.EnrichmentRulesSave(set); err != nil {
+		logger.Error.Println(err)
+		d["ErrRules"] = err
+		views.RenderTmpl(w, "tsenrichment", d)
+		return
+	}
+
+	sess := session.Instance(r)
+	sess.AddFlash("Enrichment rules saved")
+	sess.Save(r, w)
+	http.Redirect(w, r, "/ts/display/"+tsname, http.StatusSeeOther)
+}
@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/marc"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+	"github.com/nicomo/abacaxi/views"
+)
+
+const (
+	exportSchedulerInterval       = time.Minute // schedules are precise to the minute
+	jobScheduledExportMaxAttempts = 1           // the next run catches up, changed records included
+)
+
+// StartExportScheduler queues the scheduled exports when they are due, in the background
+func StartExportScheduler() {
+	go func() {
+		for t := range time.Tick(exportSchedulerInterval) {
+			queueDueExports(t)
+		}
+	}()
+}
+
+// queueDueExports queues a job for each export due at t
+func queueDueExports(t time.Time) {
+	due, err := models.ExportSchedulesClaimDue(t)
+	if err != nil {
+		logger.Error.Printf("couldn't retrieve the scheduled exports: %v", err)
+		return
+	}
+
+	for _, s := range due {
+		if err := queueScheduledExport(s, "scheduler"); err != nil {
+			logger.Error.Printf("couldn't queue the scheduled export %s: %v", s.ID.Hex(), err)
+		}
+	}
+}
+
+// queueScheduledExport creates the job running a scheduled export
+func queueScheduledExport(s models.ExportSchedule, user string) error {
+	job := models.Job{
+		JobType:     models.JobScheduledExport,
+		TSName:      s.TSName,
+		ScheduleID:  s.ID,
+		User:        user,
+		MaxAttempts: jobScheduledExportMaxAttempts,
+	}
+	return models.JobCreate(&job)
+}
+
+// runScheduledExportJob writes the file of a scheduled export to its destination, and reports on it
+func runScheduledExportJob(job *models.Job) error {
+	s, err := models.ExportScheduleGetByID(job.ScheduleID.Hex())
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+
+	f := s.Filter
+	f.TSName = s.TSName
+	f.Trash, f.IDs = false, nil
+	if s.ChangedOnly && !s.LastRun.IsZero() {
+		f.Since = s.LastRun
+	}
+	// records without Unimarc have nothing to export
+	if s.ExportType != models.ExportKbart && f.HasUnimarc == nil {
+		hasUnimarc := true
+		f.HasUnimarc = &hasUnimarc
+	}
+
+	label := "Scheduled " + s.ExportType
+	if s.Format != "" {
+		label += " " + s.Format
+	}
+
+	count, fpath, err := writeScheduledExport(s, f, started)
+	reportID := exportReport(label, s.TSName, f, count, err, "File : "+fpath)
+	if err != nil {
+		// the last run isn't updated, so that the next one includes the changes this one missed
+		return err
+	}
+
+	return models.ExportScheduleRunDone(s.ID, started, reportID)
+}
+
+// writeScheduledExport writes the file of a scheduled export to its destination directory.
+// The file is written under a temporary name, then renamed, so that the ILS loader never picks a partial file.
+// It returns the number of records exported and the path of the file
+func writeScheduledExport(s models.ExportSchedule, f models.RecordsFilter, t time.Time) (int, string, error) {
+	var (
+		filename string
+		write    func(io.Writer) (int, error)
+	)
+
+	switch s.ExportType {
+	case models.ExportKbart:
+		myTS, err := models.GetTargetService(s.TSName)
+		if err != nil {
+			logger.Error.Println(err)
+			myTS.Name = s.TSName
+		}
+		// several runs a day mustn't replace a file the ILS loader hasn't collected yet: the time is added, as for MARC files
+		filename = strings.TrimSuffix(models.KbartFilename(myTS, t), ".txt") + "_" + t.Format("1504") + ".txt"
+		write = func(out io.Writer) (int, error) {
+			return models.WriteKbart(out, f)
+		}
+	case models.ExportUnimarc:
+		filename = s.TSName + "_" + t.Format("2006-01-02_1504") + marc.FormatExtension(s.Format)
+		write = func(out io.Writer) (int, error) {
+			return models.WriteUnimarc(out, f, s.Format, s.TSName)
+		}
+	case models.ExportMarc21:
+		filename = s.TSName + "_marc21_" + t.Format("2006-01-02_1504") + marc.FormatExtension(s.Format)
+		write = func(out io.Writer) (int, error) {
+			return models.WriteMarc21(out, f, s.Format)
+		}
+	default:
+		return 0, "", fmt.Errorf("unknown export type %s", s.ExportType)
+	}
+
+	fpath := filepath.Join(s.Destination, filename)
+	tmpPath := filepath.Join(s.Destination, "."+filename+".part")
+
+	// a file already there, e.g. from a run in the same minute, isn't replaced
+	if _, err := os.Stat(fpath); err == nil {
+		return 0, fpath, fmt.Errorf("%s already exists and wasn't collected yet", fpath)
+	}
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, fpath, err
+	}
+	count, err := write(file)
+	if ErrClose := file.Close(); err == nil {
+		err = ErrClose
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, fpath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+
+	return count, fpath, err
+}
+
+// ExportSchedulesHandler lists the scheduled exports, with the form to add one
+func ExportSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	// Get flash messages, if any.
+	if flashes := sess.Flashes(); len(flashes) > 0 {
+		d["Flashes"] = flashes
+	}
+	sess.Save(r, w)
+
+	schedules, err := models.ExportSchedulesGet()
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	d["schedules"] = schedules
+
+	// filters of the export form
+	d["exportFilters"] = exportFilters
+
+	// list of TS appearing in menu, and in the form
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	views.RenderTmpl(w, "exportschedules", d)
+}
+
+// ExportScheduleNewPostHandler saves a new scheduled export
+func ExportScheduleNewPostHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	tsname := r.PostFormValue("tsname")
+	f, err := getExportFilter(r, "")
+	if err != nil {
+		sess.AddFlash(err.Error())
+		sess.Save(r, w)
+		http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+		return
+	}
+
+	s := models.ExportSchedule{
+		TSName:      tsname,
+		ExportType:  r.PostFormValue("exporttype"),
+		Filter:      f,
+		Schedule:    r.PostFormValue("schedule"),
+		Destination: r.PostFormValue("destination"),
+		ChangedOnly: r.PostFormValue("changedonly") == "true",
+		Enabled:     true,
+		User:        getUsername(r),
+	}
+	if s.ExportType != models.ExportKbart {
+		s.Format = r.PostFormValue("format")
+	}
+
+	if err := models.ExportScheduleCreate(&s); err != nil {
+		sess.AddFlash("Couldn't save the scheduled export: " + err.Error())
+	} else {
+		sess.AddFlash(fmt.Sprintf("Scheduled export of %s saved, next run %s", tsname, s.NextRun.Format("2006-01-02 15:04")))
+	}
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
+
+// ExportScheduleToggleHandler enables or disables a scheduled export
+func ExportScheduleToggleHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	scheduleID := mux.Vars(r)["scheduleID"]
+	s, err := models.ExportScheduleGetByID(scheduleID)
+	if err == nil {
+		err = models.ExportScheduleSetEnabled(scheduleID, !s.Enabled)
+	}
+	if err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("Couldn't update the scheduled export: " + err.Error())
+		sess.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
+
+// ExportScheduleRunHandler runs a scheduled export right away, without changing its schedule
+func ExportScheduleRunHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	s, err := models.ExportScheduleGetByID(mux.Vars(r)["scheduleID"])
+	if err == nil {
+		err = queueScheduledExport(s, getUsername(r))
+	}
+	if err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("Couldn't run the scheduled export: " + err.Error())
+		sess.Save(r, w)
+		http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+		return
+	}
+
+	sess.AddFlash("Export of " + s.TSName + " queued")
+	sess.Save(r, w)
+	http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+}
+
+// ExportScheduleDeleteHandler removes a scheduled export. The files already written are left alone
+func ExportScheduleDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	if err := models.ExportScheduleDelete(mux.Vars(r)["scheduleID"]); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("Couldn't delete the scheduled export: " + err.Error())
+		sess.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"bufio"
 	"encoding/csv"
 	"errors"
 	"fmt"
@@ -16,24 +17,37 @@ const (
 	kbartNumFields = 25
 )
 
-func fileIO(pp parseparams, report *models.Report) ([]models.Record, error) {
+// rejectedLine is a line (or item) of a source file which couldn't be parsed
+type rejectedLine struct {
+	Line   int
+	Reason string
+}
+
+func fileIO(pp parseparams, report *models.Report) ([]models.Record, []rejectedLine, error) {
 	// slice will hold successfully parsed records
 	var records []models.Record
 
 	// retrieve target service (e.g. ebook package) for this file
 	myTS, err := models.GetTargetService(pp.tsname)
 	if err != nil {
-		return records, err
+		return records, nil, err
 	}
 
 	// open file
 	f, err := os.Open(pp.fpath)
 	if err != nil {
-		return nil, errors.New("cannot open the source file")
+		return nil, nil, errors.New("cannot open the source file")
 	}
 	defer f.Close()
 
-	reader := csv.NewReader(f)
+	// many publisher files start with a UTF-8 BOM, which would stick to the first value of the header:
+	// it's dropped before parsing
+	br := bufio.NewReader(f)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\uFEFF" {
+		br.Discard(3)
+	}
+
+	reader := csv.NewReader(br)
 
 	// target service csv has n fields, separator is provided
 	if pp.filetype == "publishercsv" {
@@ -44,20 +58,25 @@ func fileIO(pp parseparams, report *models.Report) ([]models.Record, error) {
 	reader.Comma = pp.delimiter
 
 	// counters to keep track of records parsed, for logging
-	line := 1
-	var rejectedLines []int
+	line := 0
+	var rejected []rejectedLine
 
 	for {
 		// read a row
 		r, err := reader.Read()
+		line++
 
 		// if at EOF, break out of loop
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			rejectedLines = append(rejectedLines, line)
-			line++
+			rejected = append(rejected, rejectedLine{line, err.Error()})
+			continue
+		}
+
+		// skip the kbart header
+		if line == 1 && pp.filetype == "kbart" && r[0] == "publication_title" {
 			continue
 		}
 
@@ -65,8 +84,8 @@ func fileIO(pp parseparams, report *models.Report) ([]models.Record, error) {
 		// if we do abort: source file isn't proper utf8
 		for _, v := range r {
 			if strings.ContainsRune(v, '\uFFFD') {
-				err := errors.New("parsing failed: non utf-8 character in file")
-				return records, err
+				err := fmt.Errorf("parsing failed: non utf-8 character in file, line %d", line)
+				return records, rejected, err
 			}
 		}
 
@@ -74,19 +93,20 @@ func fileIO(pp parseparams, report *models.Report) ([]models.Record, error) {
 		record, err := fileParseRow(r, pp.csvconf)
 		if err != nil {
 			logger.Error.Println(err, r)
+			rejected = append(rejected, rejectedLine{line, err.Error()})
 			continue
 		}
 
-		// add TS to record
-		record.TargetServices = append(record.TargetServices, myTS)
+		// add TS to record, with the coverage of the title in this package
+		ts := myTS
+		ts.Coverage = record.PackageCoverage()
+		record.TargetServices = append(record.TargetServices, ts)
 		if myTS.Active {
 			record.Active = true
 		}
 
 		// add record to slice
 		records = append(records, record)
-
-		line++
 	}
 
 	// log number of records successfully parsed
@@ -94,18 +114,22 @@ func fileIO(pp parseparams, report *models.Report) ([]models.Record, error) {
 		len(records), pp.fpath))
 
 	// log the lines we rejected, if any
-	if len(rejectedLines) > 0 {
+	if len(rejected) > 0 {
+		var rejectedLines []int
+		for _, v := range rejected {
+			rejectedLines = append(rejectedLines, v.Line)
+		}
 		report.Text = append(report.Text, fmt.Sprintf("lines rejected in source file: %v", rejectedLines))
 	}
 
 	// no records parsed
 	if len(records) == 0 {
 		err := errors.New("couldn't parse a single line: check your input file")
-		return records, err
+		return records, rejected, err
 
 	}
 
-	return records, nil
+	return records, rejected, nil
 }
 
 func fileParseRow(row []string, csvConf map[string]int) (models.Record, error) {
@@ -118,17 +142,9 @@ func fileParseRow(row []string, csvConf map[string]int) (models.Record, error) {
 
 		// ISBNs : validate & cleanup, convert isbn 10 <-> isbn13
 		// Identifiers Print ID
-		err := getIsbnIdentifiers(row[1], &record, models.IDTypePrint)
-		if err != nil && row[1] != "" { // doesn't look like an isbn, might be issn, cleanup and add as is
-			idCleaned := strings.Trim(strings.Replace(row[1], "-", "", -1), " ")
-			record.Identifiers = append(record.Identifiers, models.Identifier{Identifier: idCleaned, IDType: models.IDTypePrint})
-		}
+		getIdentifiers(row[1], &record, models.IDTypePrint)
 		// Identifiers Online ID
-		err = getIsbnIdentifiers(row[2], &record, models.IDTypeOnline)
-		if err != nil && row[2] != "" { // doesn't look like an isbn, might be issn, cleanup and add as is
-			idCleaned := strings.Trim(strings.Replace(row[2], "-", "", -1), " ")
-			record.Identifiers = append(record.Identifiers, models.Identifier{Identifier: idCleaned, IDType: models.IDTypeOnline})
-		}
+		getIdentifiers(row[2], &record, models.IDTypeOnline)
 
 		record.DateFirstIssueOnline = row[3]
 		record.NumFirstVolOnline = row[4]
@@ -157,18 +173,10 @@ func fileParseRow(row []string, csvConf map[string]int) (models.Record, error) {
 			record.PublicationTitle = row[i-1]
 		}
 		if i, ok := csvConf["identifierprint"]; ok {
-			err := getIsbnIdentifiers(row[i-1], &record, models.IDTypePrint)
-			if err != nil && row[i-1] != "" { // doesn't look like an isbn, might be issn, clean up and add as is
-				idCleaned := strings.Trim(strings.Replace(row[i-1], "-", "", -1), " ")
-				record.Identifiers = append(record.Identifiers, models.Identifier{Identifier: idCleaned, IDType: models.IDTypePrint})
-			}
+			getIdentifiers(row[i-1], &record, models.IDTypePrint)
 		}
 		if i, ok := csvConf["identifieronline"]; ok {
-			err := getIsbnIdentifiers(row[i-1], &record, models.IDTypeOnline)
-			if err != nil && row[i-1] != "" { // doesn't look like an isbn, might be issn, clean up and add as is
-				idCleaned := strings.Trim(strings.Replace(row[i-1], "-", "", -1), " ")
-				record.Identifiers = append(record.Identifiers, models.Identifier{Identifier: idCleaned, IDType: models.IDTypeOnline})
-			}
+			getIdentifiers(row[i-1], &record, models.IDTypeOnline)
 		}
 
 		if i, ok := csvConf["datefirstissueonline"]; ok {
@@ -239,8 +247,11 @@ func fileParseRow(row []string, csvConf map[string]int) (models.Record, error) {
 		}
 	}
 
+	// DOI, OCLC number or proprietary ID of the publisher
+	record.AddTitleIdentifiers()
+
 	if !validateRecord(record) {
-		recordNotValid := errors.New("record not valid")
+		recordNotValid := errors.New("record not valid: a title and at least one identifier are required")
 		return record, recordNotValid
 	}
 
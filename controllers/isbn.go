@@ -1,6 +1,11 @@
 package controllers
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/nicomo/abacaxi/issn"
+	"github.com/nicomo/abacaxi/logger"
 	"github.com/nicomo/abacaxi/models"
 	"github.com/terryh/goisbn"
 )
@@ -21,3 +26,65 @@ func getIsbnIdentifiers(s string, r *models.Record, idType int) error {
 
 	return nil
 }
+
+// getIssnIdentifiers adds an ISSN to the record in its canonical form, with its ISSN-L if it's another ISSN
+func getIssnIdentifiers(s string, r *models.Record, idType int) error {
+	i, err := issn.Parse(s)
+	if err != nil {
+		return err
+	}
+
+	r.Identifiers = append(r.Identifiers, models.Identifier{Identifier: string(i), IDType: idType})
+	if l := issn.Linking(i); l != i && !r.HasIdentifier(string(l)) {
+		r.Identifiers = append(r.Identifiers, models.Identifier{Identifier: string(l), IDType: models.IDTypeISSNL})
+	}
+
+	return nil
+}
+
+// getIdentifiers adds an identifier found in a source to the record:
+// ISBNs are validated, cleaned up & converted, ISSNs are validated & linked to their ISSN-L.
+// An ISSN with a wrong check digit is left out, anything else is added as is, minus the dashes and spaces
+func getIdentifiers(s string, r *models.Record, idType int) {
+	if s == "" {
+		return
+	}
+	if err := getIsbnIdentifiers(s, r, idType); err == nil {
+		return
+	}
+	switch err := getIssnIdentifiers(s, r, idType); err {
+	case nil:
+	case issn.ErrCheckDigit:
+		logger.Info.Printf("%s: %v", s, err)
+	default:
+		idCleaned := strings.Trim(strings.Replace(s, "-", "", -1), " ")
+		r.Identifiers = append(r.Identifiers, models.Identifier{Identifier: idCleaned, IDType: idType})
+	}
+}
+
+// cleanIdentifier validates a DOI, an OCLC number, an ISSN-L or a proprietary identifier given as is,
+// e.g. through the API, and returns it in its canonical form. Other identifiers are returned untouched
+func cleanIdentifier(id models.Identifier) (models.Identifier, error) {
+	var err error
+	switch id.IDType {
+	case models.IDTypeDOI:
+		id.Identifier, err = models.ParseDOI(id.Identifier)
+	case models.IDTypeOCLC:
+		id.Identifier, err = models.ParseOCLC(id.Identifier)
+	case models.IDTypeISSNL:
+		var i issn.ISSN
+		i, err = issn.Parse(id.Identifier)
+		id.Identifier = string(i)
+	case models.IDTypeProprietary:
+		parts := strings.SplitN(id.Identifier, ":", 2)
+		if len(parts) < 2 {
+			err = models.ErrInvalidProprietary
+			break
+		}
+		id, err = models.ProprietaryID(parts[0], parts[1])
+	}
+	if err != nil {
+		return id, fmt.Errorf("%s: %v", id.Identifier, err)
+	}
+	return id, nil
+}
@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+	"github.com/nicomo/abacaxi/sudoc"
+	"github.com/nicomo/abacaxi/views"
+)
+
+const (
+	jobPollInterval      = 5 * time.Second // how often idle workers look for queued jobs
+	jobSudocMaxAttempts  = 3               // the sudoc web services may be down for a while
+	jobUploadMaxAttempts = 1               // parsing a file again won't give a different result
+	jobRevertMaxAttempts = 1               // a partial revert is better checked by a user before trying again
+)
+
+// jobClaimMutex makes sure 2 workers don't pick jobs for the same target service at once
+var jobClaimMutex sync.Mutex
+
+// jobRunners maps a type of job to the function doing the actual work
+var jobRunners = map[int]func(*models.Job) error{
+	models.JobUpload:          runUploadJob,
+	models.JobSudocRecords:    runSudocRecordsJob,
+	models.JobRevertReport:    runRevertReportJob,
+	models.JobScheduledExport: runScheduledExportJob,
+	models.JobPurgeTrash:      runPurgeTrashJob,
+	models.JobFindDuplicates:  runFindDuplicatesJob,
+}
+
+// StartJobWorkers queues again the jobs interrupted by a restart,
+// then starts n workers processing the jobs queue in the background
+func StartJobWorkers(n int) {
+	requeued, err := models.JobsRequeueRunning()
+	if err != nil {
+		logger.Error.Printf("couldn't requeue interrupted jobs: %v", err)
+	}
+	if requeued > 0 {
+		logger.Info.Printf("requeued %d jobs interrupted by a restart", requeued)
+	}
+
+	for i := 0; i < n; i++ {
+		go jobWorker()
+	}
+}
+
+// jobWorker takes jobs from the queue, one at a time
+func jobWorker() {
+	for {
+		jobClaimMutex.Lock()
+		job, err := models.JobClaim()
+		jobClaimMutex.Unlock()
+
+		if err != nil { // nothing to do, or DB unavailable: wait
+			time.Sleep(jobPollInterval)
+			continue
+		}
+
+		runJob(&job)
+	}
+}
+
+// runJob runs a job and saves its outcome. A panicking job fails instead of crashing the server
+func runJob(job *models.Job) {
+	var err error
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("job panicked: %v", rec)
+		}
+		if err != nil && err != models.ErrJobCancelled {
+			logger.Error.Printf("job %s failed (attempt %d/%d): %v", job.ID.Hex(), job.Attempts, job.MaxAttempts, err)
+		}
+		if ErrFinish := job.JobFinish(err); ErrFinish != nil {
+			logger.Error.Printf("couldn't save job %s: %v", job.ID.Hex(), ErrFinish)
+		}
+	}()
+
+	runner, ok := jobRunners[job.JobType]
+	if !ok {
+		err = fmt.Errorf("unknown job type %d", job.JobType)
+		return
+	}
+	err = runner(job)
+}
+
+// runUploadJob parses an uploaded file and saves the records
+func runUploadJob(job *models.Job) error {
+	return parseFile(jobParseparams(job), job)
+}
+
+// runSudocRecordsJob retrieves Unimarc Records from Sudoc for the records of a target service, or for a selection of records
+func runSudocRecordsJob(job *models.Job) error {
+	// a selection of records, whether they have a PPN or not
+	if len(job.RecordIDs) > 0 {
+		var records []models.Record
+		_, err := models.RecordsIter(models.RecordsFilter{IDs: job.RecordIDs}, func(r models.Record) error {
+			records = append(records, r)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return sudoc.GetSudocRecords(records, fmt.Sprintf("selection of %d records", len(job.RecordIDs)), job)
+	}
+
+	records, err := models.RecordsGetNoPPNByTSName(job.TSName)
+	if err != nil {
+		return err
+	}
+
+	return sudoc.GetSudocRecords(records, job.TSName, job)
+}
+
+// runRevertReportJob puts the records changed by a batch operation
+// back in the state they were before that operation
+func runRevertReportJob(job *models.Job) error {
+	revisions, err := models.RevisionsGetFirstByReportID(job.ReportID.Hex())
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		return models.ErrNothingToRevert
+	}
+
+	report := models.Report{
+		ID:         bson.NewObjectId(),
+		ReportType: models.RevertBatch,
+	}
+	src := models.ChangeSource{User: job.User, ReportID: report.ID}
+	report.Text = append(report.Text, "Revert of report "+job.ReportID.Hex())
+
+	var reverted, failed int
+	for i, rev := range revisions {
+		if err := models.RevisionRevert(rev, src); err != nil {
+			logger.Error.Printf("couldn't revert record %s: %v", rev.RecordID.Hex(), err)
+			failed++
+		} else {
+			reverted++
+		}
+
+		if !job.JobProgress(i+1, len(revisions)) {
+			report.Success = false
+			report.Text = append(report.Text, fmt.Sprintf("Cancelled by user after %d records: reverted %d records / %d failed", i+1, reverted, failed))
+			if err := report.ReportCreate(); err != nil {
+				logger.Error.Printf("couldn't save the report to DB: %v", err)
+			}
+			return models.ErrJobCancelled
+		}
+	}
+
+	report.Success = failed == 0
+	report.Text = append(report.Text, fmt.Sprintf("Reverted %d records / %d failed", reverted, failed))
+	if err := report.ReportCreate(); err != nil {
+		logger.Error.Printf("couldn't save the report to DB: %v", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d records couldn't be reverted", failed)
+	}
+	return nil
+}
+
+// JobsHandler displays the last jobs
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	// Get flash messages, if any.
+	if flashes := sess.Flashes(); len(flashes) > 0 {
+		d["Flashes"] = flashes
+	}
+	sess.Save(r, w)
+
+	jobs, _, err := models.JobsGet(-1, 0, 100)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	d["jobs"] = jobs
+
+	// list of TS appearing in menu
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	views.RenderTmpl(w, "jobs", d)
+}
+
+// JobCancelHandler cancels a queued job, or asks a running job to stop
+func JobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	jobID := mux.Vars(r)["jobID"]
+	if !bson.IsObjectIdHex(jobID) {
+		http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+		return
+	}
+
+	if err := models.JobCancel(jobID); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash(fmt.Sprintf("Job couldn't be cancelled: %v", err))
+		sess.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+}
+
+// JobRetryHandler queues again a failed or cancelled job
+func JobRetryHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	jobID := mux.Vars(r)["jobID"]
+	if !bson.IsObjectIdHex(jobID) {
+		http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+		return
+	}
+
+	if err := models.JobRetry(jobID); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash(fmt.Sprintf("Job couldn't be retried: %v", err))
+		sess.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+	"github.com/nicomo/abacaxi/views"
+)
+
+// mergeOption is a value of a select of the merge policy form, with its label
+type mergeOption struct {
+	Value string
+	Label string
+}
+
+// mergeRuleDisplay is a rule of the merge policy, with the labels of its source & rule
+type mergeRuleDisplay struct {
+	models.MergeRule
+	SourceLabel string
+	RuleLabel   string
+}
+
+// MergePolicyHandler displays the merge policy, and a form to add a rule to it
+func MergePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	// Get flash messages, if any.
+	if flashes := sess.Flashes(); len(flashes) > 0 {
+		d["Flashes"] = flashes
+	}
+	sess.Save(r, w)
+
+	policy, err := models.MergePolicyGet()
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	d["policy"] = policy
+
+	var rules []mergeRuleDisplay
+	for _, mr := range policy.Rules {
+		rules = append(rules, mergeRuleDisplay{
+			MergeRule:   mr,
+			SourceLabel: models.MergeSourceLabel(mr.Source),
+			RuleLabel:   models.MergeRuleLabel(mr.Rule),
+		})
+	}
+	d["rules"] = rules
+
+	// the choices of the form
+	d["fields"] = append([]string{models.AllFields}, models.MergeFields...)
+	sources := []mergeOption{{"", models.MergeSourceLabel("")}}
+	for _, s := range models.MergeSources {
+		sources = append(sources, mergeOption{s, models.MergeSourceLabel(s)})
+	}
+	d["sources"] = sources
+	var ruleNames []mergeOption
+	for _, rule := range models.MergeRuleNames() {
+		ruleNames = append(ruleNames, mergeOption{rule, models.MergeRuleLabel(rule)})
+	}
+	d["ruleNames"] = ruleNames
+	d["fallback"] = models.MergeRuleLabel(models.RuleNonEmpty)
+
+	// list of TS appearing in menu
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	views.RenderTmpl(w, "mergepolicy", d)
+}
+
+// MergePolicySetHandler adds a rule to the merge policy, or replaces the rule for the same field & source
+func MergePolicySetHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	mr := models.MergeRule{
+		Field:  r.PostFormValue("field"),
+		Source: r.PostFormValue("source"),
+		Rule:   r.PostFormValue("rule"),
+	}
+	if err := models.MergePolicySetRule(mr, getChangeSource(r)); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("Couldn't save the merge rule: " + err.Error())
+	} else {
+		sess.AddFlash(fmt.Sprintf("Merge rule saved: %s, %s, %s", mr.Field, models.MergeSourceLabel(mr.Source), models.MergeRuleLabel(mr.Rule)))
+	}
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/mergepolicy", http.StatusSeeOther)
+}
+
+// MergePolicyDeleteHandler removes a rule from the merge policy
+func MergePolicyDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	if err := models.MergePolicyDeleteRule(r.PostFormValue("field"), r.PostFormValue("source"), getChangeSource(r)); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("Couldn't delete the merge rule: " + err.Error())
+		sess.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/mergepolicy", http.StatusSeeOther)
+}
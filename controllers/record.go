@@ -1,16 +1,43 @@
 package controllers
 
 import (
+	"fmt"
+	"io"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+
 	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/marc"
 	"github.com/nicomo/abacaxi/models"
 	"github.com/nicomo/abacaxi/session"
 	"github.com/nicomo/abacaxi/views"
 )
 
+// marcDisplay holds a parsed marc record, to be displayed on the record page
+type marcDisplay struct {
+	Label    string
+	Record   marc.Record
+	KeyData  marc.KeyData
+	Problems []error // validation problems
+	Err      error   // the record couldn't be parsed at all
+}
+
+// getMarcDisplay parses a marc record with parseFn, and gets its key data and validation problems
+func getMarcDisplay(label string, flavour int, parseFn func() (marc.Record, error)) marcDisplay {
+	md := marcDisplay{Label: label}
+	md.Record, md.Err = parseFn()
+	if md.Err != nil {
+		logger.Error.Printf("couldn't parse %s record: %v", label, md.Err)
+		return md
+	}
+	md.KeyData = md.Record.KeyData(flavour)
+	md.Problems = md.Record.Validate(flavour)
+	return md
+}
+
 // RecordHandler displays a single record
 func RecordHandler(w http.ResponseWriter, r *http.Request) {
 	// data to be display in UI will be stored in this map
@@ -43,9 +70,34 @@ func RecordHandler(w http.ResponseWriter, r *http.Request) {
 	if !myRecord.DateUpdated.IsZero() {
 		d["formattedDateUpdated"] = myRecord.DateUpdated.Format(time.RFC822)
 	}
+	if myRecord.Deleted {
+		d["formattedDateDeleted"] = myRecord.DateDeleted.Format(time.RFC822)
+	}
 
 	d["Record"] = myRecord
 
+	// structured display of the marc records, if any
+	if myRecord.RecordUnimarc != "" {
+		d["unimarc"] = getMarcDisplay("Unimarc", marc.Unimarc, myRecord.Unimarc)
+
+		// what the export rules of each target service add to it
+		enrichment, err := models.EnrichmentPreviews(myRecord)
+		if err != nil {
+			logger.Error.Println(err)
+		}
+		d["enrichment"] = enrichment
+	}
+	if myRecord.RecordMarc21 != "" {
+		d["marc21"] = getMarcDisplay("MARC21", marc.Marc21, myRecord.Marc21)
+	}
+
+	// history of the record, most recent first
+	revisions, err := models.RevisionsGetByRecordID(recordID)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	d["revisions"] = revisions
+
 	// list of TS appearing in menu
 	TSListing, _ := models.GetTargetServicesListing()
 	d["TSListing"] = TSListing
@@ -59,56 +111,119 @@ func RecordDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	recordID := vars["recordID"]
 
-	err := models.RecordDelete(recordID)
+	sess := session.Instance(r)
+
+	err := models.RecordDelete(recordID, getChangeSource(r))
 	if err != nil {
 		logger.Error.Println(err)
-
-		// TODO: transmit either error or success message to user
+		sess.AddFlash("Couldn't delete the record: " + err.Error())
+		sess.Save(r, w)
 
 		// redirect
 		redirectURL := "/record/" + recordID
 		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
 	}
 
-	// redirect to home
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	sess.AddFlash("Record moved to the trash")
+	sess.Save(r, w)
+
+	// redirect to the trash, where it can be restored
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// RecordRevertHandler puts a record back in the state it was before a given revision
+func RecordRevertHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	revisionID := mux.Vars(r)["revisionID"]
+	if !bson.IsObjectIdHex(revisionID) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	rev, err := models.RevisionGetByID(revisionID)
+	if err != nil {
+		logger.Error.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if err := models.RevisionRevert(rev, getChangeSource(r)); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash(fmt.Sprintf("Record couldn't be reverted: %v", err))
+	} else {
+		sess.AddFlash("Record reverted")
+	}
+	sess.Save(r, w)
+
+	// a record reverted to before its creation doesn't exist anymore
+	if rev.RevisionType == models.RevisionCreated {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/record/"+rev.RecordID.Hex(), http.StatusSeeOther)
 }
 
 // RecordExportUnimarcHandler exports a single unimarc record
 // To export a batch of records, see targetservice.go
 func RecordExportUnimarcHandler(w http.ResponseWriter, r *http.Request) {
+	recordExportMarc(w, r, "", func(out io.Writer, f models.RecordsFilter, format string) (int, error) {
+		// enriched with the rules of all the target services of the record
+		return models.WriteUnimarc(out, f, format, "")
+	})
+}
+
+// RecordExportMarc21Handler exports a single MARC21 record
+func RecordExportMarc21Handler(w http.ResponseWriter, r *http.Request) {
+	recordExportMarc(w, r, "_marc21", models.WriteMarc21)
+}
+
+// recordExportMarc exports a single marc record, as written by writeMarc
+func recordExportMarc(w http.ResponseWriter, r *http.Request, suffix string, writeMarc func(io.Writer, models.RecordsFilter, string) (int, error)) {
 
 	// retrieve record ID
 	vars := mux.Vars(r)
 	recordID := vars["recordID"]
 
-	// get the relevant record
-	myRecord, err := models.RecordGetByID(recordID)
+	// iso2709, marcxml or json
+	format, err := getMarcExportFormat(r)
 	if err != nil {
-		logger.Error.Println(err)
-		//TODO: exit cleanly with user message on error
-		panic(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// put record in slice (required by models.CreateUnimarcFile)
-	recordToExport := []models.Record{myRecord}
-	filename := recordID + ".xml"
-
-	// create the file
-	filesize, err := models.CreateUnimarcFile(recordToExport, filename)
+	// none, gzip or zip
+	compression, err := getExportCompression(r)
 	if err != nil {
-		logger.Error.Printf("could not create file: %v", err)
-		//TODO: exit cleanly with user message on error
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// export the file
-	if err := exportFile(w, r, filename, filesize); err != nil {
-		logger.Error.Printf("couldn't stream the export file: %v", err)
+	// make sure the record exists
+	if !bson.IsObjectIdHex(recordID) {
+		http.Error(w, "invalid record ID", http.StatusBadRequest)
+		return
 	}
+	myRecord, err := models.RecordGetByID(recordID)
+	if err != nil {
+		logger.Error.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// a filter on this record only
+	f := models.RecordsFilter{IDs: []bson.ObjectId{myRecord.ID}}
+	filename := recordID + suffix + marc.FormatExtension(format)
+
+	// stream the marc record
+	exportStream(w, filename, compression, func(out io.Writer) (int, error) {
+		return writeMarc(out, f, format)
+	})
 
 }
 
-//RecordToggleAcquiredHandler toggles the boolean value "acquired" for a record
+// RecordToggleAcquiredHandler toggles the boolean value "acquired" for a record
 func RecordToggleAcquiredHandler(w http.ResponseWriter, r *http.Request) {
 
 	// retrieve the record ID from the request
@@ -126,7 +241,7 @@ func RecordToggleAcquiredHandler(w http.ResponseWriter, r *http.Request) {
 		myRecord.Acquired = true
 	}
 
-	err = myRecord.RecordUpdate()
+	err = myRecord.RecordUpdate(getChangeSource(r))
 	if err != nil {
 		logger.Error.Println(err)
 	}
@@ -154,7 +269,7 @@ func RecordToggleActiveHandler(w http.ResponseWriter, r *http.Request) {
 		myRecord.Active = true
 	}
 
-	err = myRecord.RecordUpdate()
+	err = myRecord.RecordUpdate(getChangeSource(r))
 	if err != nil {
 		logger.Error.Println(err)
 	}
@@ -0,0 +1,363 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+	"github.com/nicomo/abacaxi/views"
+)
+
+// recordFormBlankIdentifiers is the number of empty identifier lines of the record form, to add identifiers
+const recordFormBlankIdentifiers = 3
+
+// recordFormLabels are the labels of the fields of the record form: their KBART column
+var recordFormLabels = map[string]string{
+	"PublicationTitle":             "publication_title",
+	"FirstAuthor":                  "first_author",
+	"FirstEditor":                  "first_editor",
+	"PublisherName":                "publisher_name",
+	"PublicationType":              "publication_type",
+	"TitleURL":                     "title_url",
+	"TitleID":                      "title_id",
+	"DateFirstIssueOnline":         "date_first_issue_online",
+	"NumFirstVolOnline":            "num_first_vol_online",
+	"NumFirstIssueOnline":          "num_first_issue_online",
+	"DateLastIssueOnline":          "date_last_issue_online",
+	"NumLastVolOnline":             "num_last_vol_online",
+	"NumLastIssueOnline":           "num_last_issue_online",
+	"EmbargoInfo":                  "embargo_info",
+	"CoverageDepth":                "coverage_depth",
+	"CoverageNotes":                "coverage_notes",
+	"Notes":                        "notes",
+	"DateMonographPublishedPrint":  "date_monograph_published_print",
+	"DateMonographPublishedOnline": "date_monograph_published_online",
+	"MonographVolume":              "monograph_volume",
+	"MonographEdition":             "monograph_edition",
+	"ParentPublicationTitleID":     "parent_publication_title_id",
+	"PrecedingPublicationTitleID":  "preceding_publication_title_id",
+	"AccessType":                   "access_type",
+}
+
+// recordFormField is a field of the record form, with its value & the problem with it, if any
+type recordFormField struct {
+	Name   string
+	Label  string
+	Value  string
+	Manual bool // the value was edited by hand, later uploads keep it
+	Err    string
+}
+
+// recordFormTS is a target service of the record form, checked if the record belongs to it
+type recordFormTS struct {
+	models.TargetService
+	Checked bool
+}
+
+// recordFormIDType is an identifier type of the record form
+type recordFormIDType struct {
+	IDType int
+	Label  string
+}
+
+// recordFormIDTypes are the identifier types which can be chosen
+var recordFormIDTypes = []int{
+	models.IDTypePrint,
+	models.IDTypeOnline,
+	models.IDTypeISSNL,
+	models.IDTypeDOI,
+	models.IDTypeOCLC,
+	models.IDTypePPN,
+	models.IDTypeSFX,
+	models.IDTypeProprietary,
+}
+
+// renderRecordForm displays the record form, filled with a record, and the problems found in it, by field
+func renderRecordForm(w http.ResponseWriter, r *http.Request, d map[string]interface{}, record models.Record, problems map[string]string) {
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	d["Record"] = record
+
+	v := reflect.ValueOf(record)
+	var fields []recordFormField
+	for _, name := range models.MergeFields {
+		fields = append(fields, recordFormField{
+			Name:   name,
+			Label:  recordFormLabels[name],
+			Value:  v.FieldByName(name).String(),
+			Manual: record.FieldSources[name] == models.SourceManual,
+			Err:    problems[name],
+		})
+	}
+	d["fields"] = fields
+
+	// the identifiers, and a few empty lines to add some
+	identifiers := append([]models.Identifier(nil), record.Identifiers...)
+	for i := 0; i < recordFormBlankIdentifiers; i++ {
+		identifiers = append(identifiers, models.Identifier{IDType: models.IDTypeOnline})
+	}
+	d["identifiers"] = identifiers
+	var idTypes []recordFormIDType
+	for _, t := range recordFormIDTypes {
+		idTypes = append(idTypes, recordFormIDType{t, models.IDTypeLabel(t)})
+	}
+	d["idTypes"] = idTypes
+	d["errIdentifiers"] = problems["Identifiers"]
+
+	// list of TS appearing in menu, and to choose from
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+	var targetServices []recordFormTS
+	for _, ts := range TSListing {
+		checked := false
+		for _, rts := range record.TargetServices {
+			checked = checked || rts.Name == ts.Name
+		}
+		targetServices = append(targetServices, recordFormTS{ts, checked})
+	}
+	d["targetServices"] = targetServices
+	d["errTargetServices"] = problems["TargetServices"]
+
+	if len(problems) > 0 {
+		d["ErrRecordForm"] = "The record wasn't saved, please check the fields below"
+	}
+
+	views.RenderTmpl(w, "recordform", d)
+}
+
+// formIdentifier cleans up an identifier typed in the record form, as identifiers found in files are:
+// ISBNs are validated & converted, ISSNs are linked to their ISSN-L. It returns the identifiers to add
+func formIdentifier(s string, idType int) ([]models.Identifier, error) {
+	var r models.Record
+	switch idType {
+	case models.IDTypePrint, models.IDTypeOnline:
+		if err := getIsbnIdentifiers(s, &r, idType); err == nil {
+			return r.Identifiers, nil
+		}
+		if err := getIssnIdentifiers(s, &r, idType); err != nil {
+			return nil, fmt.Errorf("%s: not a valid ISBN or ISSN", s)
+		}
+		return r.Identifiers, nil
+	case models.IDTypePPN, models.IDTypeSFX:
+		return []models.Identifier{{Identifier: s, IDType: idType}}, nil
+	}
+
+	id, err := cleanIdentifier(models.Identifier{Identifier: s, IDType: idType})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s, err)
+	}
+	return []models.Identifier{id}, nil
+}
+
+// recordFromForm fills a record with the values of the record form.
+// The target services the record already belongs to keep their coverage.
+// A new record gets the identifiers of its title_id & title_url, as in uploads, and is deduped when saved;
+// the identifiers of a record edited mustn't belong to another record.
+// It returns the problems found, by field
+func recordFromForm(r *http.Request, record *models.Record, newRecord bool) map[string]string {
+	problems := make(map[string]string)
+
+	if err := r.ParseForm(); err != nil {
+		logger.Error.Println(err)
+		problems["Identifiers"] = err.Error()
+		return problems
+	}
+
+	v := reflect.ValueOf(record).Elem()
+	for _, name := range models.MergeFields {
+		v.FieldByName(name).SetString(strings.TrimSpace(r.PostFormValue(name)))
+	}
+	record.Acquired = r.PostFormValue("acquired") == "true"
+	record.Active = r.PostFormValue("active") == "true"
+
+	// identifiers, one per line of the form
+	var identifiers models.Record
+	var errIdentifiers []string
+	values, types := r.PostForm["identifier"], r.PostForm["idtype"]
+	for i, s := range values {
+		s = strings.TrimSpace(s)
+		if s == "" || i >= len(types) {
+			continue
+		}
+		idType, err := strconv.Atoi(types[i])
+		if err != nil {
+			errIdentifiers = append(errIdentifiers, s+": unknown identifier type")
+			continue
+		}
+		ids, err := formIdentifier(s, idType)
+		if err != nil {
+			errIdentifiers = append(errIdentifiers, err.Error())
+			continue
+		}
+		for _, id := range ids {
+			if !identifiers.HasIdentifier(id.Identifier) {
+				identifiers.Identifiers = append(identifiers.Identifiers, id)
+			}
+		}
+	}
+	record.Identifiers = identifiers.Identifiers
+
+	// target services, keeping the coverage of those the record already belongs to
+	var targetServices []models.TargetService
+	for _, name := range r.PostForm["ts"] {
+		ts, err := models.GetTargetService(name)
+		if err != nil {
+			problems["TargetServices"] = "unknown target service " + name
+			continue
+		}
+		for _, rts := range record.TargetServices {
+			if rts.Name == name {
+				ts.Coverage = rts.Coverage
+			}
+		}
+		targetServices = append(targetServices, ts)
+	}
+	record.TargetServices = targetServices
+
+	if newRecord {
+		record.AddTitleIdentifiers()
+	}
+
+	for _, p := range record.Validate() {
+		if problems[p.Field] == "" {
+			problems[p.Field] = p.Err.Error()
+		}
+	}
+
+	// an identifier belongs to a single record
+	if !newRecord {
+		taken, err := record.IdentifiersTaken()
+		if err != nil {
+			logger.Error.Println(err)
+		}
+		for id, recordID := range taken {
+			errIdentifiers = append(errIdentifiers, fmt.Sprintf("%s already belongs to the record %s", id, recordID.Hex()))
+		}
+	}
+
+	if len(errIdentifiers) > 0 {
+		if problems["Identifiers"] != "" {
+			errIdentifiers = append(errIdentifiers, problems["Identifiers"])
+		}
+		problems["Identifiers"] = strings.Join(errIdentifiers, " ; ")
+	}
+
+	return problems
+}
+
+// RecordEditGetHandler displays the form to edit a record
+func RecordEditGetHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	recordID := mux.Vars(r)["recordID"]
+	myRecord, err := models.RecordGetByID(recordID)
+	if err != nil || myRecord.Deleted {
+		logger.Error.Println(err)
+		http.Redirect(w, r, "/record/"+recordID, http.StatusSeeOther)
+		return
+	}
+
+	d["action"] = "/record/edit/" + recordID
+	renderRecordForm(w, r, d, myRecord, nil)
+}
+
+// RecordEditPostHandler saves a record edited by hand. The fields edited are flagged as manual edits,
+// so that the merge policy keeps them when the record is uploaded again
+func RecordEditPostHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+	sess := session.Instance(r)
+
+	recordID := mux.Vars(r)["recordID"]
+	myRecord, err := models.RecordGetByID(recordID)
+	if err != nil || myRecord.Deleted {
+		logger.Error.Println(err)
+		sess.AddFlash("Only a record out of the trash can be edited")
+		sess.Save(r, w)
+		http.Redirect(w, r, "/record/"+recordID, http.StatusSeeOther)
+		return
+	}
+	before := myRecord
+
+	d["action"] = "/record/edit/" + recordID
+	if problems := recordFromForm(r, &myRecord, false); len(problems) > 0 {
+		renderRecordForm(w, r, d, myRecord, problems)
+		return
+	}
+
+	myRecord.EditCoverage(before)
+	myRecord.SetManualSources(before)
+	if err := myRecord.RecordUpdate(getChangeSource(r)); err != nil {
+		logger.Error.Println(err)
+		d["ErrRecordForm"] = "Couldn't save the record: " + err.Error()
+		renderRecordForm(w, r, d, myRecord, nil)
+		return
+	}
+
+	sess.AddFlash("Record saved")
+	sess.Save(r, w)
+	http.Redirect(w, r, "/record/"+recordID, http.StatusSeeOther)
+}
+
+// RecordNewGetHandler displays the form to create a record, e.g. for a title bought on its own.
+// The target service in the ts query param, if any, is checked
+func RecordNewGetHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	myRecord := models.Record{Active: true}
+	if tsname := r.FormValue("ts"); tsname != "" {
+		if ts, err := models.GetTargetService(tsname); err == nil {
+			myRecord.TargetServices = append(myRecord.TargetServices, ts)
+		}
+	}
+
+	d["action"] = "/record/new"
+	renderRecordForm(w, r, d, myRecord, nil)
+}
+
+// RecordNewPostHandler creates a record from the record form.
+// A record having one of the same identifiers gets the values & target services of the form instead,
+// the same way file uploads do
+func RecordNewPostHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+	sess := session.Instance(r)
+
+	var myRecord models.Record
+	d["action"] = "/record/new"
+	if problems := recordFromForm(r, &myRecord, true); len(problems) > 0 {
+		renderRecordForm(w, r, d, myRecord, problems)
+		return
+	}
+
+	_, inserted, err := myRecord.RecordUpsert(getChangeSource(r))
+	if err == models.ErrRecordInTrash {
+		sess.AddFlash("This title is in the trash : restore its record to edit it")
+		sess.Save(r, w)
+		http.Redirect(w, r, "/record/"+myRecord.ID.Hex(), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		logger.Error.Println(err)
+		d["ErrRecordForm"] = "Couldn't save the record: " + err.Error()
+		renderRecordForm(w, r, d, myRecord, nil)
+		return
+	}
+
+	if inserted > 0 {
+		sess.AddFlash("Record created")
+	} else {
+		sess.AddFlash("This title was already in the hub : the values & target services of the form were merged into its record")
+	}
+	sess.Save(r, w)
+	http.Redirect(w, r, "/record/"+myRecord.ID.Hex(), http.StatusSeeOther)
+}
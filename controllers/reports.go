@@ -1,10 +1,15 @@
 package controllers
 
 import (
+	"fmt"
 	"net/http"
 
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+
 	"github.com/nicomo/abacaxi/logger"
 	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
 	"github.com/nicomo/abacaxi/views"
 )
 
@@ -12,6 +17,13 @@ import (
 func ReportsHandler(w http.ResponseWriter, r *http.Request) {
 	d := make(map[string]interface{})
 
+	// Get flash messages, if any.
+	sess := session.Instance(r)
+	if flashes := sess.Flashes(); len(flashes) > 0 {
+		d["Flashes"] = flashes
+	}
+	sess.Save(r, w)
+
 	reports, err := models.ReportsGet()
 	if err != nil {
 		logger.Error.Println(err)
@@ -25,3 +37,39 @@ func ReportsHandler(w http.ResponseWriter, r *http.Request) {
 
 	views.RenderTmpl(w, "reports", d)
 }
+
+// ReportRevertHandler queues a job undoing the changes made to records by a batch operation
+func ReportRevertHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	reportID := mux.Vars(r)["reportID"]
+	if !bson.IsObjectIdHex(reportID) {
+		http.Redirect(w, r, "/reports", http.StatusSeeOther)
+		return
+	}
+
+	if models.RevisionsCountByReportID(reportID) == 0 {
+		sess.AddFlash(fmt.Sprintf("Nothing to revert: %v", models.ErrNothingToRevert))
+		sess.Save(r, w)
+		http.Redirect(w, r, "/reports", http.StatusSeeOther)
+		return
+	}
+
+	job := models.Job{
+		JobType:     models.JobRevertReport,
+		ReportID:    bson.ObjectIdHex(reportID),
+		User:        getUsername(r),
+		MaxAttempts: jobRevertMaxAttempts,
+	}
+	if err := models.JobCreate(&job); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash(fmt.Sprintf("Revert couldn't be queued: %v", err))
+		sess.Save(r, w)
+		http.Redirect(w, r, "/reports", http.StatusSeeOther)
+		return
+	}
+
+	sess.AddFlash("Revert queued, a new report will be available when it's done")
+	sess.Save(r, w)
+	http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+}
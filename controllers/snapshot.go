@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+	"github.com/nicomo/abacaxi/views"
+)
+
+// snapshotDisplayMax is the max number of titles listed on a snapshot page
+const snapshotDisplayMax = 500
+
+// snapshotPrefix marks a snapshot in the parameters of a comparison, e.g. a=snapshot:{snapshotID}
+const snapshotPrefix = "snapshot:"
+
+// snapshotLabel names a snapshot in the UI and in the files exported
+func snapshotLabel(s models.Snapshot) string {
+	return s.TSName + " " + s.DateCreated.Format("2006-01-02 15:04")
+}
+
+// takeSnapshot takes a snapshot of a target service, and returns the line of a report telling about it
+func takeSnapshot(tsname, trigger string, src models.ChangeSource) string {
+	s, err := models.SnapshotCreate(tsname, trigger, src)
+	if err != nil {
+		logger.Error.Printf("couldn't take a snapshot of %s: %v", tsname, err)
+		return fmt.Sprintf("Couldn't take a snapshot of the holdings: %v", err)
+	}
+	return fmt.Sprintf("Snapshot of the holdings taken: %d titles", s.Count)
+}
+
+// TargetServiceSnapshotsHandler lists the snapshots of a target service.
+// With an "at" date, it shows the snapshot telling what the target service had then
+func TargetServiceSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	tsname := mux.Vars(r)["targetservice"]
+
+	// what we had at a given date
+	if r.FormValue("at") != "" {
+		at, err := time.ParseInLocation("2006-01-02", r.FormValue("at"), time.Local)
+		if err == nil {
+			var s models.Snapshot
+			s, err = models.SnapshotAt(tsname, at.AddDate(0, 0, 1)) // until the end of the day
+			if err == nil {
+				http.Redirect(w, r, "/snapshot/"+s.ID.Hex(), http.StatusSeeOther)
+				return
+			}
+		}
+		sess.AddFlash(fmt.Sprintf("No snapshot of %s on %s: %v", tsname, r.FormValue("at"), err))
+	}
+
+	// Get flash messages, if any.
+	if flashes := sess.Flashes(); len(flashes) > 0 {
+		d["Flashes"] = flashes
+	}
+	sess.Save(r, w)
+
+	snapshots, err := models.SnapshotsGetByTSName(tsname)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	d["snapshots"] = snapshots
+	d["myTS"] = tsname
+
+	// list of TS appearing in menu
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	views.RenderTmpl(w, "snapshots", d)
+}
+
+// TargetServiceSnapshotNewHandler takes a snapshot of a target service on demand
+func TargetServiceSnapshotNewHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	tsname := mux.Vars(r)["targetservice"]
+	if _, err := models.GetTargetService(tsname); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	sess.AddFlash(takeSnapshot(tsname, models.SnapshotManual, getChangeSource(r)))
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/ts/snapshots/"+tsname, http.StatusSeeOther)
+}
+
+// SnapshotHandler displays the titles of a snapshot
+func SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	s, err := models.SnapshotGetByID(mux.Vars(r)["snapshotID"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	d["snapshot"] = s
+
+	// the snapshot taken before, to compare with
+	if previous, err := models.SnapshotPrevious(s); err == nil {
+		d["previous"] = previous
+	}
+
+	// only display the first titles of large packages, the export has them all
+	var holdings []models.Holding
+	_, err = models.SnapshotHoldingsIter(s.ID, func(h models.Holding) error {
+		if len(holdings) == snapshotDisplayMax {
+			return io.EOF
+		}
+		holdings = append(holdings, h)
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		logger.Error.Println(err)
+	}
+	d["holdings"] = holdings
+	d["displayMax"] = snapshotDisplayMax
+
+	// list of TS appearing in menu
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	views.RenderTmpl(w, "snapshot", d)
+}
+
+// SnapshotExportKbartHandler exports the titles of a snapshot as a KBART file
+func SnapshotExportKbartHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := models.SnapshotGetByID(mux.Vars(r)["snapshotID"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// none, gzip or zip
+	compression, err := getExportCompression(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// named after the target service, on the date of the snapshot
+	myTS, err := models.GetTargetService(s.TSName)
+	if err != nil {
+		logger.Error.Println(err)
+		myTS.Name = s.TSName
+	}
+	filename := models.KbartFilename(myTS, s.DateCreated)
+
+	// errors are logged by exportStream
+	exportStream(w, filename, compression, func(out io.Writer) (int, error) {
+		return models.WriteSnapshotKbart(out, s.ID)
+	})
+}
+
+// getSnapshotHoldings retrieves the titles of the snapshot named by a comparison parameter, and a label for them
+func getSnapshotHoldings(param, value string) (string, []models.Holding, error) {
+	s, err := models.SnapshotGetByID(strings.TrimPrefix(value, snapshotPrefix))
+	if err != nil {
+		return value, nil, fmt.Errorf("%s: unknown snapshot %s", param, value)
+	}
+
+	holdings, err := models.SnapshotHoldings(s.ID)
+	return snapshotLabel(s), holdings, err
+}
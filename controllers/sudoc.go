@@ -30,7 +30,7 @@ func GetSudocRecordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := sudoc.GetSudocRecord(myRecord); err != nil {
+	if err := sudoc.GetSudocRecord(myRecord, getChangeSource(r)); err != nil {
 		// user friendly error message
 		msg := fmt.Sprintf("Unimarc Record couldn't be retrieve: %v", err)
 		sess.AddFlash(msg)
@@ -63,17 +63,23 @@ func GetSudocRecordsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	tsname := vars["targetservice"]
 
-	records, err := models.RecordsGetNoPPNByTSName(tsname)
-	if err != nil {
+	// queue the request as a background job
+	// and redirect user to the jobs with a flash message
+	job := models.Job{
+		JobType:     models.JobSudocRecords,
+		TSName:      tsname,
+		User:        getUsername(r),
+		MaxAttempts: jobSudocMaxAttempts,
+	}
+	if err := models.JobCreate(&job); err != nil {
 		logger.Error.Println(err)
+		sess.AddFlash(fmt.Sprintf("Request couldn't be queued: %v", err))
+		sess.Save(r, w)
+		http.Redirect(w, r, "/ts/display/"+tsname, http.StatusFound)
+		return
 	}
 
-	// we have records, and can proceed
-	// - redirect user to home with a flash message
-	// - continue our work in a separate go routine
-	sess.AddFlash("Request is running in the background, result will be in the reports")
+	sess.AddFlash("Request is queued and will run in the background, result will be in the reports")
 	sess.Save(r, w)
-	go sudoc.GetSudocRecords(records, tsname)
-	http.Redirect(w, r, "/", http.StatusFound)
-
+	http.Redirect(w, r, "/jobs", http.StatusFound)
 }
@@ -2,14 +2,18 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"path"
 	"strconv"
-
-	"log"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/marc"
 	"github.com/nicomo/abacaxi/models"
 	"github.com/nicomo/abacaxi/session"
 	"github.com/nicomo/abacaxi/views"
@@ -134,6 +138,9 @@ func TargetServiceHandler(w http.ResponseWriter, r *http.Request) {
 		d["myRecords"] = records
 	}
 
+	// filters of the export form
+	d["exportFilters"] = exportFilters
+
 	// list of TS appearing in menu
 	TSListing, _ := models.GetTargetServicesListing()
 	d["TSListing"] = TSListing
@@ -157,99 +164,198 @@ func TargetServiceDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, redirectURL, http.StatusFound)
 	}
 
-	// get the linked records
-	records, err := models.RecordsGetByTSName(tsname, 0)
-	if err != nil {
-		logger.Error.Printf("could not retrieve linked records: %v", err)
-	}
-
-	// for each record, remove the link to the TS
+	// remove the link to the TS from the records,
 	// switch active to false if no other TS exists
-	// update the record
-	for _, record := range records {
-		for i, ts := range record.TargetServices {
-
-			if len(record.TargetServices) <= 1 {
-				record.Active = false
-			}
-
-			// embedded TS in records removed
-			if ts.Name == tsname {
-				record.TargetServices = append(record.TargetServices[:i], record.TargetServices[i+1:]...) // we pop the ts from the slice
-			}
-		}
-
-		err := record.RecordUpdate()
-		if err != nil {
-			logger.Error.Printf("could not update linked record: %v", err)
-		}
+	if err := models.TSDetachRecords(tsname, getChangeSource(r)); err != nil {
+		logger.Error.Printf("could not retrieve linked records: %v", err)
 	}
 
 	// redirect to home
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-// TargetServiceExportKbartHandler exports a batch of records as a KBART-compliant .csv file
+// TargetServiceExportKbartHandler exports a batch of records as a KBART file
 func TargetServiceExportKbartHandler(w http.ResponseWriter, r *http.Request) {
 
 	// retrieve tsname passed in url
 	vars := mux.Vars(r)
 	tsname := vars["targetservice"]
 
-	// get the relevant records
-	records, err := models.RecordsGetWithUnimarcByTSName(tsname)
+	// all records by default, see getExportFilter
+	f, err := getExportFilter(r, tsname)
 	if err != nil {
-		logger.Error.Println(err)
-		//TODO: exit cleanly with user message on error
-		log.Fatalln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	filename := tsname + ".csv"
-
-	// create .csv kbart file
-	filesize, err := models.CreateKbartFile(records, filename)
+	// none, gzip or zip
+	compression, err := getExportCompression(r)
 	if err != nil {
-		logger.Error.Printf("could not create Kbart file: %v", err)
-		//TODO: exit cleanly with user message on error
-		log.Fatalln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// exporting the created file
-	if err := exportFile(w, r, filename, filesize); err != nil {
-		logger.Error.Printf("couldn't stream the export file: %v", err)
+	myTS, err := models.GetTargetService(tsname)
+	if err != nil {
+		logger.Error.Println(err)
+		myTS.Name = tsname
 	}
+	filename := models.KbartFilename(myTS, time.Now())
+
+	// stream the kbart file, straight from the DB
+	count, err := exportStream(w, filename, compression, func(out io.Writer) (int, error) {
+		return models.WriteKbart(out, f)
+	})
+	exportReport("KBART", tsname, f, count, err)
 
 }
 
 // TargetServiceExportUnimarcHandler exports a batch of unimarc records
 func TargetServiceExportUnimarcHandler(w http.ResponseWriter, r *http.Request) {
+	targetServiceExportMarc(w, r, "Unimarc", "", models.WriteUnimarc)
+}
+
+// TargetServiceExportMarc21Handler exports a batch of MARC21 records
+func TargetServiceExportMarc21Handler(w http.ResponseWriter, r *http.Request) {
+	targetServiceExportMarc(w, r, "MARC21", "_marc21", func(out io.Writer, f models.RecordsFilter, format, tsname string) (int, error) {
+		// enrichment rules are written for Unimarc
+		return models.WriteMarc21(out, f, format)
+	})
+}
+
+// TargetServiceExportChangesHandler exports the changes made to the records of a target service since a date,
+// as a zip archive with 3 files: new, modified & deleted records.
+// The files are KBART files, or marc records for the unimarc & marc21 types; marc deletes have leader/05 = 'd'
+func TargetServiceExportChangesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// retrieve TS name
 	vars := mux.Vars(r)
 	tsname := vars["targetservice"]
 
-	// get the relevant records
-	records, err := models.RecordsGetWithUnimarcByTSName(tsname)
+	since, err := getSinceParam(r)
 	if err != nil {
-		logger.Error.Println(err)
-		//TODO: exit cleanly with user message on error
-		panic(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	filename := tsname + ".xml"
+	exportType := r.FormValue("type")
+	if exportType == "" {
+		exportType = models.ExportKbart
+	}
+	format, err := getMarcExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// create the file
-	filesize, err := models.CreateUnimarcFile(records, filename)
+	f, err := getExportFilter(r, tsname)
 	if err != nil {
-		logger.Error.Printf("could not create file: %v", err)
-		//TODO: exit cleanly with user message on error
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// name of the files in the archive, e.g. mypackage_marc21_deleted.xml
+	var base, ext string
+	switch exportType {
+	case models.ExportKbart:
+		myTS, err := models.GetTargetService(tsname)
+		if err != nil {
+			logger.Error.Println(err)
+			myTS.Name = tsname
+		}
+		kbartName := models.KbartFilename(myTS, time.Now())
+		ext = path.Ext(kbartName)
+		base = strings.TrimSuffix(kbartName, ext)
+	case models.ExportUnimarc, models.ExportMarc21:
+		// records without Unimarc have nothing to export
+		if f.HasUnimarc == nil {
+			hasUnimarc := true
+			f.HasUnimarc = &hasUnimarc
+		}
+		base, ext = tsname, marc.FormatExtension(format)
+		if exportType == models.ExportMarc21 {
+			base += "_marc21"
+		}
+	default:
+		http.Error(w, "unknown export type "+exportType, http.StatusBadRequest)
+		return
 	}
 
-	// export the file
-	if err := exportFile(w, r, filename, filesize); err != nil {
-		logger.Error.Printf("couldn't stream the export file: %v", err)
+	var parts []exportPart
+	for _, changes := range models.ChangesKinds {
+		changes := changes
+		parts = append(parts, exportPart{
+			name: base + "_" + changes + ext,
+			write: func(out io.Writer) (int, error) {
+				return models.WriteChanges(out, exportType, format, f, since, changes)
+			},
+		})
 	}
 
+	// stream the 3 files, straight from the DB
+	zipname := tsname + "_changes_" + since.Format("2006-01-02") + ".zip"
+	counts, err := exportZipStream(w, zipname, parts)
+
+	label := "Changes since " + since.Format("2006-01-02 15:04") + " " + exportType
+	if exportType != models.ExportKbart {
+		label += " " + format
+	}
+	exportReport(label, tsname, f, counts[0]+counts[1], err,
+		fmt.Sprintf("%d new / %d modified / %d deleted", counts[0], counts[1], counts[2]))
+
+}
+
+// getSinceParam reads the date changes are exported from, e.g. 2017-03-15 or 2017-03-15T08:30
+func getSinceParam(r *http.Request) (time.Time, error) {
+	since := r.FormValue("since")
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, since, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("since: expected a date, e.g. 2017-03-15 or 2017-03-15T08:30, got %q", since)
+}
+
+// targetServiceExportMarc exports the marc records of a target service, as written by writeMarc
+func targetServiceExportMarc(w http.ResponseWriter, r *http.Request, label, suffix string, writeMarc func(io.Writer, models.RecordsFilter, string, string) (int, error)) {
+
+	// retrieve TS name
+	vars := mux.Vars(r)
+	tsname := vars["targetservice"]
+
+	// iso2709, marcxml or json
+	format, err := getMarcExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// none, gzip or zip
+	compression, err := getExportCompression(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// records without Unimarc have nothing to export
+	f, err := getExportFilter(r, tsname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.HasUnimarc == nil {
+		hasUnimarc := true
+		f.HasUnimarc = &hasUnimarc
+	}
+
+	filename := tsname + suffix + marc.FormatExtension(format)
+
+	// stream the marc records, straight from the DB
+	count, err := exportStream(w, filename, compression, func(out io.Writer) (int, error) {
+		return writeMarc(out, f, format, tsname)
+	})
+	exportReport(label+" "+format, tsname, f, count, err)
+
 }
 
 // TargetServiceUpdateGetHandler fills the update form for a Target Service
@@ -304,7 +410,7 @@ func TargetServiceUpdatePostHandler(w http.ResponseWriter, r *http.Request) {
 	// the name of the target service we're interested in is in the router variables
 	vars := mux.Vars(r)
 	tsname := vars["targetservice"]
-	d["myTS"] = tsname
+	d["myTS"] = models.TargetService{Name: tsname}
 
 	// list of TS appearing in menu
 	TSListing, _ := models.GetTargetServicesListing()
@@ -317,6 +423,8 @@ func TargetServiceUpdatePostHandler(w http.ResponseWriter, r *http.Request) {
 		views.RenderTmpl(w, "tsupdate", d)
 		return
 	}
+	ts.Name = tsname
+	d["myTS"] = ts // the form is displayed again as filled if there's an error
 
 	if ts.DisplayName == "" {
 		d["ErrTSUpdate"] = "Display name can't be empty for TS " + tsname
@@ -334,6 +442,8 @@ func TargetServiceUpdatePostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ts.ID = tsToUpdate.ID
+	ts.DateCreated = tsToUpdate.DateCreated
+	ts.Active = tsToUpdate.Active // toggled from the target service page, not in the form
 
 	err := models.TSUpdate(ts)
 	if err != nil {
@@ -393,24 +503,10 @@ func TargetServiceToggleActiveHandler(w http.ResponseWriter, r *http.Request) {
 		logger.Error.Println(err)
 	}
 
-	// retrieve records with thats TS
-	records, err := models.RecordsGetByTSName(tsname, 0)
-	if err != nil {
-		logger.Error.Println(err)
-	}
-
-	// change "active" bool in those records
+	// change "active" bool in the records with that TS
 	// and save each to DB
-	for _, v := range records {
-		if myTS.Active {
-			v.Active = false
-		} else {
-			v.Active = true
-		}
-		ErrRecordUpdate := v.RecordUpdate()
-		if ErrRecordUpdate != nil {
-			logger.Error.Printf("can't update record %v: %v", v.ID, ErrRecordUpdate)
-		}
+	if err := models.TSSetRecordsActive(tsname, !myTS.Active, getChangeSource(r)); err != nil {
+		logger.Error.Println(err)
 	}
 
 	// change "active" bool in TS struct
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/session"
+	"github.com/nicomo/abacaxi/views"
+)
+
+const (
+	trashPurgeInterval = 24 * time.Hour // records are purged once a day
+	trashPageSize      = 100
+)
+
+// trashRetention is how long deleted records stay in the trash before they are purged
+var trashRetention time.Duration
+
+// StartTrashPurger queues a job purging the trash now, then every day, in the background.
+// Records stay in the trash for retentionDays before they are purged
+func StartTrashPurger(retentionDays int) {
+	trashRetention = time.Duration(retentionDays) * 24 * time.Hour
+
+	go func() {
+		queuePurgeTrash()
+		for range time.Tick(trashPurgeInterval) {
+			queuePurgeTrash()
+		}
+	}()
+}
+
+// queuePurgeTrash creates the job purging the trash, unless one is already queued
+func queuePurgeTrash() {
+	job := models.Job{JobType: models.JobPurgeTrash, User: "purger"}
+	if err := models.JobCreate(&job); err != nil && err != models.ErrJobDuplicate {
+		logger.Error.Printf("couldn't queue the trash purge: %v", err)
+	}
+}
+
+// runPurgeTrashJob removes for good the records deleted before the retention period, and reports on it
+func runPurgeTrashJob(job *models.Job) error {
+	before := time.Now().Add(-trashRetention)
+	purged, err := models.RecordsPurge(before)
+
+	// nothing worth a report
+	if err == nil && purged == 0 {
+		return nil
+	}
+
+	report := models.Report{ReportType: models.Purge, Success: err == nil}
+	report.Text = append(report.Text,
+		fmt.Sprintf("Purge of the records deleted before %s", before.Format("2006-01-02 15:04")),
+		fmt.Sprintf("%d records removed for good", purged))
+	if err != nil {
+		report.Text = append(report.Text, fmt.Sprintf("Purge failed: %v", err))
+	}
+	if ErrReport := report.ReportCreate(); ErrReport != nil {
+		logger.Error.Printf("couldn't save the report to DB: %v", ErrReport)
+	}
+
+	return err
+}
+
+// TrashHandler lists the deleted records, most recently deleted first
+func TrashHandler(w http.ResponseWriter, r *http.Request) {
+	d := make(map[string]interface{})
+
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	// Get flash messages, if any.
+	if flashes := sess.Flashes(); len(flashes) > 0 {
+		d["Flashes"] = flashes
+	}
+	sess.Save(r, w)
+
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	records, err := models.RecordsGetTrash((page-1)*trashPageSize, trashPageSize)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	d["myRecords"] = records
+
+	count := models.RecordsCountFiltered(models.RecordsFilter{Trash: true})
+	d["count"] = count
+	if page > 1 {
+		d["prevPage"] = page - 1
+	}
+	if page*trashPageSize < count {
+		d["nextPage"] = page + 1
+	}
+	d["retentionDays"] = int(trashRetention.Hours() / 24)
+
+	// list of TS appearing in menu
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	views.RenderTmpl(w, "trash", d)
+}
+
+// RecordRestoreHandler takes a record out of the trash
+func RecordRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	recordID := mux.Vars(r)["recordID"]
+	if !bson.IsObjectIdHex(recordID) {
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return
+	}
+
+	if err := models.RecordRestore(recordID, getChangeSource(r)); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("Couldn't restore the record: " + err.Error())
+		sess.Save(r, w)
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return
+	}
+
+	sess.AddFlash("Record restored")
+	sess.Save(r, w)
+	http.Redirect(w, r, "/record/"+recordID, http.StatusSeeOther)
+}
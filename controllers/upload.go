@@ -1,12 +1,17 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+
 	"github.com/nicomo/abacaxi/logger"
 	"github.com/nicomo/abacaxi/models"
 	"github.com/nicomo/abacaxi/session"
@@ -96,78 +101,342 @@ func UploadPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	// copy uploaded file into new file
 	io.Copy(f, file)
+	f.Close()
 
-	pp := parseparams{
-		tsname,
-		fpath,
-		filetype,
-		delimiter,
-		csvconf,
+	// we have a file to parse
+	// let's queue that as a background job,
+	// on hold until the user confirms if she asked for a preview
+	preview := r.PostFormValue("preview") == "true"
+	job := models.Job{
+		JobType:      models.JobUpload,
+		TSName:       tsname,
+		User:         getUsername(r),
+		MaxAttempts:  jobUploadMaxAttempts,
+		FilePath:     fpath,
+		FileType:     filetype,
+		Delimiter:    string(delimiter),
+		CSVConf:      csvconf,
+		FullHoldings: r.PostFormValue("fullholdings") == "true",
+	}
+	if preview {
+		job.Status = models.JobPending
+	}
+	if err := models.JobCreate(&job); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash(fmt.Sprintf("Upload couldn't be queued: %v", err))
+		sess.Save(r, w)
+		http.Redirect(w, r, "/upload", http.StatusFound)
+		return
 	}
 
-	// we have a file to parse
-	// let's do that in a separate go routine
-	go parseFile(pp)
+	if preview {
+		uploadPreview(w, r, job)
+		return
+	}
 
-	// and redirect the user home with a flash message
-	sess.AddFlash("Upload is running in the background, result will be in the reports")
+	// and redirect the user to the jobs with a flash message
+	sess.AddFlash("Upload is queued and will run in the background, result will be in the reports")
 	sess.Save(r, w)
-	http.Redirect(w, r, "/", http.StatusFound)
+	http.Redirect(w, r, "/jobs", http.StatusFound)
 }
 
-func parseFile(pp parseparams) {
-	var (
-		records []models.Record
-		report  models.Report
-		err     error
-	)
-
-	if pp.filetype == "sfxxml" {
-		records, err = xmlIO(pp, &report)
-		if err != nil {
-			logger.Error.Println(err)
-			report.Success = false
-			report.Text = append(report.Text, fmt.Sprintf("Upload process couldn't complete: %v", err))
-			report.ReportCreate()
-			return
-		}
+const (
+	uploadChunkSize  = 100 // number of records saved between 2 job progress updates
+	uploadPreviewMax = 500 // max number of inserted / updated / dropped records listed in a preview
+)
+
+// errFullHoldingsRejected is the reason why the titles missing from a full holdings file are kept:
+// the rejected lines may well be some of them
+var errFullHoldingsRejected = errors.New("some lines of the file were rejected, the titles missing from the file are kept in the target service")
+
+// jobParseparams retrieves the parse parameters stored in an upload job
+func jobParseparams(job *models.Job) parseparams {
+	delimiter := '\t'
+	if job.Delimiter != "" {
+		delimiter = []rune(job.Delimiter)[0]
+	}
+
+	return parseparams{
+		tsname:    job.TSName,
+		fpath:     job.FilePath,
+		filetype:  job.FileType,
+		delimiter: delimiter,
+		csvconf:   job.CSVConf,
+	}
+}
+
+// readFile parses a source file into records, according to its type
+func readFile(pp parseparams, report *models.Report) ([]models.Record, []rejectedLine, error) {
+	switch pp.filetype {
+	case "sfxxml":
 		report.ReportType = models.UploadSfx
-	} else if pp.filetype == "publishercsv" || pp.filetype == "kbart" {
-		records, err = fileIO(pp, &report)
-		if err != nil {
-			logger.Error.Println(err)
-			report.Success = false
-			report.Text = append(report.Text, fmt.Sprintf("Upload process couldn't complete: %v", err))
-			report.ReportCreate()
-			return
-		}
-		if pp.filetype == "publishercsv" {
-			report.ReportType = models.UploadCsv
-		}
-		if pp.filetype == "kbart" {
-			report.ReportType = models.UploadKbart
+		return xmlIO(pp, report)
+	case "publishercsv":
+		report.ReportType = models.UploadCsv
+		return fileIO(pp, report)
+	case "kbart":
+		report.ReportType = models.UploadKbart
+		return fileIO(pp, report)
+	}
+
+	// manage case wrong file extension : message to the user
+	return nil, nil, errors.New("unknown file type")
+}
+
+// uploadPreview parses an uploaded file and displays what importing it would change,
+// without writing anything to the records
+func uploadPreview(w http.ResponseWriter, r *http.Request, job models.Job) {
+	d := make(map[string]interface{})
+
+	// Get session
+	sess := session.Instance(r)
+	if sess.Values["id"] != nil {
+		d["IsLoggedIn"] = true
+	}
+
+	d["job"] = job
+
+	var report models.Report
+	records, rejected, err := readFile(jobParseparams(&job), &report)
+	if err != nil {
+		d["ErrPreview"] = err
+	}
+	d["parseReport"] = report.Text
+	d["rejected"] = rejected
+
+	// only display the first records of large batches
+	preview := models.RecordsUpsertPreview(records, job.FileType)
+	d["insertsCount"] = len(preview.Inserts)
+	d["updatesCount"] = len(preview.Updates)
+	d["unchangedCount"] = preview.Unchanged
+	d["inTrash"] = preview.InTrash
+	if len(preview.Inserts) > uploadPreviewMax {
+		preview.Inserts = preview.Inserts[:uploadPreviewMax]
+	}
+	if len(preview.Updates) > uploadPreviewMax {
+		preview.Updates = preview.Updates[:uploadPreviewMax]
+	}
+	d["inserts"] = preview.Inserts
+	d["updates"] = preview.Updates
+	d["previewMax"] = uploadPreviewMax
+
+	// titles of the target service missing from a full holdings file
+	if job.FullHoldings && err == nil {
+		if len(rejected) > 0 {
+			d["ErrDropped"] = errFullHoldingsRejected
+		} else {
+			dropped, err := preview.Dropped(job.TSName)
+			if err != nil {
+				logger.Error.Println(err)
+			}
+			d["droppedCount"] = len(dropped)
+			if len(dropped) > uploadPreviewMax {
+				dropped = dropped[:uploadPreviewMax]
+			}
+			d["dropped"] = dropped
 		}
-	} else {
-		// manage case wrong file extension : message to the user
-		logger.Error.Println("unknown file type")
+	}
+
+	// list of TS appearing in menu
+	TSListing, _ := models.GetTargetServicesListing()
+	d["TSListing"] = TSListing
+
+	views.RenderTmpl(w, "uploadpreview", d)
+}
+
+// UploadConfirmHandler queues an upload the user previewed
+func UploadConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	jobID := mux.Vars(r)["jobID"]
+	if !bson.IsObjectIdHex(jobID) {
+		http.Redirect(w, r, "/upload", http.StatusSeeOther)
+		return
+	}
+
+	if err := models.JobConfirm(jobID); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash(fmt.Sprintf("Upload couldn't be queued: %v", err))
+		sess.Save(r, w)
+		http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+		return
+	}
+
+	sess.AddFlash("Upload is queued and will run in the background, result will be in the reports")
+	sess.Save(r, w)
+	http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+}
+
+// UploadDiscardHandler drops an upload the user previewed, and the uploaded file
+func UploadDiscardHandler(w http.ResponseWriter, r *http.Request) {
+	sess := session.Instance(r)
+
+	jobID := mux.Vars(r)["jobID"]
+	if !bson.IsObjectIdHex(jobID) {
+		http.Redirect(w, r, "/upload", http.StatusSeeOther)
+		return
+	}
+
+	job, err := models.JobGetByID(jobID)
+	if err != nil || job.Status != models.JobPending {
+		sess.AddFlash("This upload is not waiting for a confirmation")
+		sess.Save(r, w)
+		http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+		return
+	}
+
+	if err := models.JobCancel(jobID); err != nil {
+		logger.Error.Println(err)
+	}
+	if err := os.Remove(job.FilePath); err != nil {
+		logger.Error.Println(err)
+	}
+
+	sess.AddFlash("Upload discarded, nothing has been imported")
+	sess.Save(r, w)
+	http.Redirect(w, r, "/upload", http.StatusSeeOther)
+}
+
+func parseFile(pp parseparams, job *models.Job) error {
+	// the report ID is known up front, so that the changes made to records can be linked to it
+	report := models.Report{ID: bson.NewObjectId()}
+	src := models.ChangeSource{User: job.User, ReportID: report.ID, Type: pp.filetype}
+
+	records, rejected, err := readFile(pp, &report)
+	if err != nil {
+		logger.Error.Println(err)
 		report.Success = false
-		report.Text = append(report.Text, fmt.Sprintln("unknown file type"))
+		report.Text = append(report.Text, fmt.Sprintf("Upload process couldn't complete: %v", err))
 		report.ReportCreate()
-		return
+		return err
 	}
 
-	// save the records to DB
-	recordsUpdated, recordsInserted := models.RecordsUpsert(records)
+	// save the records to DB, chunk by chunk so that we can report progress
+	var recordsUpdated, recordsInserted, recordsUnchanged int
+	var recordsInTrash, recordsFailed []models.Record
+	mergeStats := make(models.MergeStats)
+	for i := 0; i < len(records); i += uploadChunkSize {
+		end := i + uploadChunkSize
+		if end > len(records) {
+			end = len(records)
+		}
+		result := models.RecordsUpsert(records[i:end], src)
+		recordsUpdated += result.Updated
+		recordsInserted += result.Inserted
+		recordsUnchanged += result.Unchanged
+		recordsInTrash = append(recordsInTrash, result.InTrash...)
+		recordsFailed = append(recordsFailed, result.Failed...)
+		mergeStats.Add(result.Stats)
+
+		if !job.JobProgress(end, len(records)) {
+			report.Success = false
+			report.Text = append(report.Text, fmt.Sprintf("Cancelled by user after %d records: updated %d records / inserted %d records",
+				end,
+				recordsUpdated,
+				recordsInserted))
+			if err := report.ReportCreate(); err != nil {
+				logger.Error.Printf("couldn't save the report to DB: %v", err)
+			}
+			return models.ErrJobCancelled
+		}
+	}
 
 	// report
-	report.Text = append(report.Text, fmt.Sprintf("Updated %d records / Inserted %d records",
+	report.Text = append(report.Text, fmt.Sprintf("Updated %d records / Inserted %d records / %d records unchanged",
 		recordsUpdated,
-		recordsInserted))
+		recordsInserted,
+		recordsUnchanged))
 	report.Success = true
 
+	// the titles of the file whose record is in the trash are left out, the record has to be restored first
+	if len(recordsInTrash) > 0 {
+		report.Text = append(report.Text, fmt.Sprintf("Skipped %d records in the trash, restore them to update them", len(recordsInTrash)))
+		for _, record := range recordsInTrash {
+			report.Text = append(report.Text, fmt.Sprintf("Skipped, in the trash: %s (record %s)", record.PublicationTitle, record.ID.Hex()))
+		}
+	}
+
+	if len(recordsFailed) > 0 {
+		report.Text = append(report.Text, fmt.Sprintf("Couldn't save %d records, see the log", len(recordsFailed)))
+		for _, record := range recordsFailed {
+			report.Text = append(report.Text, fmt.Sprintf("Couldn't save: %s", record.PublicationTitle))
+		}
+	}
+
+	// the merge rules which decided the values of the fields of the records updated
+	if len(mergeStats) > 0 {
+		report.Text = append(report.Text, "Merge policy decisions, when the file and the DB differed:")
+		report.Text = append(report.Text, mergeStats.Lines()...)
+	}
+
+	// the titles of the target service missing from a full holdings file were dropped from the package
+	if job.FullHoldings {
+		report.Text = append(report.Text, detachDroppedRecords(pp.tsname, records, rejected, len(recordsFailed), src)...)
+	}
+
+	// what the target service has after this upload
+	report.Text = append(report.Text, takeSnapshot(pp.tsname, models.SnapshotUpload, src))
+
 	// save the report to DB
 	if err := report.ReportCreate(); err != nil {
 		logger.Error.Printf("couldn't save the report to DB: %v", err)
 	}
 
+	return nil
+}
+
+// detachDroppedRecords detaches a target service from its records missing from a full holdings file,
+// and returns the lines of the report listing them.
+// Nothing is detached if the file is empty, if a line was rejected or a record couldn't be saved:
+// the titles missing from the file may be these ones
+func detachDroppedRecords(tsname string, records []models.Record, rejected []rejectedLine, failed int, src models.ChangeSource) []string {
+	if len(rejected) > 0 {
+		return []string{"Full holdings: " + errFullHoldingsRejected.Error()}
+	}
+	if failed > 0 {
+		return []string{"Full holdings: some records couldn't be saved, the titles missing from the file are kept in the target service"}
+	}
+	if len(records) == 0 {
+		return []string{"Full holdings: no title found in the file, the target service is left as it was"}
+	}
+
+	kept := make(map[bson.ObjectId]bool)
+	for _, record := range records {
+		kept[record.ID] = true
+	}
+
+	dropped, err := models.TSDetachMissingRecords(tsname, kept, src)
+	if err != nil {
+		logger.Error.Println(err)
+		return []string{fmt.Sprintf("Full holdings: couldn't detach the titles missing from the file: %v", err)}
+	}
+
+	var deactivated int
+	for _, record := range dropped {
+		if len(record.TargetServices) == 0 {
+			deactivated++
+		}
+	}
+	text := []string{fmt.Sprintf("Full holdings: %d titles dropped from %s / %d records de-activated, with no target service left",
+		len(dropped),
+		tsname,
+		deactivated)}
+	for _, record := range dropped {
+		text = append(text, "Dropped: "+droppedTitle(record))
+	}
+
+	return text
+}
+
+// droppedTitle describes a title dropped from a target service in a report
+func droppedTitle(record models.Record) string {
+	var ids []string
+	for _, v := range record.Identifiers {
+		ids = append(ids, v.Identifier)
+	}
+	s := fmt.Sprintf("%s (%s)", record.PublicationTitle, strings.Join(ids, ", "))
+	if len(record.TargetServices) == 0 {
+		s += ", de-activated"
+	}
+	return s
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/middleware"
 	"github.com/nicomo/abacaxi/models"
 	"github.com/nicomo/abacaxi/session"
 	"github.com/nicomo/abacaxi/views"
@@ -32,6 +33,23 @@ func logAttempt(sess *sessions.Session) {
 	}
 }
 
+// getUsername returns the name of the user behind a request,
+// logged in through the session or authenticated by an API token
+func getUsername(r *http.Request) string {
+	if user, ok := middleware.APIUser(r.Context()); ok {
+		return user.Username
+	}
+	if username, ok := session.Instance(r).Values["username"].(string); ok {
+		return username
+	}
+	return ""
+}
+
+// getChangeSource tells the models who is changing records through a request
+func getChangeSource(r *http.Request) models.ChangeSource {
+	return models.ChangeSource{User: getUsername(r), Type: models.SourceManual}
+}
+
 // UsersHandler displays the list of existing users
 func UsersHandler(w http.ResponseWriter, r *http.Request) {
 	// our messages (errors, confirmation, etc) to the user & the template will be store in this map
@@ -199,6 +217,35 @@ func UserNewPostHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/users", http.StatusFound)
 }
 
+// UserAPITokenHandler generates a new API token for the logged in user
+// the token is displayed once, only its hash is saved in DB
+func UserAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Get session & the logged in user ID
+	sess := session.Instance(r)
+	currentID := sess.Values["id"].(string)
+
+	token, err := session.TokenCreate()
+	if err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("API token couldn't be created")
+		sess.Save(r, w)
+		http.Redirect(w, r, "/users", http.StatusSeeOther)
+		return
+	}
+
+	if err := models.UserUpdateAPIToken(currentID, session.TokenHash(token)); err != nil {
+		logger.Error.Println(err)
+		sess.AddFlash("API token couldn't be saved")
+		sess.Save(r, w)
+		http.Redirect(w, r, "/users", http.StatusSeeOther)
+		return
+	}
+
+	sess.AddFlash("Your new API token, copy it now, it won't be displayed again: " + token)
+	sess.Save(r, w)
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
+
 // UserDeleteHandler deletes a user
 func UserDeleteHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -29,19 +30,19 @@ type XMLRecord struct {
 }
 
 // xmlIO takes an xml file to clean it, save copy & unmarshall content
-func xmlIO(pp parseparams, report *models.Report) ([]models.Record, error) {
+func xmlIO(pp parseparams, report *models.Report) ([]models.Record, []rejectedLine, error) {
 
 	// retrieve target service (i.e. ebook/ejournals package) for this file
 	myTS, err := models.GetTargetService(pp.tsname)
 	if err != nil {
-		logger.Error.Println(err)
+		return nil, nil, err
 	}
 
 	// open the source XML file
 	f, err := os.Open(pp.fpath)
 	if err != nil {
 		logger.Error.Println(err)
-		os.Exit(1)
+		return nil, nil, errors.New("cannot open the source file")
 	}
 	defer f.Close()
 
@@ -49,15 +50,17 @@ func xmlIO(pp parseparams, report *models.Report) ([]models.Record, error) {
 	xmlRecords, err := ReadRecords(f)
 	if err != nil {
 		logger.Error.Println(err)
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("cannot read the xml file: %v", err)
 	}
 
 	// unmarshall  records into record structs
 	records := []models.Record{}
-	for _, record := range xmlRecords {
+	var rejected []rejectedLine
+	for i, record := range xmlRecords {
 		record, err := xmlUnmarshall(record, myTS)
 		if err != nil {
 			logger.Error.Println(err)
+			rejected = append(rejected, rejectedLine{i + 1, "item not valid: " + err.Error()})
 			continue
 		}
 		records = append(records, record)
@@ -66,6 +69,15 @@ func xmlIO(pp parseparams, report *models.Report) ([]models.Record, error) {
 	// log number of records successfully parsed
 	report.Text = append(report.Text, fmt.Sprintf("successfully parsed %d records\n", len(records)))
 
+	// log the items we rejected, if any
+	if len(rejected) > 0 {
+		var rejectedItems []int
+		for _, v := range rejected {
+			rejectedItems = append(rejectedItems, v.Line)
+		}
+		report.Text = append(report.Text, fmt.Sprintf("items rejected in source file: %v", rejectedItems))
+	}
+
 	/*	// save a server copy of source xml file
 		t := time.Now()
 		dst := "./data/" + tsname + "Processed" + t.Format("20060102150405") + ".xml"
@@ -78,7 +90,7 @@ func xmlIO(pp parseparams, report *models.Report) ([]models.Record, error) {
 		report = report + fmt.Sprintf("successfully saved cleaned up version of xml file as %s\n", dst)
 		logger.Info.Println(saveCopyMssg)
 	*/
-	return records, nil
+	return records, rejected, nil
 }
 
 // ReadRecords reads the XML document
@@ -0,0 +1,181 @@
+// Package cron reads cron-like schedules, e.g. "30 2 * * 1-5", and tells when they are due
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNeverDue is returned for a schedule which can't ever be due, e.g. on February 30
+var ErrNeverDue = errors.New("the schedule is never due")
+
+// shortcuts are the usual names of the common schedules
+var shortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// bounds are the values allowed in a field of a schedule
+type bounds struct {
+	name     string
+	min, max int
+}
+
+// the 5 fields of a schedule, in order. 0 & 7 are both Sunday
+var fieldBounds = []bounds{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Schedule is a parsed schedule: the minutes, hours, days of month, months & days of week it is due at
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool // "*": the day is given by the other day field only
+}
+
+// Parse reads a schedule with 5 fields: minute, hour, day of month, month, day of week.
+// A field is "*", a value, a range "1-5", a list "1,15" or a step "*/15" or "8-18/2";
+// @hourly, @daily, @weekly & @monthly are accepted too
+func Parse(spec string) (Schedule, error) {
+	var s Schedule
+
+	spec = strings.TrimSpace(spec)
+	if full, ok := shortcuts[spec]; ok {
+		spec = full
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(fieldBounds) {
+		return s, fmt.Errorf("expected 5 fields (minute hour day month weekday), got %q", spec)
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := parseField(field, fieldBounds[i])
+		if err != nil {
+			return s, err
+		}
+		sets[i] = set
+	}
+
+	s.minute, s.hour, s.dom, s.month, s.dow = sets[0], sets[1], sets[2], sets[3], sets[4]
+	if s.dow&(1<<7) != 0 { // Sunday as 7
+		s.dow |= 1
+	}
+	s.domAny, s.dowAny = fields[2] == "*", fields[4] == "*"
+
+	if s.Next(time.Now()).IsZero() {
+		return s, ErrNeverDue
+	}
+	return s, nil
+}
+
+// parseField reads a field of a schedule as the set of the values it allows
+func parseField(field string, b bounds) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("%s: invalid step in %q", b.name, part)
+			}
+			rng, step = part[:i], n
+		}
+
+		low, high := b.min, b.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			ends := strings.SplitN(rng, "-", 2)
+			var err1, err2 error
+			low, err1 = strconv.Atoi(ends[0])
+			high, err2 = strconv.Atoi(ends[1])
+			if err1 != nil || err2 != nil || low > high {
+				return 0, fmt.Errorf("%s: invalid range %q", b.name, rng)
+			}
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("%s: invalid value %q", b.name, rng)
+			}
+			low = n
+			if step == 1 { // a single value, unless it starts a step, e.g. 5/15
+				high = n
+			}
+		}
+		if low < b.min || high > b.max {
+			return 0, fmt.Errorf("%s: %q out of %d-%d", b.name, rng, b.min, b.max)
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+// has tells whether a value is in a set
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
+
+// dayMatches tells whether the schedule is due on the day of t.
+// As in cron, when both day fields are restricted, either of them will do
+func (s Schedule) dayMatches(t time.Time) bool {
+	dom, dow := has(s.dom, t.Day()), has(s.dow, int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time the schedule is due strictly after t, to the minute,
+// or the zero time if it isn't due in the next 5 years.
+// The schedule follows the wall clock of the location of t: when summer time starts, what's due in the hour skipped
+// is due an hour later; when it ends, what's due in the hour repeated is due once
+func (s Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// the wall clock, free of the changes of offset
+	w := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	limit := w.AddDate(5, 0, 0)
+
+	for w.Before(limit) {
+		if !has(s.month, int(w.Month())) {
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.dayMatches(w) {
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !has(s.hour, w.Hour()) {
+			w = w.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !has(s.minute, w.Minute()) {
+			w = w.Add(time.Minute)
+			continue
+		}
+
+		next := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0, 0, loc)
+		// a time of the hour repeated may have been due already
+		if next.After(t) {
+			return next
+		}
+		w = w.Add(time.Minute)
+	}
+
+	return time.Time{}
+}
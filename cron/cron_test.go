@@ -0,0 +1,132 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"0 2 * * *", false},
+		{"*/15 8-18 * * 1-5", false},
+		{"0,30 9 1,15 * *", false},
+		{"5/15 * * * *", false},
+		{"0 0 * * 7", false},
+		{"  @daily ", false},
+		{"@weekly", false},
+		{"0 0 29 2 *", false},
+		{"", true},
+		{"0 2 * *", true},
+		{"0 2 * * * *", true},
+		{"60 * * * *", true},
+		{"0 24 * * *", true},
+		{"0 0 0 * *", true},
+		{"0 0 * 13 *", true},
+		{"0 0 * * 8", true},
+		{"*/0 * * * *", true},
+		{"*/x * * * *", true},
+		{"5-1 * * * *", true},
+		{"a * * * *", true},
+		{"@yearly", true},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q): err = %v, want error %v", tt.spec, err, tt.wantErr)
+		}
+	}
+
+	if _, err := Parse("0 0 30 2 *"); err != ErrNeverDue {
+		t.Errorf("Parse on February 30: err = %v, want %v", err, ErrNeverDue)
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from string
+		want string
+	}{
+		{"nightly", "0 2 * * *", "2018-05-16 10:00:00", "2018-05-17 02:00:00"},
+		{"strictly after", "0 2 * * *", "2018-05-16 02:00:00", "2018-05-17 02:00:00"},
+		{"seconds are dropped", "* * * * *", "2018-05-16 10:07:30", "2018-05-16 10:08:00"},
+		{"step", "*/15 * * * *", "2018-05-16 10:07:00", "2018-05-16 10:15:00"},
+		{"step from a value", "5/20 * * * *", "2018-05-16 10:26:00", "2018-05-16 10:45:00"},
+		{"step in a range", "0 8-18/4 * * *", "2018-05-16 13:00:00", "2018-05-16 16:00:00"},
+		{"list on working days", "0,30 9 * * 1-5", "2018-05-18 09:30:00", "2018-05-21 09:00:00"},
+		{"next month", "0 0 1 * *", "2018-01-31 12:00:00", "2018-02-01 00:00:00"},
+		{"day 31 skips short months", "0 0 31 * *", "2018-02-01 00:00:00", "2018-03-31 00:00:00"},
+		{"leap day", "0 0 29 2 *", "2018-03-01 00:00:00", "2020-02-29 00:00:00"},
+		{"next year", "0 0 1 1 *", "2018-05-16 00:00:00", "2019-01-01 00:00:00"},
+		{"day of month only", "0 0 15 * *", "2018-05-16 00:00:00", "2018-06-15 00:00:00"},
+		{"day of week only", "0 0 * * 1", "2018-05-16 00:00:00", "2018-05-21 00:00:00"},
+		{"Sunday as 0", "0 0 * * 0", "2018-05-16 00:00:00", "2018-05-20 00:00:00"},
+		{"Sunday as 7", "0 0 * * 7", "2018-05-16 00:00:00", "2018-05-20 00:00:00"},
+		{"either day field, the day of week first", "0 0 13 * 5", "2018-05-16 00:00:00", "2018-05-18 00:00:00"},
+		{"either day field, the day of month first", "0 0 17 * 5", "2018-05-16 00:00:00", "2018-05-17 00:00:00"},
+		{"both day fields, month restricted", "0 0 1 6 1", "2018-05-16 00:00:00", "2018-06-01 00:00:00"},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("%s: Parse(%q): %v", tt.name, tt.spec, err)
+			continue
+		}
+		if got, want := s.Next(utc(tt.from)), utc(tt.want); !got.Equal(want) {
+			t.Errorf("%s: Next(%s) of %q = %s, want %s", tt.name, tt.from, tt.spec, got, want)
+		}
+	}
+}
+
+func TestNextSummerTime(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	date := func(day, month, hour, min int, offset int) time.Time {
+		return time.Date(2018, time.Month(month), day, hour, min, 0, 0, time.FixedZone("", offset*3600))
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		// on 2018-03-25, 02:00 CET is 03:00 CEST
+		{"due in the hour skipped", "30 2 * * *", date(24, 3, 12, 0, 1), date(25, 3, 3, 30, 2)},
+		{"the day after the hour skipped", "30 2 * * *", date(25, 3, 3, 30, 2), date(26, 3, 2, 30, 2)},
+		{"hourly, summer time starts", "0 * * * *", date(25, 3, 1, 30, 1), date(25, 3, 3, 0, 2)},
+		{"due after the hour skipped", "0 4 * * *", date(25, 3, 1, 0, 1), date(25, 3, 4, 0, 2)},
+		// on 2018-10-28, 03:00 CEST is 02:00 CET
+		{"due in the hour repeated", "30 2 * * *", date(27, 10, 12, 0, 2), date(28, 10, 2, 30, 1)},
+		{"due once in the hour repeated", "30 2 * * *", date(28, 10, 2, 30, 1), date(29, 10, 2, 30, 1)},
+		{"past in the hour repeated", "30 2 * * *", date(28, 10, 2, 40, 2), date(29, 10, 2, 30, 1)},
+		{"due after the hour repeated", "0 4 * * *", date(28, 10, 1, 0, 2), date(28, 10, 4, 0, 1)},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("%s: Parse(%q): %v", tt.name, tt.spec, err)
+			continue
+		}
+		if got := s.Next(tt.from.In(paris)); !got.Equal(tt.want) {
+			t.Errorf("%s: Next(%s) of %q = %s, want %s", tt.name, tt.from.In(paris), tt.spec, got, tt.want.In(paris))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Package issn validates & normalizes ISSNs, and links them to their ISSN-L
+// from a table loaded locally, e.g. the ISSN-to-ISSN-L table of the ISSN International Centre
+package issn
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrInvalidISSN is returned for a string which isn't an ISSN: 7 digits and a check digit
+	ErrInvalidISSN = errors.New("not an ISSN")
+	// ErrCheckDigit is returned for an ISSN whose check digit is wrong, most likely a typo
+	ErrCheckDigit = errors.New("wrong ISSN check digit")
+)
+
+// ISSN is an ISSN in its canonical form: 8 characters, no hyphen, an upper case X as check digit if need be.
+// This is how ISSNs are stored in the records identifiers
+type ISSN string
+
+// Parse validates an ISSN and returns it in its canonical form.
+// Hyphens, spaces and an "ISSN" prefix are accepted, e.g. "ISSN 0378-5955"
+func Parse(s string) (ISSN, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSpace(strings.TrimPrefix(s, "ISSN"))
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+
+	if len(s) != 8 {
+		return "", ErrInvalidISSN
+	}
+	for i := 0; i < 7; i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return "", ErrInvalidISSN
+		}
+	}
+	if (s[7] < '0' || s[7] > '9') && s[7] != 'X' {
+		return "", ErrInvalidISSN
+	}
+
+	if s[7] != checkDigit(s[:7]) {
+		return "", ErrCheckDigit
+	}
+	return ISSN(s), nil
+}
+
+// Valid tells whether a string is an ISSN with the right check digit
+func Valid(s string) bool {
+	_, err := Parse(s)
+	return err == nil
+}
+
+// checkDigit computes the check digit of the first 7 digits of an ISSN: modulus 11, weights 8 to 2
+func checkDigit(digits string) byte {
+	var sum int
+	for i := 0; i < 7; i++ {
+		sum += int(digits[i]-'0') * (8 - i)
+	}
+	switch c := (11 - sum%11) % 11; c {
+	case 10:
+		return 'X'
+	default:
+		return byte('0' + c)
+	}
+}
+
+// String returns the ISSN as it's usually displayed, e.g. 0378-5955
+func (i ISSN) String() string {
+	if len(i) != 8 {
+		return string(i)
+	}
+	return string(i[:4]) + "-" + string(i[4:])
+}
+
+// number is the ISSN without its check digit, as a number: it's enough to tell ISSNs apart
+func (i ISSN) number() uint32 {
+	var n uint32
+	for j := 0; j < 7; j++ {
+		n = n*10 + uint32(i[j]-'0')
+	}
+	return n
+}
+
+// fromNumber returns the ISSN of a number, computing its check digit
+func fromNumber(n uint32) ISSN {
+	digits := []byte{'0', '0', '0', '0', '0', '0', '0'}
+	for j := 6; j >= 0; j-- {
+		digits[j] = byte('0' + n%10)
+		n /= 10
+	}
+	return ISSN(string(digits) + string(checkDigit(string(digits))))
+}
+
+// Table links ISSNs to their ISSN-L. Only the ISSNs which aren't their own ISSN-L are kept,
+// as numbers, so that the full table of the ISSN International Centre fits in memory
+type Table map[uint32]uint32
+
+// ReadTable reads a table of ISSN-L: one ISSN per line, tab delimited, its ISSN-L in the second column,
+// as in the ISSN-to-ISSN-L.txt file of the ISSN International Centre. Lines which don't hold 2 ISSNs, e.g. the header, are skipped
+func ReadTable(r io.Reader) (Table, error) {
+	t := make(Table)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		cols := strings.Split(scanner.Text(), "\t")
+		if len(cols) < 2 {
+			continue
+		}
+		i, err1 := Parse(cols[0])
+		l, err2 := Parse(cols[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if i != l {
+			t[i.number()] = l.number()
+		}
+	}
+
+	return t, scanner.Err()
+}
+
+// Linking returns the ISSN-L of an ISSN: the ISSN itself if the table doesn't say otherwise
+func (t Table) Linking(i ISSN) ISSN {
+	if l, ok := t[i.number()]; ok {
+		return fromNumber(l)
+	}
+	return i
+}
+
+// groupIndex lists the ISSNs of a table by ISSN-L, to find the ISSNs sharing an ISSN-L:
+// each entry is the number of the ISSN-L, then the number of the ISSN, sorted
+func (t Table) groupIndex() []uint64 {
+	index := make([]uint64, 0, len(t))
+	for i, l := range t {
+		index = append(index, uint64(l)<<32|uint64(i))
+	}
+	sort.Slice(index, func(a, b int) bool { return index[a] < index[b] })
+	return index
+}
+
+// group returns the ISSNs sharing the ISSN-L of an ISSN, the ISSN-L first, from a table & its index
+func (t Table) group(index []uint64, i ISSN) []ISSN {
+	l := t.Linking(i)
+	group := []ISSN{l}
+
+	n := uint64(l.number()) << 32
+	for j := sort.Search(len(index), func(j int) bool { return index[j] >= n }); j < len(index) && index[j]>>32 == n>>32; j++ {
+		group = append(group, fromNumber(uint32(index[j])))
+	}
+	return group
+}
+
+// the table used by the package functions, loaded at startup, and its index by ISSN-L
+var (
+	table      Table
+	tableIndex []uint64
+	tableMutex sync.RWMutex
+)
+
+// LoadTable reads the table of ISSN-L used by Linking from a file
+func LoadTable(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	t, err := ReadTable(f)
+	if err != nil {
+		return 0, err
+	}
+
+	index := t.groupIndex()
+
+	tableMutex.Lock()
+	table, tableIndex = t, index
+	tableMutex.Unlock()
+
+	return len(t), nil
+}
+
+// Linking returns the ISSN-L of an ISSN, from the table loaded.
+// Without a table, or for an ISSN the table doesn't know, an ISSN is its own ISSN-L
+func Linking(i ISSN) ISSN {
+	tableMutex.RLock()
+	defer tableMutex.RUnlock()
+	return table.Linking(i)
+}
+
+// Group returns the ISSNs sharing the ISSN-L of an ISSN, from the table loaded, the ISSN-L first:
+// e.g. the print & online ISSNs of a serial. Without a table, an ISSN is on its own
+func Group(i ISSN) []ISSN {
+	tableMutex.RLock()
+	defer tableMutex.RUnlock()
+	return table.group(tableIndex, i)
+}
@@ -0,0 +1,145 @@
+package issn
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    ISSN
+		wantErr error
+	}{
+		{"0378-5955", "03785955", nil},
+		{"03785955", "03785955", nil},
+		{" ISSN 0378-5955 ", "03785955", nil},
+		{"issn 0378 5955", "03785955", nil},
+		{"0317-8471", "03178471", nil},
+		{"1050-124X", "1050124X", nil},
+		{"1050-124x", "1050124X", nil},
+		{"0028-0836", "00280836", nil},
+		{"1476-4687", "14764687", nil},
+		{"0378-5954", "", ErrCheckDigit},
+		{"1050-1240", "", ErrCheckDigit},
+		{"0378-595", "", ErrInvalidISSN},
+		{"0378-59555", "", ErrInvalidISSN},
+		{"X378-5955", "", ErrInvalidISSN},
+		{"0378-595Y", "", ErrInvalidISSN},
+		{"9782070368228", "", ErrInvalidISSN},
+		{"", "", ErrInvalidISSN},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.s)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("Parse(%q) = %q, %v, want %q, %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+		if Valid(tt.s) != (tt.wantErr == nil) {
+			t.Errorf("Valid(%q) = %v, want %v", tt.s, !(tt.wantErr == nil), tt.wantErr == nil)
+		}
+	}
+}
+
+func TestCheckDigit(t *testing.T) {
+	tests := []struct {
+		digits string
+		want   byte
+	}{
+		{"0378595", '5'},
+		{"0317847", '1'},
+		{"1050124", 'X'},
+		{"0000000", '0'},
+		{"2434561", 'X'},
+	}
+
+	for _, tt := range tests {
+		if got := checkDigit(tt.digits); got != tt.want {
+			t.Errorf("checkDigit(%q) = %q, want %q", tt.digits, got, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		i    ISSN
+		want string
+	}{
+		{"03785955", "0378-5955"},
+		{"1050124X", "1050-124X"},
+		{"0378", "0378"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.i.String(); got != tt.want {
+			t.Errorf("ISSN(%q).String() = %q, want %q", string(tt.i), got, tt.want)
+		}
+	}
+}
+
+func TestNumber(t *testing.T) {
+	for _, i := range []ISSN{"03785955", "1050124X", "00000000", "99999994"} {
+		if got := fromNumber(i.number()); got != i {
+			t.Errorf("fromNumber(%q.number()) = %q", string(i), got)
+		}
+	}
+}
+
+// issnlTable is the start of an ISSN-to-ISSN-L.txt file: Nature print & online, a serial on its own, a line with a wrong ISSN
+const issnlTable = "ISSN\tISSN-L\n" +
+	"0028-0836\t0028-0836\n" +
+	"1476-4687\t0028-0836\n" +
+	"0378-5955\t0378-5955\n" +
+	"1050-1240\t0378-5955\n" +
+	"single column\n"
+
+func TestTable(t *testing.T) {
+	table, err := ReadTable(strings.NewReader(issnlTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the ISSNs which aren't their own ISSN-L are kept
+	if len(table) != 1 {
+		t.Errorf("table of %d ISSNs, want 1", len(table))
+	}
+
+	linking := []struct {
+		i    ISSN
+		want ISSN
+	}{
+		{"14764687", "00280836"},
+		{"00280836", "00280836"},
+		{"03785955", "03785955"},
+		{"1050124X", "1050124X"},
+	}
+	for _, tt := range linking {
+		if got := table.Linking(tt.i); got != tt.want {
+			t.Errorf("Linking(%q) = %q, want %q", string(tt.i), got, tt.want)
+		}
+	}
+
+	index := table.groupIndex()
+	groups := []struct {
+		i    ISSN
+		want []ISSN
+	}{
+		{"14764687", []ISSN{"00280836", "14764687"}},
+		{"00280836", []ISSN{"00280836", "14764687"}},
+		{"03785955", []ISSN{"03785955"}},
+	}
+	for _, tt := range groups {
+		if got := table.group(index, tt.i); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("group(%q) = %q, want %q", string(tt.i), got, tt.want)
+		}
+	}
+
+	// without a table, an ISSN is its own ISSN-L, on its own
+	var empty Table
+	if got := empty.Linking("14764687"); got != "14764687" {
+		t.Errorf("Linking without table = %q, want the ISSN", got)
+	}
+	if got := empty.group(nil, "14764687"); !reflect.DeepEqual(got, []ISSN{"14764687"}) {
+		t.Errorf("group without table = %q, want the ISSN", got)
+	}
+}
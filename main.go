@@ -7,8 +7,10 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/nicomo/abacaxi/config"
 	"github.com/nicomo/abacaxi/controllers"
+	"github.com/nicomo/abacaxi/issn"
+	"github.com/nicomo/abacaxi/logger"
 	"github.com/nicomo/abacaxi/middleware"
-	_ "github.com/nicomo/abacaxi/models"
+	"github.com/nicomo/abacaxi/models"
 	"github.com/nicomo/abacaxi/session"
 )
 
@@ -16,9 +18,31 @@ func main() {
 	// get config params
 	conf := config.GetConfig()
 
+	// connect to mongoDB
+	models.Init(conf)
+
 	// create a session store
 	session.StoreCreate(conf.SessionStoreKey)
 
+	// load the table linking ISSNs to their ISSN-L, if any
+	if conf.ISSNLTable != "" {
+		n, err := issn.LoadTable(conf.ISSNLTable)
+		if err != nil {
+			logger.Error.Printf("couldn't load the ISSN-L table %s: %v", conf.ISSNLTable, err)
+		} else {
+			logger.Info.Printf("ISSN-L table loaded: %d ISSNs linked", n)
+		}
+	}
+
+	// start the background workers processing the jobs queue
+	controllers.StartJobWorkers(2)
+
+	// start the scheduler queueing the scheduled exports
+	controllers.StartExportScheduler()
+
+	// start the purge of the records deleted for longer than the retention period
+	controllers.StartTrashPurger(conf.TrashRetentionDays)
+
 	// create a router & all routes
 	router := mux.NewRouter()
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
@@ -27,28 +51,66 @@ func main() {
 	router.Handle("/", http.HandlerFunc(controllers.HomeHandler))
 
 	// all inner pages subject to authentication
+	router.Handle("/compare", middleware.DisallowAnon(http.HandlerFunc(controllers.CompareHandler)))
+	router.Handle("/compare/export", middleware.DisallowAnon(http.HandlerFunc(controllers.CompareExportHandler)))
+	router.Handle("/duplicates", middleware.DisallowAnon(http.HandlerFunc(controllers.DuplicatesHandler)))
+	router.Handle("/duplicates/find", middleware.DisallowAnon(http.HandlerFunc(controllers.DuplicatesFindHandler))).Methods("POST")
+	router.Handle("/duplicates/merge/{duplicateID}", middleware.DisallowAnon(http.HandlerFunc(controllers.DuplicateMergeHandler))).Methods("POST")
+	router.Handle("/duplicates/dismiss/{duplicateID}", middleware.DisallowAnon(http.HandlerFunc(controllers.DuplicateDismissHandler))).Methods("POST")
+	router.Handle("/jobs", middleware.DisallowAnon(http.HandlerFunc(controllers.JobsHandler)))
+	router.Handle("/jobs/cancel/{jobID}", middleware.DisallowAnon(http.HandlerFunc(controllers.JobCancelHandler)))
+	router.Handle("/jobs/retry/{jobID}", middleware.DisallowAnon(http.HandlerFunc(controllers.JobRetryHandler)))
+	router.Handle("/mergepolicy", middleware.DisallowAnon(http.HandlerFunc(controllers.MergePolicyHandler)))
+	router.Handle("/mergepolicy/set", middleware.DisallowAnon(http.HandlerFunc(controllers.MergePolicySetHandler))).Methods("POST")
+	router.Handle("/mergepolicy/delete", middleware.DisallowAnon(http.HandlerFunc(controllers.MergePolicyDeleteHandler))).Methods("POST")
+	router.Handle("/records/bulk", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordsBulkHandler))).Methods("POST")
+	router.Handle("/record/new", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordNewGetHandler))).Methods("GET")
+	router.Handle("/record/new", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordNewPostHandler))).Methods("POST")
 	router.Handle("/record/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordHandler)))
 	router.Handle("/record/export/unimarc/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordExportUnimarcHandler)))
+	router.Handle("/record/export/marc21/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordExportMarc21Handler)))
+	router.Handle("/record/edit/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordEditGetHandler))).Methods("GET")
+	router.Handle("/record/edit/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordEditPostHandler))).Methods("POST")
 	router.Handle("/record/delete/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordDeleteHandler)))
+	router.Handle("/record/restore/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordRestoreHandler)))
 	router.Handle("/record/toggleacquired/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordToggleAcquiredHandler)))
 	router.Handle("/record/toggleactive/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordToggleActiveHandler)))
+	router.Handle("/record/revert/{revisionID}", middleware.DisallowAnon(http.HandlerFunc(controllers.RecordRevertHandler)))
 	router.Handle("/reports", middleware.DisallowAnon(http.HandlerFunc(controllers.ReportsHandler)))
+	router.Handle("/reports/revert/{reportID}", middleware.DisallowAnon(http.HandlerFunc(controllers.ReportRevertHandler)))
 	router.Handle("/ts/display/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceHandler)))
 	router.Handle("/ts/display/{targetservice}/{page:[0-9]+}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServicePageHandler)))
 	router.Handle("/ts/delete/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceDeleteHandler)))
 	router.Handle("/ts/export/unimarc/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceExportUnimarcHandler)))
+	router.Handle("/ts/export/marc21/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceExportMarc21Handler)))
+	router.Handle("/ts/export/changes/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceExportChangesHandler)))
 	router.Handle("/ts/export/kbart/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceExportKbartHandler)))
+	router.Handle("/ts/snapshots/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceSnapshotsHandler)))
+	router.Handle("/ts/snapshots/new/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceSnapshotNewHandler)))
 	router.Handle("/ts/toggleactive/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceToggleActiveHandler)))
+	router.Handle("/ts/enrichment/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceEnrichmentGetHandler))).Methods("GET")
+	router.Handle("/ts/enrichment/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceEnrichmentPostHandler))).Methods("POST")
 	router.Handle("/ts/update/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceUpdateGetHandler))).Methods("GET")
 	router.Handle("/ts/update/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceUpdatePostHandler))).Methods("POST")
 	router.Handle("/ts/new", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceNewGetHandler))).Methods("GET")
 	router.Handle("/ts/new", middleware.DisallowAnon(http.HandlerFunc(controllers.TargetServiceNewPostHandler))).Methods("POST")
+	router.Handle("/schedules", middleware.DisallowAnon(http.HandlerFunc(controllers.ExportSchedulesHandler)))
+	router.Handle("/schedules/new", middleware.DisallowAnon(http.HandlerFunc(controllers.ExportScheduleNewPostHandler))).Methods("POST")
+	router.Handle("/schedules/toggle/{scheduleID}", middleware.DisallowAnon(http.HandlerFunc(controllers.ExportScheduleToggleHandler)))
+	router.Handle("/schedules/run/{scheduleID}", middleware.DisallowAnon(http.HandlerFunc(controllers.ExportScheduleRunHandler)))
+	router.Handle("/schedules/delete/{scheduleID}", middleware.DisallowAnon(http.HandlerFunc(controllers.ExportScheduleDeleteHandler)))
+	router.Handle("/trash", middleware.DisallowAnon(http.HandlerFunc(controllers.TrashHandler)))
+	router.Handle("/snapshot/{snapshotID}", middleware.DisallowAnon(http.HandlerFunc(controllers.SnapshotHandler)))
+	router.Handle("/snapshot/export/kbart/{snapshotID}", middleware.DisallowAnon(http.HandlerFunc(controllers.SnapshotExportKbartHandler)))
 	router.Handle("/search", middleware.DisallowAnon(http.HandlerFunc(controllers.SearchHandler)))
 	router.Handle("/sudocgetrecord/{recordID}", middleware.DisallowAnon(http.HandlerFunc(controllers.GetSudocRecordHandler)))
 	router.Handle("/sudocgetrecords/{targetservice}", middleware.DisallowAnon(http.HandlerFunc(controllers.GetSudocRecordsHandler)))
 	router.Handle("/upload", middleware.DisallowAnon(http.HandlerFunc(controllers.UploadGetHandler))).Methods("GET")
 	router.Handle("/upload", middleware.DisallowAnon(http.HandlerFunc(controllers.UploadPostHandler))).Methods("POST")
+	router.Handle("/upload/confirm/{jobID}", middleware.DisallowAnon(http.HandlerFunc(controllers.UploadConfirmHandler)))
+	router.Handle("/upload/discard/{jobID}", middleware.DisallowAnon(http.HandlerFunc(controllers.UploadDiscardHandler)))
 	router.Handle("/users", middleware.DisallowAnon(http.HandlerFunc(controllers.UsersHandler)))
+	router.Handle("/users/token", middleware.DisallowAnon(http.HandlerFunc(controllers.UserAPITokenHandler))).Methods("POST")
 	router.Handle("/users/delete/{userID}", middleware.DisallowAnon(http.HandlerFunc(controllers.UserDeleteHandler)))
 	// user login pages allowed for anon users only
 	router.Handle("/users/login", middleware.DisallowAuthed(http.HandlerFunc(controllers.UserLoginGetHandler))).Methods("GET")
@@ -57,6 +119,31 @@ func main() {
 	router.Handle("/users/new", middleware.DisallowAnon(http.HandlerFunc(controllers.UserNewGetHandler))).Methods("GET")
 	router.Handle("/users/new", middleware.DisallowAnon(http.HandlerFunc(controllers.UserNewPostHandler))).Methods("POST")
 
+	// JSON API, authenticated with a token
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.Handle("/jobs", middleware.APIAuth(http.HandlerFunc(controllers.APIJobsHandler))).Methods("GET")
+	api.Handle("/jobs", middleware.APIAuth(http.HandlerFunc(controllers.APIJobCreateHandler))).Methods("POST")
+	api.Handle("/jobs/{jobID}", middleware.APIAuth(http.HandlerFunc(controllers.APIJobGetHandler))).Methods("GET")
+	api.Handle("/jobs/{jobID}/cancel", middleware.APIAuth(http.HandlerFunc(controllers.APIJobCancelHandler))).Methods("POST")
+	api.Handle("/jobs/{jobID}/retry", middleware.APIAuth(http.HandlerFunc(controllers.APIJobRetryHandler))).Methods("POST")
+	api.Handle("/records", middleware.APIAuth(http.HandlerFunc(controllers.APIRecordsHandler))).Methods("GET")
+	api.Handle("/records", middleware.APIAuth(http.HandlerFunc(controllers.APIRecordCreateHandler))).Methods("POST")
+	api.Handle("/records/{recordID}", middleware.APIAuth(http.HandlerFunc(controllers.APIRecordGetHandler))).Methods("GET")
+	api.Handle("/records/{recordID}", middleware.APIAuth(http.HandlerFunc(controllers.APIRecordUpdateHandler))).Methods("PUT")
+	api.Handle("/records/{recordID}", middleware.APIAuth(http.HandlerFunc(controllers.APIRecordDeleteHandler))).Methods("DELETE")
+	api.Handle("/records/{recordID}/revisions", middleware.APIAuth(http.HandlerFunc(controllers.APIRecordRevisionsHandler))).Methods("GET")
+	api.Handle("/targetservices", middleware.APIAuth(http.HandlerFunc(controllers.APITargetServicesHandler))).Methods("GET")
+	api.Handle("/targetservices", middleware.APIAuth(http.HandlerFunc(controllers.APITargetServiceCreateHandler))).Methods("POST")
+	api.Handle("/targetservices/{targetservice}", middleware.APIAuth(http.HandlerFunc(controllers.APITargetServiceGetHandler))).Methods("GET")
+	api.Handle("/targetservices/{targetservice}", middleware.APIAuth(http.HandlerFunc(controllers.APITargetServiceUpdateHandler))).Methods("PUT")
+	api.Handle("/targetservices/{targetservice}", middleware.APIAuth(http.HandlerFunc(controllers.APITargetServiceDeleteHandler))).Methods("DELETE")
+	api.Handle("/targetservices/{targetservice}/records", middleware.APIAuth(http.HandlerFunc(controllers.APITargetServiceRecordCreateHandler))).Methods("POST")
+	api.Handle("/reports", middleware.APIAuth(http.HandlerFunc(controllers.APIReportsHandler))).Methods("GET")
+	api.Handle("/reports", middleware.APIAuth(http.HandlerFunc(controllers.APIReportCreateHandler))).Methods("POST")
+	api.Handle("/reports/{reportID}", middleware.APIAuth(http.HandlerFunc(controllers.APIReportGetHandler))).Methods("GET")
+	api.Handle("/reports/{reportID}", middleware.APIAuth(http.HandlerFunc(controllers.APIReportUpdateHandler))).Methods("PUT")
+	api.Handle("/reports/{reportID}", middleware.APIAuth(http.HandlerFunc(controllers.APIReportDeleteHandler))).Methods("DELETE")
+
 	// 404
 	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
@@ -0,0 +1,225 @@
+package marc
+
+import (
+	"strings"
+	"time"
+)
+
+// fieldMapping maps a Unimarc data field to a MARC21 data field.
+// Subfields without a mapping are dropped
+type fieldMapping struct {
+	tag       string
+	ind1      string
+	ind2      string
+	subfields map[string]string
+}
+
+// unimarcToMarc21 lists the Unimarc fields carried over to MARC21, besides the ones needing more work:
+// leader, 008, 200 (title) and 7xx (names)
+var unimarcToMarc21 = map[string]fieldMapping{
+	"010": {tag: "020", ind1: " ", ind2: " ", subfields: map[string]string{"a": "a", "b": "q", "z": "z"}},
+	"011": {tag: "022", ind1: " ", ind2: " ", subfields: map[string]string{"a": "a", "y": "y", "z": "z"}},
+	"101": {tag: "041", ind1: "0", ind2: " ", subfields: map[string]string{"a": "a", "c": "h"}},
+	"205": {tag: "250", ind1: " ", ind2: " ", subfields: map[string]string{"a": "a", "b": "b"}},
+	"210": {tag: "264", ind1: " ", ind2: "1", subfields: map[string]string{"a": "a", "c": "b", "d": "c"}},
+	"215": {tag: "300", ind1: " ", ind2: " ", subfields: map[string]string{"a": "a", "c": "b", "d": "c", "e": "e"}},
+	"225": {tag: "490", ind1: "0", ind2: " ", subfields: map[string]string{"a": "a", "v": "v", "x": "x"}},
+	"300": {tag: "500", ind1: " ", ind2: " ", subfields: map[string]string{"a": "a"}},
+	"320": {tag: "504", ind1: " ", ind2: " ", subfields: map[string]string{"a": "a"}},
+	"327": {tag: "505", ind1: "0", ind2: " ", subfields: map[string]string{"a": "a"}},
+	"330": {tag: "520", ind1: " ", ind2: " ", subfields: map[string]string{"a": "a"}},
+	"606": {tag: "650", ind1: " ", ind2: "4", subfields: map[string]string{"a": "a", "x": "x", "y": "z", "z": "y"}},
+	"607": {tag: "651", ind1: " ", ind2: "4", subfields: map[string]string{"a": "a", "x": "x", "y": "z", "z": "y"}},
+	"610": {tag: "653", ind1: " ", ind2: " ", subfields: map[string]string{"a": "a"}},
+	"676": {tag: "082", ind1: "0", ind2: "4", subfields: map[string]string{"a": "a", "v": "2"}},
+	"856": {tag: "856", ind1: "4", ind2: "0", subfields: map[string]string{"u": "u", "z": "z", "y": "y"}},
+}
+
+// unimarcRelators maps the most frequent Unimarc relator codes to MARC21 relator codes
+var unimarcRelators = map[string]string{
+	"070": "aut",
+	"340": "edt",
+	"440": "ill",
+	"651": "pbd",
+	"730": "trl",
+}
+
+// ToMarc21 derives a MARC21 record from a Unimarc record.
+// This is a crosswalk of the fields we commonly use, not a complete conversion
+func ToMarc21(u Record) Record {
+	var m Record
+
+	m.Leader = marc21Leader(u.Leader)
+
+	// control fields: record ID & date of last transaction keep their tag
+	for _, tag := range []string{"001", "005"} {
+		if v := u.ControlField(tag); v != "" {
+			m.ControlFields = append(m.ControlFields, ControlField{Tag: tag, Value: v})
+		}
+	}
+	m.ControlFields = append(m.ControlFields, ControlField{Tag: "008", Value: marc21Fixed(u)})
+
+	// the Sudoc record ID is kept as a system control number
+	if ppn := u.ControlField("001"); ppn != "" {
+		m.DataFields = append(m.DataFields, DataField{Tag: "035", Ind1: " ", Ind2: " ", Subfields: []Subfield{{Code: "a", Value: "(PPN)" + ppn}}})
+	}
+
+	// main entry: first 700 (personal name) or 710 (corporate name)
+	mainEntry := false
+	for _, f := range u.DataFields {
+		switch f.Tag {
+		case "700":
+			m.DataFields = append(m.DataFields, marc21Name(f, "100", "1"))
+			mainEntry = true
+		case "701", "702":
+			m.DataFields = append(m.DataFields, marc21Name(f, "700", "1"))
+		case "710":
+			m.DataFields = append(m.DataFields, marc21Corporate(f, "110"))
+			mainEntry = true
+		case "711", "712":
+			m.DataFields = append(m.DataFields, marc21Corporate(f, "710"))
+		case "200":
+			m.DataFields = append(m.DataFields, marc21Title(f))
+		default:
+			if mapping, ok := unimarcToMarc21[f.Tag]; ok {
+				m.DataFields = append(m.DataFields, mapping.apply(f))
+			}
+		}
+	}
+
+	// 245 first indicator: title added entry only if there's a main entry
+	for i, f := range m.DataFields {
+		if f.Tag == "245" && mainEntry {
+			m.DataFields[i].Ind1 = "1"
+		}
+	}
+
+	m.sortFields()
+	return m
+}
+
+// apply converts a data field according to the mapping
+func (fm fieldMapping) apply(f DataField) DataField {
+	df := DataField{Tag: fm.tag, Ind1: fm.ind1, Ind2: fm.ind2}
+	for _, sf := range f.Subfields {
+		if code, ok := fm.subfields[sf.Code]; ok {
+			df.Subfields = append(df.Subfields, Subfield{Code: code, Value: sf.Value})
+		}
+	}
+	return df
+}
+
+// marc21Title converts a 200 title field into a 245, with ISBD punctuation
+func marc21Title(f DataField) DataField {
+	df := DataField{Tag: "245", Ind1: "0", Ind2: "0"}
+	title := f.Subfield("a")
+	subtitle := strings.Join(f.SubfieldValues("e"), " : ")
+	responsibility := strings.Join(f.SubfieldValues("f"), " ; ")
+
+	if subtitle != "" {
+		title += " :"
+	} else if responsibility != "" {
+		title += " /"
+	}
+	df.Subfields = append(df.Subfields, Subfield{Code: "a", Value: title})
+	if subtitle != "" {
+		if responsibility != "" {
+			subtitle += " /"
+		}
+		df.Subfields = append(df.Subfields, Subfield{Code: "b", Value: subtitle})
+	}
+	if responsibility != "" {
+		df.Subfields = append(df.Subfields, Subfield{Code: "c", Value: responsibility})
+	}
+	for _, v := range f.SubfieldValues("h") {
+		df.Subfields = append(df.Subfields, Subfield{Code: "n", Value: v})
+	}
+	for _, v := range f.SubfieldValues("i") {
+		df.Subfields = append(df.Subfields, Subfield{Code: "p", Value: v})
+	}
+	return df
+}
+
+// marc21Name converts a 70x personal name into a 100 / 700
+func marc21Name(f DataField, tag, ind1 string) DataField {
+	df := DataField{Tag: tag, Ind1: ind1, Ind2: " "}
+	name := f.Subfield("a")
+	if forename := f.Subfield("b"); forename != "" {
+		name += ", " + forename
+	}
+	df.Subfields = append(df.Subfields, Subfield{Code: "a", Value: name})
+	if dates := f.Subfield("f"); dates != "" {
+		df.Subfields = append(df.Subfields, Subfield{Code: "d", Value: dates})
+	}
+	df.Subfields = append(df.Subfields, marc21Relators(f)...)
+	return df
+}
+
+// marc21Corporate converts a 71x corporate name into a 110 / 710
+func marc21Corporate(f DataField, tag string) DataField {
+	df := DataField{Tag: tag, Ind1: "2", Ind2: " "}
+	df.Subfields = append(df.Subfields, Subfield{Code: "a", Value: f.Subfield("a")})
+	for _, v := range f.SubfieldValues("b") {
+		df.Subfields = append(df.Subfields, Subfield{Code: "b", Value: v})
+	}
+	df.Subfields = append(df.Subfields, marc21Relators(f)...)
+	return df
+}
+
+// marc21Relators converts the $4 relator codes we know of
+func marc21Relators(f DataField) []Subfield {
+	var subfields []Subfield
+	for _, code := range f.SubfieldValues("4") {
+		if relator, ok := unimarcRelators[code]; ok {
+			subfields = append(subfields, Subfield{Code: "4", Value: relator})
+		}
+	}
+	return subfields
+}
+
+// marc21Leader keeps record status, type & bibliographic level from the Unimarc leader,
+// and sets the MARC21 specific positions: UTF-8 encoding, ISBD punctuation, entry map
+func marc21Leader(leader string) string {
+	l := []byte("     nam a22      i 4500")
+	u := []byte(leader)
+	if len(u) == 24 {
+		l[5], l[6], l[7] = u[5], u[6], u[7]
+	}
+	return string(l)
+}
+
+// marc21Fixed builds the 008 fixed length data elements from the Unimarc 100 & 101 fields
+func marc21Fixed(u Record) string {
+	// date entered, type of date & dates, place, material specific elements, language, modified record, source
+	f := []byte(time.Now().Format("060102") + "s" + "||||" + "    " + "xx " + strings.Repeat("|", 17) + "und" + " " + "d")
+
+	// 100$a: general processing data, e.g. 20170315d2016    k  y0frey50      ba
+	general := u.FirstSubfield("100", "a")
+	if len(general) >= 17 {
+		if entered, err := time.Parse("20060102", general[0:8]); err == nil {
+			copy(f[0:6], entered.Format("060102"))
+		}
+		copy(f[7:11], general[9:13])
+		if strings.TrimSpace(general[13:17]) != "" {
+			f[6] = 'm'
+			copy(f[11:15], general[13:17])
+		}
+	}
+
+	// 101$a: language of the text
+	if lang := u.FirstSubfield("101", "a"); len(lang) == 3 {
+		copy(f[35:38], lang)
+	}
+
+	return string(f)
+}
+
+// sortFields orders the data fields by tag, as MARC21 expects, keeping the order of repeated fields
+func (r *Record) sortFields() {
+	fields := r.DataFields
+	for i := 1; i < len(fields); i++ {
+		for j := i; j > 0 && fields[j].Tag < fields[j-1].Tag; j-- {
+			fields[j], fields[j-1] = fields[j-1], fields[j]
+		}
+	}
+}
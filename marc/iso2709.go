@@ -0,0 +1,88 @@
+package marc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ISO 2709 separators
+const (
+	subfieldDelimiter = 0x1F
+	fieldTerminator   = 0x1E
+	recordTerminator  = 0x1D
+)
+
+// ErrRecordTooLong is returned when a record, or one of its fields, doesn't fit in the ISO 2709 length limits
+var ErrRecordTooLong = errors.New("record too long for ISO 2709")
+
+// MarshalISO2709 encodes a record as binary MARC (ISO 2709).
+// Lengths & base address in the leader are computed, the other leader positions are kept
+func (r Record) MarshalISO2709() ([]byte, error) {
+	var directory, data bytes.Buffer
+
+	addField := func(tag string, content []byte) error {
+		content = append(content, fieldTerminator)
+		if len(content) > 9999 {
+			return ErrRecordTooLong
+		}
+		fmt.Fprintf(&directory, "%3.3s%04d%05d", tag, len(content), data.Len())
+		data.Write(content)
+		return nil
+	}
+
+	for _, f := range r.ControlFields {
+		if err := addField(f.Tag, []byte(f.Value)); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range r.DataFields {
+		var content bytes.Buffer
+		content.WriteString(indicator(f.Ind1))
+		content.WriteString(indicator(f.Ind2))
+		for _, sf := range f.Subfields {
+			content.WriteByte(subfieldDelimiter)
+			content.WriteString(sf.Code)
+			content.WriteString(sf.Value)
+		}
+		if err := addField(f.Tag, content.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	directory.WriteByte(fieldTerminator)
+
+	baseAddress := 24 + directory.Len()
+	length := baseAddress + data.Len() + 1
+	if length > 99999 {
+		return nil, ErrRecordTooLong
+	}
+
+	var out bytes.Buffer
+	out.WriteString(leaderISO2709(r.Leader, length, baseAddress))
+	out.Write(directory.Bytes())
+	out.Write(data.Bytes())
+	out.WriteByte(recordTerminator)
+	return out.Bytes(), nil
+}
+
+// indicator returns a blank for a missing indicator
+func indicator(ind string) string {
+	if ind == "" {
+		return " "
+	}
+	return ind[:1]
+}
+
+// leaderISO2709 sets the structural positions of a leader:
+// record length (00-04), indicator & subfield code counts (10-11), base address (12-16), entry map (20-23).
+// The leader is 24 bytes, whatever the input: it's padded with blanks or cut
+func leaderISO2709(leader string, length, baseAddress int) string {
+	l := []byte(strings.Repeat(" ", 24))
+	copy(l, leader)
+	copy(l[0:5], fmt.Sprintf("%05d", length))
+	l[10], l[11] = '2', '2'
+	copy(l[12:17], fmt.Sprintf("%05d", baseAddress))
+	copy(l[20:24], "4500")
+	return string(l)
+}
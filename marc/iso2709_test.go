@@ -0,0 +1,130 @@
+package marc
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// unmarshalISO2709 decodes a single binary MARC record, the way an ILS loader reads it
+func unmarshalISO2709(t *testing.T, b []byte) Record {
+	t.Helper()
+
+	if len(b) < 24 || b[len(b)-1] != recordTerminator {
+		t.Fatalf("not an ISO 2709 record: %q", b)
+	}
+	length, err := strconv.Atoi(string(b[0:5]))
+	if err != nil || length != len(b) {
+		t.Fatalf("record length %q, want %05d", b[0:5], len(b))
+	}
+	baseAddress, err := strconv.Atoi(string(b[12:17]))
+	if err != nil || b[baseAddress-1] != fieldTerminator {
+		t.Fatalf("base address %q doesn't follow the directory", b[12:17])
+	}
+
+	r := Record{Leader: string(b[:24])}
+	for dir := b[24 : baseAddress-1]; len(dir) > 0; dir = dir[12:] {
+		if len(dir) < 12 {
+			t.Fatalf("truncated directory entry %q", dir)
+		}
+		tag := string(dir[0:3])
+		fieldLength, _ := strconv.Atoi(string(dir[3:7]))
+		start, _ := strconv.Atoi(string(dir[7:12]))
+		content := b[baseAddress+start : baseAddress+start+fieldLength]
+		if content[len(content)-1] != fieldTerminator {
+			t.Fatalf("field %s isn't terminated", tag)
+		}
+		content = content[:len(content)-1]
+
+		if strings.HasPrefix(tag, "00") {
+			r.ControlFields = append(r.ControlFields, ControlField{Tag: tag, Value: string(content)})
+			continue
+		}
+		f := DataField{Tag: tag, Ind1: string(content[0:1]), Ind2: string(content[1:2])}
+		for _, sf := range bytes.Split(content[2:], []byte{subfieldDelimiter})[1:] {
+			f.Subfields = append(f.Subfields, Subfield{Code: string(sf[:1]), Value: string(sf[1:])})
+		}
+		r.DataFields = append(r.DataFields, f)
+	}
+	return r
+}
+
+func TestMarshalISO2709RoundTrip(t *testing.T) {
+	r, err := Parse(sudocRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := r.MarshalISO2709()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := unmarshalISO2709(t, b)
+
+	if !reflect.DeepEqual(got.ControlFields, r.ControlFields) {
+		t.Errorf("control fields = %v, want %v", got.ControlFields, r.ControlFields)
+	}
+	if !reflect.DeepEqual(got.DataFields, r.DataFields) {
+		t.Errorf("data fields = %v, want %v", got.DataFields, r.DataFields)
+	}
+	// positions which aren't structural are kept
+	if got.Leader[5:10] != r.Leader[5:10] || got.Leader[17:20] != r.Leader[17:20] {
+		t.Errorf("leader = %q, want the positions of %q", got.Leader, r.Leader)
+	}
+}
+
+func TestLeaderISO2709(t *testing.T) {
+	tests := []struct {
+		name   string
+		leader string
+		want   string
+	}{
+		{"sudoc leader", "     cas0 22        450 ", "00123cas0 2200045   4500"},
+		{"empty leader", "", "00123     2200045   4500"},
+		{"entry map overwritten", "     nam  22        1234", "00123nam  2200045   4500"},
+		{"short leader", "     nam", "00123nam  2200045   4500"},
+		{"long leader", "     nam  22        450 trailing", "00123nam  2200045   4500"},
+	}
+
+	for _, tt := range tests {
+		if got := leaderISO2709(tt.leader, 123, 45); got != tt.want {
+			t.Errorf("%s: leaderISO2709(%q) = %q, want %q", tt.name, tt.leader, got, tt.want)
+		}
+	}
+
+	// a leader is 24 bytes, even with multibyte characters
+	got := leaderISO2709(strings.Repeat("é", 24), 123, 45)
+	if len(got) != 24 || got[0:5] != "00123" || got[12:17] != "00045" || got[20:24] != "4500" {
+		t.Errorf("multibyte leader: leaderISO2709 = %q (%d bytes)", got, len(got))
+	}
+}
+
+func TestMarshalISO2709Lengths(t *testing.T) {
+	r := Record{
+		Leader:        "     nam  22        450 ",
+		ControlFields: []ControlField{{Tag: "001", Value: "123456789"}},
+		DataFields: []DataField{
+			{Tag: "200", Ind1: "1", Subfields: []Subfield{{Code: "a", Value: "Études françaises"}}},
+		},
+	}
+
+	b, err := r.MarshalISO2709()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lengths are in bytes, not in characters
+	got := unmarshalISO2709(t, b)
+	if v := got.DataFields[0].Subfield("a"); v != "Études françaises" {
+		t.Errorf("200$a = %q, want %q", v, "Études françaises")
+	}
+	if got.DataFields[0].Ind2 != " " {
+		t.Errorf("missing indicator = %q, want a blank", got.DataFields[0].Ind2)
+	}
+
+	r.DataFields[0].Subfields[0].Value = strings.Repeat("a", 10000)
+	if _, err := r.MarshalISO2709(); err != ErrRecordTooLong {
+		t.Errorf("field of 10000 bytes: err = %v, want %v", err, ErrRecordTooLong)
+	}
+}
@@ -0,0 +1,46 @@
+package marc
+
+import "strings"
+
+// KeyData is the bibliographic data of a record most often looked at
+type KeyData struct {
+	Title     string
+	ISBNs     []string
+	Publisher string
+	Author    string
+}
+
+// KeyData extracts title, ISBNs, publisher & main author from a record:
+// 200$a, 010$a, 210$c & 700 for Unimarc,
+// 245$a, 020$a, 260$b (or 264$b) & 100$a for MARC21
+func (r Record) KeyData(flavour int) KeyData {
+	var kd KeyData
+
+	switch flavour {
+	case Unimarc:
+		kd.Title = r.FirstSubfield("200", "a")
+		kd.ISBNs = r.SubfieldValues("010", "a")
+		kd.Publisher = r.FirstSubfield("210", "c")
+		if authors := r.Fields("700"); len(authors) > 0 {
+			// $a entry element, $b part of name other than entry element
+			kd.Author = strings.TrimSpace(authors[0].Subfield("a") + ", " + authors[0].Subfield("b"))
+			kd.Author = strings.TrimSuffix(kd.Author, ",")
+		}
+	case Marc21:
+		kd.Title = cleanPunctuation(r.FirstSubfield("245", "a"))
+		kd.ISBNs = r.SubfieldValues("020", "a")
+		kd.Publisher = r.FirstSubfield("260", "b")
+		if kd.Publisher == "" {
+			kd.Publisher = r.FirstSubfield("264", "b")
+		}
+		kd.Publisher = cleanPunctuation(kd.Publisher)
+		kd.Author = cleanPunctuation(r.FirstSubfield("100", "a"))
+	}
+
+	return kd
+}
+
+// cleanPunctuation removes the ISBD punctuation ending MARC21 subfields, e.g. "Title /"
+func cleanPunctuation(s string) string {
+	return strings.TrimSpace(strings.TrimRight(s, " /:;,"))
+}
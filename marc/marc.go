@@ -0,0 +1,176 @@
+// Package marc parses MarcXML records, Unimarc or MARC21, into fields & subfields
+package marc
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	Unimarc = iota // Flavours of MARC: Unimarc, as used by Sudoc
+	Marc21         // Flavours of MARC: MARC21
+)
+
+// ErrNoRecord is returned when a MarcXML document doesn't hold any record
+var ErrNoRecord = errors.New("no marc record found")
+
+// Record is a single MARC record
+type Record struct {
+	Leader        string         `xml:"leader"`
+	ControlFields []ControlField `xml:"controlfield"`
+	DataFields    []DataField    `xml:"datafield"`
+}
+
+// ControlField is a field without indicators nor subfields, e.g. 001
+type ControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+// DataField is a field with indicators & subfields, e.g. 200
+type DataField struct {
+	Tag       string     `xml:"tag,attr"`
+	Ind1      string     `xml:"ind1,attr"`
+	Ind2      string     `xml:"ind2,attr"`
+	Subfields []Subfield `xml:"subfield"`
+}
+
+// Subfield is a subfield of a data field, e.g. $a
+type Subfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Parse parses the first record of a MarcXML document.
+// The record may be wrapped in a collection element, and namespaced or not
+func Parse(s string) (Record, error) {
+	records, err := parse(s, 1)
+	if err != nil {
+		return Record{}, err
+	}
+	return records[0], nil
+}
+
+// ParseCollection parses all the records of a MarcXML document
+func ParseCollection(s string) ([]Record, error) {
+	return parse(s, 0)
+}
+
+// parse decodes at most max records, or all of them if max is 0
+func parse(s string, max int) ([]Record, error) {
+	var records []Record
+
+	d := xml.NewDecoder(strings.NewReader(s))
+	for max == 0 || len(records) < max {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "record" {
+			continue
+		}
+
+		var record Record
+		if err := d.DecodeElement(&record, &start); err != nil {
+			return records, err
+		}
+		record.trim()
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return records, ErrNoRecord
+	}
+	return records, nil
+}
+
+// trim removes the white spaces around values, left by indented documents
+func (r *Record) trim() {
+	r.Leader = strings.Trim(r.Leader, "\r\n\t")
+	for i := range r.ControlFields {
+		r.ControlFields[i].Value = strings.TrimSpace(r.ControlFields[i].Value)
+	}
+	for i := range r.DataFields {
+		for j := range r.DataFields[i].Subfields {
+			r.DataFields[i].Subfields[j].Value = strings.TrimSpace(r.DataFields[i].Subfields[j].Value)
+		}
+	}
+}
+
+// ControlField returns the value of the first control field with this tag, or an empty string
+func (r Record) ControlField(tag string) string {
+	for _, f := range r.ControlFields {
+		if f.Tag == tag {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Fields returns the data fields with this tag, in the order of the record
+func (r Record) Fields(tag string) []DataField {
+	var fields []DataField
+	for _, f := range r.DataFields {
+		if f.Tag == tag {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// SubfieldValues returns the values of a subfield in all the data fields with this tag, e.g. all the 010$a
+func (r Record) SubfieldValues(tag, code string) []string {
+	var values []string
+	for _, f := range r.Fields(tag) {
+		values = append(values, f.SubfieldValues(code)...)
+	}
+	return values
+}
+
+// FirstSubfield returns the first value of a subfield in the data fields with this tag, or an empty string
+func (r Record) FirstSubfield(tag, code string) string {
+	values := r.SubfieldValues(tag, code)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// AddField inserts a data field after the fields with the same or a lower tag
+func (r *Record) AddField(f DataField) {
+	i := len(r.DataFields)
+	for i > 0 && r.DataFields[i-1].Tag > f.Tag {
+		i--
+	}
+	r.DataFields = append(r.DataFields, DataField{})
+	copy(r.DataFields[i+1:], r.DataFields[i:])
+	r.DataFields[i] = f
+}
+
+// Subfield returns the value of the first subfield with this code, or an empty string
+func (f DataField) Subfield(code string) string {
+	for _, sf := range f.Subfields {
+		if sf.Code == code {
+			return sf.Value
+		}
+	}
+	return ""
+}
+
+// SubfieldValues returns the values of all the subfields with this code
+func (f DataField) SubfieldValues(code string) []string {
+	var values []string
+	for _, sf := range f.Subfields {
+		if sf.Code == code {
+			values = append(values, sf.Value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,191 @@
+package marc
+
+import (
+	"reflect"
+	"testing"
+)
+
+// sudocRecord is a Unimarc record as returned by the Sudoc, namespaced & indented
+const sudocRecord = `<?xml version="1.0" encoding="UTF-8"?>
+<record xmlns="http://www.loc.gov/MARC21/slim">
+  <leader>     cas0 22        450 </leader>
+  <controlfield tag="001">038587734</controlfield>
+  <controlfield tag="005">20180516104455.000</controlfield>
+  <datafield tag="010" ind1=" " ind2=" ">
+    <subfield code="a">978-2-07-036822-8</subfield>
+    <subfield code="b">br.</subfield>
+  </datafield>
+  <datafield tag="010" ind1=" " ind2=" ">
+    <subfield code="a">2-07-036822-X</subfield>
+  </datafield>
+  <datafield tag="200" ind1="1" ind2=" ">
+    <subfield code="a">
+      Études rurales
+    </subfield>
+    <subfield code="f">École pratique des hautes études</subfield>
+  </datafield>
+  <datafield tag="210" ind1=" " ind2=" ">
+    <subfield code="a">Paris</subfield>
+    <subfield code="c">Mouton</subfield>
+  </datafield>
+  <datafield tag="700" ind1=" " ind2="1">
+    <subfield code="a">Duby</subfield>
+    <subfield code="b">Georges</subfield>
+  </datafield>
+</record>`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr error
+		want001 string
+		want200 string
+	}{
+		{"namespaced record", sudocRecord, nil, "038587734", "Études rurales"},
+		{"collection, no namespace", `<collection><record><leader>00000nam  2200000   4500</leader>
+			<controlfield tag="001">1</controlfield>
+			<datafield tag="200" ind1="1" ind2=" "><subfield code="a">First</subfield></datafield>
+			</record><record><controlfield tag="001">2</controlfield></record></collection>`, nil, "1", "First"},
+		{"prefixed namespace", `<marc:collection xmlns:marc="http://www.loc.gov/MARC21/slim"><marc:record>
+			<marc:controlfield tag="001">42</marc:controlfield>
+			<marc:datafield tag="200" ind1="1" ind2=" "><marc:subfield code="a">Prefixed</marc:subfield></marc:datafield>
+			</marc:record></marc:collection>`, nil, "42", "Prefixed"},
+		{"no record", `<collection></collection>`, ErrNoRecord, "", ""},
+		{"empty document", ``, ErrNoRecord, "", ""},
+	}
+
+	for _, tt := range tests {
+		r, err := Parse(tt.doc)
+		if err != tt.wantErr {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got := r.ControlField("001"); got != tt.want001 {
+			t.Errorf("%s: 001 = %q, want %q", tt.name, got, tt.want001)
+		}
+		if got := r.FirstSubfield("200", "a"); got != tt.want200 {
+			t.Errorf("%s: 200$a = %q, want %q", tt.name, got, tt.want200)
+		}
+	}
+
+	if _, err := Parse(`<record><datafield tag="200"><subfield code="a">unclosed`); err == nil {
+		t.Errorf("malformed document: no error")
+	}
+}
+
+func TestParseCollection(t *testing.T) {
+	records, err := ParseCollection(`<collection>
+		<record><controlfield tag="001">1</controlfield></record>
+		<record><controlfield tag="001">2</controlfield></record>
+		<record><controlfield tag="001">3</controlfield></record>
+		</collection>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range records {
+		got = append(got, r.ControlField("001"))
+	}
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("001s = %v, want %v", got, want)
+	}
+}
+
+func TestRecordAccessors(t *testing.T) {
+	r, err := Parse(sudocRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.Leader; got != "     cas0 22        450 " {
+		t.Errorf("leader = %q, blanks should be kept", got)
+	}
+	if got, want := r.SubfieldValues("010", "a"), []string{"978-2-07-036822-8", "2-07-036822-X"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("010$a = %v, want %v", got, want)
+	}
+	if got := len(r.Fields("010")); got != 2 {
+		t.Errorf("%d 010 fields, want 2", got)
+	}
+	if got := r.FirstSubfield("606", "a"); got != "" {
+		t.Errorf("missing 606$a = %q, want empty", got)
+	}
+	if got := r.ControlField("003"); got != "" {
+		t.Errorf("missing 003 = %q, want empty", got)
+	}
+
+	r.AddField(DataField{Tag: "101", Ind1: "0", Subfields: []Subfield{{Code: "a", Value: "fre"}}})
+	r.AddField(DataField{Tag: "999", Subfields: []Subfield{{Code: "a", Value: "local"}}})
+	var tags []string
+	for _, f := range r.DataFields {
+		tags = append(tags, f.Tag)
+	}
+	if want := []string{"010", "010", "101", "200", "210", "700", "999"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags after AddField = %v, want %v", tags, want)
+	}
+}
+
+func TestKeyData(t *testing.T) {
+	r, err := Parse(sudocRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := KeyData{
+		Title:     "Études rurales",
+		ISBNs:     []string{"978-2-07-036822-8", "2-07-036822-X"},
+		Publisher: "Mouton",
+		Author:    "Duby, Georges",
+	}
+	if got := r.KeyData(Unimarc); !reflect.DeepEqual(got, want) {
+		t.Errorf("KeyData(Unimarc) = %+v, want %+v", got, want)
+	}
+
+	m21 := Record{DataFields: []DataField{
+		{Tag: "100", Ind1: "1", Subfields: []Subfield{{Code: "a", Value: "Duby, Georges,"}}},
+		{Tag: "245", Ind1: "1", Ind2: "0", Subfields: []Subfield{{Code: "a", Value: "Études rurales /"}}},
+		{Tag: "264", Ind2: "1", Subfields: []Subfield{{Code: "b", Value: "Mouton ;"}}},
+	}}
+	want = KeyData{Title: "Études rurales", Publisher: "Mouton", Author: "Duby, Georges"}
+	if got := m21.KeyData(Marc21); !reflect.DeepEqual(got, want) {
+		t.Errorf("KeyData(Marc21) = %+v, want %+v", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid, err := Parse(sudocRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		edit     func(r *Record)
+		flavour  int
+		wantErrs int
+	}{
+		{"valid record", func(r *Record) {}, Unimarc, 0},
+		{"marc21 mandatory fields", func(r *Record) {}, Marc21, 1},
+		{"short leader", func(r *Record) { r.Leader = "cas" }, Unimarc, 1},
+		{"data field tag as control field", func(r *Record) { r.ControlFields[0].Tag = "200" }, Unimarc, 2},
+		{"invalid indicator", func(r *Record) { r.DataFields[0].Ind1 = "#" }, Unimarc, 1},
+		{"invalid subfield code", func(r *Record) { r.DataFields[0].Subfields[0].Code = "$" }, Unimarc, 1},
+		{"no subfield", func(r *Record) { r.DataFields[0].Subfields = nil }, Unimarc, 1},
+		{"missing title", func(r *Record) { r.DataFields[2].Tag = "201" }, Unimarc, 1},
+	}
+
+	for _, tt := range tests {
+		// copy the fields edited
+		r := valid
+		r.ControlFields = append([]ControlField(nil), valid.ControlFields...)
+		r.DataFields = nil
+		for _, f := range valid.DataFields {
+			f.Subfields = append([]Subfield(nil), f.Subfields...)
+			r.DataFields = append(r.DataFields, f)
+		}
+		tt.edit(&r)
+
+		if errs := r.Validate(tt.flavour); len(errs) != tt.wantErrs {
+			t.Errorf("%s: %d errors %v, want %d", tt.name, len(errs), errs, tt.wantErrs)
+		}
+	}
+}
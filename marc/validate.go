@@ -0,0 +1,60 @@
+package marc
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var (
+	tagRe          = regexp.MustCompile(`^[0-9]{3}$`)
+	indicatorRe    = regexp.MustCompile(`^[0-9a-z ]?$`)
+	subfieldCodeRe = regexp.MustCompile(`^[0-9a-z]$`)
+)
+
+// mandatory fields, for each flavour of MARC
+var mandatoryFields = map[int][]string{
+	Unimarc: {"001", "200"},
+	Marc21:  {"001", "245"},
+}
+
+// Validate checks the structure of a record: leader, tags, indicators and subfield codes,
+// and the presence of the fields mandatory in this flavour of MARC.
+// Returns all the problems found, none if the record is valid
+func (r Record) Validate(flavour int) []error {
+	var errs []error
+
+	if len(r.Leader) != 24 {
+		errs = append(errs, fmt.Errorf("leader should be 24 characters long, is %d", len(r.Leader)))
+	}
+
+	for _, f := range r.ControlFields {
+		if !tagRe.MatchString(f.Tag) || f.Tag >= "010" {
+			errs = append(errs, fmt.Errorf("invalid control field tag %q", f.Tag))
+		}
+	}
+
+	for _, f := range r.DataFields {
+		if !tagRe.MatchString(f.Tag) || f.Tag < "010" {
+			errs = append(errs, fmt.Errorf("invalid data field tag %q", f.Tag))
+		}
+		if !indicatorRe.MatchString(f.Ind1) || !indicatorRe.MatchString(f.Ind2) {
+			errs = append(errs, fmt.Errorf("field %s: invalid indicators %q %q", f.Tag, f.Ind1, f.Ind2))
+		}
+		if len(f.Subfields) == 0 {
+			errs = append(errs, fmt.Errorf("field %s: no subfield", f.Tag))
+		}
+		for _, sf := range f.Subfields {
+			if !subfieldCodeRe.MatchString(sf.Code) {
+				errs = append(errs, fmt.Errorf("field %s: invalid subfield code %q", f.Tag, sf.Code))
+			}
+		}
+	}
+
+	for _, tag := range mandatoryFields[flavour] {
+		if r.ControlField(tag) == "" && len(r.Fields(tag)) == 0 {
+			errs = append(errs, fmt.Errorf("mandatory field %s is missing", tag))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,191 @@
+package marc
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Export formats
+const (
+	FormatISO2709 = "iso2709" // binary MARC
+	FormatMarcXML = "marcxml" // MarcXML collection
+	FormatJSON    = "json"    // MARC-in-JSON, as an array of records
+)
+
+// ErrUnknownFormat is returned when asked for an export format we don't know
+var ErrUnknownFormat = errors.New("unknown marc export format")
+
+// Writer writes a batch of records in a given format. Close must be called
+// once all the records are written, to end the document
+type Writer interface {
+	Write(Record) error
+	Close() error
+}
+
+// NewWriter returns a Writer for one of the export formats
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case FormatISO2709:
+		return &iso2709Writer{w: w}, nil
+	case FormatMarcXML:
+		return &xmlWriter{w: w}, nil
+	case FormatJSON:
+		return &jsonWriter{w: w}, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// FormatExtension returns the file extension for an export format
+func FormatExtension(format string) string {
+	switch format {
+	case FormatISO2709:
+		return ".mrc"
+	case FormatJSON:
+		return ".json"
+	}
+	return ".xml"
+}
+
+// iso2709Writer writes records one after the other, as the format requires nothing else
+type iso2709Writer struct {
+	w io.Writer
+}
+
+func (iw *iso2709Writer) Write(r Record) error {
+	b, err := r.MarshalISO2709()
+	if err != nil {
+		return err
+	}
+	_, err = iw.w.Write(b)
+	return err
+}
+
+func (iw *iso2709Writer) Close() error {
+	return nil
+}
+
+// xmlWriter wraps the records in a MarcXML collection
+type xmlWriter struct {
+	w       io.Writer
+	enc     *xml.Encoder
+	started bool
+}
+
+var collectionStart = xml.StartElement{
+	Name: xml.Name{Local: "collection"},
+	Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: "http://www.loc.gov/MARC21/slim"}},
+}
+
+func (xw *xmlWriter) start() error {
+	xw.started = true
+	if _, err := io.WriteString(xw.w, xml.Header); err != nil {
+		return err
+	}
+	xw.enc = xml.NewEncoder(xw.w)
+	xw.enc.Indent("", "  ")
+	return xw.enc.EncodeToken(collectionStart)
+}
+
+func (xw *xmlWriter) Write(r Record) error {
+	if !xw.started {
+		if err := xw.start(); err != nil {
+			return err
+		}
+	}
+	return xw.enc.EncodeElement(r, xml.StartElement{Name: xml.Name{Local: "record"}})
+}
+
+func (xw *xmlWriter) Close() error {
+	if !xw.started { // an empty collection is still a collection
+		if err := xw.start(); err != nil {
+			return err
+		}
+	}
+	if err := xw.enc.EncodeToken(collectionStart.End()); err != nil {
+		return err
+	}
+	if err := xw.enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(xw.w, "\n")
+	return err
+}
+
+// jsonWriter writes the records as a json array, one record per line
+type jsonWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (jw *jsonWriter) Write(r Record) error {
+	b, err := r.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if jw.count == 0 {
+		sep = "[\n"
+	}
+	jw.count++
+	if _, err := io.WriteString(jw.w, sep); err != nil {
+		return err
+	}
+	_, err = jw.w.Write(b)
+	return err
+}
+
+func (jw *jsonWriter) Close() error {
+	end := "\n]\n"
+	if jw.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(jw.w, end)
+	return err
+}
+
+// MarshalMarcXML encodes a single record as a MarcXML record element, e.g. to be stored
+func (r Record) MarshalMarcXML() (string, error) {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "record"},
+		Attr: collectionStart.Attr,
+	}
+	var sb strings.Builder
+	enc := xml.NewEncoder(&sb)
+	if err := enc.EncodeElement(r, start); err != nil {
+		return "", err
+	}
+	if err := enc.Flush(); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// MarshalJSON encodes a record as MARC-in-JSON, see http://dilettantes.code4lib.org/blog/2010/09/a-proposal-to-serialize-marc-in-json/
+func (r Record) MarshalJSON() ([]byte, error) {
+	type jsonDataField struct {
+		Subfields []map[string]string `json:"subfields"`
+		Ind1      string              `json:"ind1"`
+		Ind2      string              `json:"ind2"`
+	}
+	type jsonRecord struct {
+		Leader string                   `json:"leader"`
+		Fields []map[string]interface{} `json:"fields"`
+	}
+
+	jr := jsonRecord{Leader: r.Leader, Fields: []map[string]interface{}{}}
+	for _, f := range r.ControlFields {
+		jr.Fields = append(jr.Fields, map[string]interface{}{f.Tag: f.Value})
+	}
+	for _, f := range r.DataFields {
+		df := jsonDataField{Ind1: indicator(f.Ind1), Ind2: indicator(f.Ind2), Subfields: []map[string]string{}}
+		for _, sf := range f.Subfields {
+			df.Subfields = append(df.Subfields, map[string]string{sf.Code: sf.Value})
+		}
+		jr.Fields = append(jr.Fields, map[string]interface{}{f.Tag: df})
+	}
+
+	return json.Marshal(jr)
+}
@@ -1,11 +1,53 @@
 package middleware
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"strings"
 
+	"github.com/nicomo/abacaxi/models"
 	"github.com/nicomo/abacaxi/session"
 )
 
+type key int
+
+const apiUserKey key = 1
+
+// APIUser retrieves the user authenticated by APIAuth from a http Request Context
+func APIUser(ctx context.Context) (models.User, bool) {
+	user, ok := ctx.Value(apiUserKey).(models.User)
+	return user, ok
+}
+
+// APIAuth only lets through requests with a valid API token
+// in an "Authorization: Bearer <token>" header
+func APIAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			apiUnauthorized(w, "missing API token")
+			return
+		}
+
+		user, err := models.UserByAPIToken(session.TokenHash(token))
+		if err != nil {
+			apiUnauthorized(w, "invalid API token")
+			return
+		}
+
+		// move on with the user in the request context
+		ctx := context.WithValue(r.Context(), apiUserKey, user)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func apiUnauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
 // DisallowAnon does not allow anonymous users to access the page
 func DisallowAnon(h http.Handler) http.Handler {
 
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"errors"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+)
+
+// Bulk actions on a selection of records
+const (
+	BulkSetAcquired   = "setacquired"
+	BulkClearAcquired = "clearacquired"
+	BulkSetActive     = "setactive"
+	BulkClearActive   = "clearactive"
+	BulkAttachTS      = "attachts"
+	BulkDetachTS      = "detachts"
+	BulkDelete        = "delete"
+)
+
+// ErrBulkAction is returned for an unknown bulk action
+var ErrBulkAction = errors.New("unknown bulk action")
+
+// BulkResult counts the records a bulk action changed, those already as asked, and those which couldn't be changed
+type BulkResult struct {
+	Changed   int
+	Unchanged int
+	Failed    []string // the IDs of the records which couldn't be changed, with the reason
+}
+
+// BulkActionLabel returns a human readable label for a bulk action, e.g. for a report
+func BulkActionLabel(action, tsname string) string {
+	switch action {
+	case BulkSetAcquired:
+		return "set Acquired"
+	case BulkClearAcquired:
+		return "clear Acquired"
+	case BulkSetActive:
+		return "set Active"
+	case BulkClearActive:
+		return "clear Active"
+	case BulkAttachTS:
+		return "attach to " + tsname
+	case BulkDetachTS:
+		return "detach from " + tsname
+	case BulkDelete:
+		return "move to the trash"
+	}
+	return action
+}
+
+// RecordsBulkUpdate applies a bulk action to a selection of records, tsname being the target service
+// to attach or detach. Each record changed gets a revision, so that the whole action can be undone from the report of src.
+// Records in the trash are left as they are
+func RecordsBulkUpdate(IDs []bson.ObjectId, action, tsname string, src ChangeSource) (BulkResult, error) {
+	var result BulkResult
+
+	// the target service attached, as stored in DB
+	var ts TargetService
+	switch action {
+	case BulkSetAcquired, BulkClearAcquired, BulkSetActive, BulkClearActive, BulkDelete:
+	case BulkAttachTS, BulkDetachTS:
+		var err error
+		if ts, err = GetTargetService(tsname); err != nil {
+			return result, err
+		}
+	default:
+		return result, ErrBulkAction
+	}
+
+	for _, ID := range IDs {
+		record, err := RecordGetByID(ID.Hex())
+		if err != nil {
+			result.Failed = append(result.Failed, ID.Hex()+": "+err.Error())
+			continue
+		}
+		if record.Deleted {
+			result.Unchanged++
+			continue
+		}
+
+		if action == BulkDelete {
+			if err := RecordDelete(ID.Hex(), src); err != nil {
+				logger.Error.Printf("couldn't delete record %s: %v", ID.Hex(), err)
+				result.Failed = append(result.Failed, ID.Hex()+": "+err.Error())
+				continue
+			}
+			result.Changed++
+			continue
+		}
+
+		if !record.bulkApply(action, ts) {
+			result.Unchanged++
+			continue
+		}
+		if err := record.RecordUpdate(src); err != nil {
+			logger.Error.Printf("couldn't update record %s: %v", ID.Hex(), err)
+			result.Failed = append(result.Failed, ID.Hex()+": "+err.Error())
+			continue
+		}
+		result.Changed++
+	}
+
+	return result, nil
+}
+
+// bulkApply applies a bulk action to a record, and tells whether it changed anything.
+// A record attached to an active target service is active, as with uploads;
+// a record detached from its last target service is de-activated
+func (r *Record) bulkApply(action string, ts TargetService) bool {
+	acquired, active, count := r.Acquired, r.Active, len(r.TargetServices)
+
+	switch action {
+	case BulkSetAcquired:
+		r.Acquired = true
+	case BulkClearAcquired:
+		r.Acquired = false
+	case BulkSetActive:
+		r.Active = true
+	case BulkClearActive:
+		r.Active = false
+	case BulkAttachTS:
+		for _, rts := range r.TargetServices {
+			if rts.Name == ts.Name {
+				return false
+			}
+		}
+		r.TargetServices = append(r.TargetServices, ts)
+		if ts.Active {
+			r.Active = true
+		}
+		return true
+	case BulkDetachTS:
+		r.detachTS(ts.Name)
+		return len(r.TargetServices) != count
+	}
+
+	return r.Acquired != acquired || r.Active != active
+}
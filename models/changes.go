@@ -0,0 +1,211 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/marc"
+)
+
+// Changes made to the records of a target service since a given date, exported in separate files
+const (
+	ChangesNew      = "new"      // records created, or attached to the target service, since then
+	ChangesModified = "modified" // records in the target service before then, and updated since
+	ChangesDeleted  = "deleted"  // records deleted, or removed from the target service, since then
+)
+
+// ChangesKinds lists the kinds of changes, in the order they are exported
+var ChangesKinds = []string{ChangesNew, ChangesModified, ChangesDeleted}
+
+// ErrUnknownChanges is returned when asked for a kind of changes we don't know
+var ErrUnknownChanges = errors.New("unknown kind of changes")
+
+// recordAt returns a record as it was at a date: as it was before its first revision since then, or as it is if it wasn't changed.
+// It returns false if the record didn't exist then
+func recordAt(recordID bson.ObjectId, t time.Time) (Record, bool, error) {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRevisionsColl()
+
+	var rev Revision
+	err := coll.Find(bson.M{"recordid": recordID, "datecreated": bson.M{"$gte": t}}).Sort("datecreated").One(&rev)
+	if err == mgo.ErrNotFound {
+		record, err := RecordGetByID(recordID.Hex())
+		if err == mgo.ErrNotFound {
+			return record, false, nil
+		}
+		return record, err == nil, err
+	}
+	if err != nil || rev.Before == nil {
+		return Record{}, false, err
+	}
+	return *rev.Before, true, nil
+}
+
+// inTargetService tells whether a record is in a target service, out of the trash
+func (r Record) inTargetService(tsname string) bool {
+	return !r.Deleted && RecordsFilter{TSName: tsname}.matches(r)
+}
+
+// attachedSince returns the IDs of the records which already existed at a date, out of a target service or in the trash,
+// and were attached to the target service or restored since: for the target service, they are new records.
+// They are found in the revisions
+func attachedSince(tsname string, since time.Time) ([]bson.ObjectId, error) {
+	var IDs []bson.ObjectId
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRevisionsColl()
+
+	// records out of the target service at some point since the date
+	qry := bson.M{
+		"datecreated": bson.M{"$gte": since},
+		"before":      bson.M{"$exists": true},
+		"$or": []bson.M{
+			{"before.targetservices.name": bson.M{"$ne": tsname}},
+			{"before.deleted": true},
+		},
+	}
+	var candidates []bson.ObjectId
+	if err := coll.Find(qry).Distinct("recordid", &candidates); err != nil {
+		return IDs, err
+	}
+
+	// they were out of the target service at the date
+	for _, ID := range candidates {
+		record, existed, err := recordAt(ID, since)
+		if err != nil {
+			return IDs, err
+		}
+		if existed && !record.inTargetService(tsname) {
+			IDs = append(IDs, ID)
+		}
+	}
+
+	return IDs, nil
+}
+
+// removedSource is the source of the records which were in the target service of a filter at some point since a date,
+// and no longer are, because they were deleted or removed from the target service.
+// They are found in the revisions, and come as they were last seen in the target service.
+// Records which weren't in the target service at the date, e.g. created since, never made it to an export, and are left out
+func removedSource(f RecordsFilter, since time.Time) recordSource {
+	return func(fn func(Record) error) (int, error) {
+		var count int
+
+		mgoSession := mgoSession.Copy()
+		defer mgoSession.Close()
+		coll := getRevisionsColl()
+
+		// revisions of records deleted, or whose target services changed, while in the target service
+		qry := bson.M{
+			"datecreated":                bson.M{"$gte": since},
+			"before.targetservices.name": f.TSName,
+			"before.datecreated":         bson.M{"$lt": since},
+			"$or": []bson.M{
+				{"revisiontype": RevisionDeleted},
+				{"changes.field": "TargetServices"},
+			},
+		}
+		iter := coll.Find(qry).Sort("-datecreated").Iter()
+
+		// the most recent revision of each record holds the record as it was last seen in the target service
+		seen := make(map[bson.ObjectId]bool)
+		var rev Revision
+		for iter.Next(&rev) {
+			before, recordID := *rev.Before, rev.RecordID
+			rev = Revision{} // Next doesn't reset the fields missing from the next document
+
+			if seen[recordID] {
+				continue
+			}
+			seen[recordID] = true
+
+			// the record may be back in the target service, or out of the trash
+			if current, err := RecordGetByID(recordID.Hex()); err == nil && current.inTargetService(f.TSName) {
+				continue
+			}
+
+			if !f.matches(before) {
+				continue
+			}
+			if then, existed, err := recordAt(recordID, since); err != nil || !existed || !then.inTargetService(f.TSName) {
+				if err != nil {
+					iter.Close()
+					return count, err
+				}
+				continue
+			}
+			count++
+			if err := fn(before); err != nil {
+				iter.Close()
+				return count, err
+			}
+		}
+
+		return count, iter.Close()
+	}
+}
+
+// deletedMarc returns the function getting the marc record of a deleted record:
+// the marc record as it was, with the record status set to deleted (leader/05 = 'd')
+func deletedMarc(getMarc func(Record) (marc.Record, error)) func(Record) (marc.Record, error) {
+	return func(r Record) (marc.Record, error) {
+		m, err := getMarc(r)
+		if err != nil {
+			return m, err
+		}
+		leader := []byte(fmt.Sprintf("%-24.24s", m.Leader))
+		leader[5] = 'd'
+		m.Leader = string(leader)
+		return m, nil
+	}
+}
+
+// WriteChanges writes one kind of changes made since a date to the records matching a filter,
+// as a KBART file or marc records in one of the marc export formats.
+// It returns the number of records written
+func WriteChanges(out io.Writer, exportType, format string, f RecordsFilter, since time.Time, changes string) (int, error) {
+	var source recordSource
+	switch changes {
+	case ChangesNew, ChangesModified:
+		// records attached to the target service since the date are new to it, whenever they were created
+		attached, err := attachedSince(f.TSName, since)
+		if err != nil {
+			return 0, err
+		}
+		f.AttachedIDs = attached
+		if changes == ChangesNew {
+			f.NewSince = since
+		} else {
+			f.ModSince = since
+		}
+		source = filterSource(f)
+	case ChangesDeleted:
+		source = removedSource(f, since)
+	default:
+		return 0, ErrUnknownChanges
+	}
+
+	switch exportType {
+	case ExportKbart:
+		return writeKbart(out, source, f.TSName)
+	case ExportUnimarc:
+		// deleted records don't need the local fields, the ILS only has to find them
+		if changes == ChangesDeleted {
+			return writeMarc(out, source, format, deletedMarc(Record.Unimarc))
+		}
+		return writeMarc(out, source, format, unimarcEnricher(f.TSName))
+	case ExportMarc21:
+		if changes == ChangesDeleted {
+			return writeMarc(out, source, format, deletedMarc(Record.Marc21))
+		}
+		return writeMarc(out, source, format, Record.Marc21)
+	}
+	return 0, errors.New("unknown export type " + exportType)
+}
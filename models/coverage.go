@@ -0,0 +1,128 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+)
+
+// PackageCoverage is the coverage of a title in a package: the same journal may have different coverages,
+// URLs & embargoes in 2 packages. It's kept on the target service entries of a record
+type PackageCoverage struct {
+	DateFirstIssueOnline string `bson:",omitempty"`
+	NumFirstVolOnline    string `bson:",omitempty"`
+	NumFirstIssueOnline  string `bson:",omitempty"`
+	DateLastIssueOnline  string `bson:",omitempty"`
+	NumLastVolOnline     string `bson:",omitempty"`
+	NumLastIssueOnline   string `bson:",omitempty"`
+	TitleURL             string `bson:",omitempty"`
+	TitleID              string `bson:",omitempty"`
+	EmbargoInfo          string `bson:",omitempty"`
+	CoverageDepth        string `bson:",omitempty"`
+}
+
+// PackageCoverage returns the coverage fields of a record, e.g. of a line of a KBART file, or nil if they're all empty
+func (r Record) PackageCoverage() *PackageCoverage {
+	c := PackageCoverage{
+		DateFirstIssueOnline: r.DateFirstIssueOnline,
+		NumFirstVolOnline:    r.NumFirstVolOnline,
+		NumFirstIssueOnline:  r.NumFirstIssueOnline,
+		DateLastIssueOnline:  r.DateLastIssueOnline,
+		NumLastVolOnline:     r.NumLastVolOnline,
+		NumLastIssueOnline:   r.NumLastIssueOnline,
+		TitleURL:             r.TitleURL,
+		TitleID:              r.TitleID,
+		EmbargoInfo:          r.EmbargoInfo,
+		CoverageDepth:        r.CoverageDepth,
+	}
+	if c == (PackageCoverage{}) {
+		return nil
+	}
+	return &c
+}
+
+// ForTargetService returns the record as it is in a target service: its coverage fields are those of the package,
+// if the record has a coverage for it. Otherwise, or if tsname is empty, the record is returned as is
+func (r Record) ForTargetService(tsname string) Record {
+	if tsname == "" {
+		return r
+	}
+	for _, ts := range r.TargetServices {
+		if ts.Name != tsname || ts.Coverage == nil {
+			continue
+		}
+		c := ts.Coverage
+		r.DateFirstIssueOnline = c.DateFirstIssueOnline
+		r.NumFirstVolOnline = c.NumFirstVolOnline
+		r.NumFirstIssueOnline = c.NumFirstIssueOnline
+		r.DateLastIssueOnline = c.DateLastIssueOnline
+		r.NumLastVolOnline = c.NumLastVolOnline
+		r.NumLastIssueOnline = c.NumLastIssueOnline
+		r.TitleURL = c.TitleURL
+		r.TitleID = c.TitleID
+		r.EmbargoInfo = c.EmbargoInfo
+		r.CoverageDepth = c.CoverageDepth
+		break
+	}
+	return r
+}
+
+// EditCoverage applies the changes made by hand to the coverage fields of a record
+// to the packages which had the values before: fixing a URL fixes it in the packages too
+func (r *Record) EditCoverage(before Record) {
+	vr, vb := reflect.ValueOf(r).Elem(), reflect.ValueOf(before)
+	t := reflect.TypeOf(PackageCoverage{})
+	// the version before may share the target services
+	r.TargetServices = append([]TargetService(nil), r.TargetServices...)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i).Name
+		old, edited := vb.FieldByName(field).String(), vr.FieldByName(field).String()
+		if old == edited {
+			continue
+		}
+		for j, ts := range r.TargetServices {
+			if ts.Coverage == nil {
+				continue
+			}
+			c := *ts.Coverage
+			vc := reflect.ValueOf(&c).Elem().FieldByName(field)
+			if vc.String() != old {
+				continue
+			}
+			vc.SetString(edited)
+			r.TargetServices[j].Coverage = &c
+		}
+	}
+}
+
+// String sums up a coverage, e.g. "2001 v.1 n.1 - 2010 v.10, fulltext, embargo P1Y"
+func (c PackageCoverage) String() string {
+	edge := func(date, vol, issue string) string {
+		var s []string
+		if date != "" {
+			s = append(s, date)
+		}
+		if vol != "" {
+			s = append(s, "v."+vol)
+		}
+		if issue != "" {
+			s = append(s, "n."+issue)
+		}
+		return strings.Join(s, " ")
+	}
+
+	first := edge(c.DateFirstIssueOnline, c.NumFirstVolOnline, c.NumFirstIssueOnline)
+	last := edge(c.DateLastIssueOnline, c.NumLastVolOnline, c.NumLastIssueOnline)
+
+	var s string
+	if first != "" || last != "" {
+		s = strings.TrimSpace(first + " - " + last)
+	}
+	if c.CoverageDepth != "" {
+		s += ", " + c.CoverageDepth
+	}
+	if c.EmbargoInfo != "" {
+		s += ", embargo " + c.EmbargoInfo
+	}
+	return strings.TrimPrefix(s, ", ")
+}
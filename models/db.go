@@ -24,3 +24,43 @@ func getReportsColl() *mgo.Collection {
 	reportsColl := mgoSession.DB(conf.AuthDatabase).C("reports")
 	return reportsColl
 }
+
+func getJobsColl() *mgo.Collection {
+	jobsColl := mgoSession.DB(conf.AuthDatabase).C("jobs")
+	return jobsColl
+}
+
+func getRevisionsColl() *mgo.Collection {
+	revisionsColl := mgoSession.DB(conf.AuthDatabase).C("revisions")
+	return revisionsColl
+}
+
+func getEnrichmentColl() *mgo.Collection {
+	enrichmentColl := mgoSession.DB(conf.AuthDatabase).C("enrichmentrules")
+	return enrichmentColl
+}
+
+func getExportSchedulesColl() *mgo.Collection {
+	exportSchedulesColl := mgoSession.DB(conf.AuthDatabase).C("exportschedules")
+	return exportSchedulesColl
+}
+
+func getSnapshotsColl() *mgo.Collection {
+	snapshotsColl := mgoSession.DB(conf.AuthDatabase).C("snapshots")
+	return snapshotsColl
+}
+
+func getSnapshotHoldingsColl() *mgo.Collection {
+	snapshotHoldingsColl := mgoSession.DB(conf.AuthDatabase).C("snapshotholdings")
+	return snapshotHoldingsColl
+}
+
+func getDuplicatesColl() *mgo.Collection {
+	duplicatesColl := mgoSession.DB(conf.AuthDatabase).C("duplicates")
+	return duplicatesColl
+}
+
+func getMergePolicyColl() *mgo.Collection {
+	mergePolicyColl := mgoSession.DB(conf.AuthDatabase).C("mergepolicy")
+	return mergePolicyColl
+}
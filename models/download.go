@@ -2,115 +2,164 @@ package models
 
 import (
 	"bufio"
-	"encoding/csv"
-	"os"
-	"path/filepath"
+	"io"
+	"strings"
+	"time"
 
 	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/marc"
 )
 
-func createFile(fname string) (*os.File, error) {
-	// create dirs if they don't exist
-	path := filepath.Join("static", "downloads")
-	ErrPath := os.MkdirAll(path, os.ModePerm)
-	if ErrPath != nil {
-		logger.Error.Println(path)
-	}
+// kbartHeader lists the KBART Phase II columns, in order
+var kbartHeader = []string{
+	"publication_title",
+	"print_identifier",
+	"online_identifier",
+	"date_first_issue_online",
+	"num_first_vol_online",
+	"num_first_issue_online",
+	"date_last_issue_online",
+	"num_last_vol_online",
+	"num_last_issue_online",
+	"title_url",
+	"first_author",
+	"title_id",
+	"embargo_info",
+	"coverage_depth",
+	"notes",
+	"publisher_name",
+	"publication_type",
+	"date_monograph_published_print",
+	"date_monograph_published_online",
+	"monograph_volume",
+	"monograph_edition",
+	"first_editor",
+	"parent_publication_title_id",
+	"preceding_publication_title_id",
+	"access_type",
+}
 
-	// create file
-	f, err := os.Create(filepath.Join(path, fname))
-	if err != nil {
-		logger.Error.Println(err)
-		return nil, err
+// kbartCleaner removes the characters which would break the tab delimited format
+var kbartCleaner = strings.NewReplacer("\t", " ", "\r\n", " ", "\n", " ", "\r", " ")
+
+// writeKbartLine writes a tab delimited line. KBART values are never quoted
+func writeKbartLine(w *bufio.Writer, values []string) error {
+	for i, v := range values {
+		values[i] = strings.TrimSpace(kbartCleaner.Replace(v))
 	}
-	return f, nil
+	_, err := w.WriteString(strings.Join(values, "\t") + "\n")
+	return err
 }
 
-// CreateKbartFile creates csv file with KBART fields from records
-func CreateKbartFile(records []Record, fname string) (int64, error) {
+// WriteKbart writes the records matching a filter as a KBART Phase II file: UTF-8, tab delimited, 25 columns.
+// The records of a target service are written with their coverage, URL, embargo & title_id in this package.
+// It returns the number of records written
+func WriteKbart(out io.Writer, f RecordsFilter) (int, error) {
+	return writeKbart(out, filterSource(f), f.TSName)
+}
 
-	f, err := createFile(fname)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-
-	// create a new writer and change default separator
-	w := csv.NewWriter(f)
-	w.Comma = ';'
-
-	// write header to csv file
-	kbartHeader := []string{
-		"publication_title",
-		"print_identifier",
-		"online_identifier",
-		"date_first_issue_online",
-		"num_first_vol_online",
-		"num_first_issue_online",
-		"date_last_issue_online",
-		"num_last_vol_online",
-		"num_last_issue_online",
-		"title_url",
-		"first_author",
-		"title_id",
-		"embargo_info",
-		"coverage_depth",
-		"coverage_notes",
-		"publisher_name",
+// recordSource calls fn for each record to export, and returns the number of records, see RecordsIter
+type recordSource func(fn func(Record) error) (int, error)
+
+// filterSource is the source of the records matching a filter, read from the DB one at a time
+func filterSource(f RecordsFilter) recordSource {
+	return func(fn func(Record) error) (int, error) {
+		return RecordsIter(f, fn)
 	}
+}
+
+// writeKbart writes the records of a source as a KBART file, with the package values of tsname, if any
+func writeKbart(out io.Writer, source recordSource, tsname string) (int, error) {
+	w := bufio.NewWriter(out)
 
 	// write the header
-	if err := w.Write(kbartHeader); err != nil {
+	if err := writeKbartLine(w, append([]string(nil), kbartHeader...)); err != nil {
 		return 0, err
 	}
 
-	// write each record in turn 
-	for _, record := range records {
-		if err := w.Write(recordToKbart(record)); err != nil {
-			logger.Error.Printf("couldn't write to csv file: %v", err)
-			continue
-		}
+	// write each record in turn, as they come from the DB
+	count, err := source(func(record Record) error {
+		return writeKbartLine(w, recordToKbart(record.ForTargetService(tsname)))
+	})
+	if err != nil {
+		return count, err
 	}
-	
-	w.Flush()
-	return getFileSize(f), nil
-}
 
-// CreateUnimarcFile creates the file to be exported
-func CreateUnimarcFile(records []Record, fname string) (int64, error) {
+	return count, w.Flush()
+}
 
-	f, err := createFile(fname)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
+// KbartFilename names a KBART file as recommended:
+// ProviderName_Region/ConsortiumName_PackageName_YYYY-MM-DD.txt
+// The provider defaults to the target service name, the region to Global and the package to AllTitles
+func KbartFilename(ts TargetService, date time.Time) string {
+	provider := kbartFilenamePart(ts.Provider, ts.Name)
+	region := kbartFilenamePart(ts.Region, "Global")
+	pkg := kbartFilenamePart(ts.PackageName, "AllTitles")
+	return provider + "_" + region + "_" + pkg + "_" + date.Format("2006-01-02") + ".txt"
+}
 
-	// get a buffered writer and write to file
-	w := bufio.NewWriter(f)
-	_, ErrWriteHeader := w.WriteString("<?xml version=\"1.0\"?>\n")
-	if ErrWriteHeader != nil {
-		return 0, ErrWriteHeader
+// kbartFilenamePart removes spaces & underscores from a part of a KBART file name, e.g. "Cairn Info" -> "CairnInfo"
+func kbartFilenamePart(s, defaultValue string) string {
+	var parts []string
+	for _, p := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '_' || r == '/' || r == '\\'
+	}) {
+		runes := []rune(p)
+		parts = append(parts, strings.ToUpper(string(runes[0]))+string(runes[1:]))
 	}
-
-	// write each marc record in turn
-	for _, record := range records {
-		_, ErrWriteRecord := w.WriteString(record.RecordUnimarc)
-		if ErrWriteRecord != nil {
-			return 0, ErrWriteRecord
-		}
+	if len(parts) == 0 {
+		return defaultValue
 	}
+	return strings.Join(parts, "")
+}
 
-	w.Flush() // flush the buffer
+// WriteUnimarc writes the Unimarc records of the records matching a filter, in one of the marc export formats:
+// binary ISO 2709, MarcXML collection or MARC-in-JSON.
+// The records are enriched with the rules of the target service tsname,
+// or with the rules of each of their target services if tsname is empty
+func WriteUnimarc(out io.Writer, f RecordsFilter, format string, tsname string) (int, error) {
+	return writeMarc(out, filterSource(f), format, unimarcEnricher(tsname))
+}
 
-	return getFileSize(f), nil
+// WriteMarc21 writes the MARC21 records of the records matching a filter, in one of the marc export formats
+func WriteMarc21(out io.Writer, f RecordsFilter, format string) (int, error) {
+	return writeMarc(out, filterSource(f), format, Record.Marc21)
 }
 
-func getFileSize(f *os.File) int64 {
-	// get & return the size of the written file
-	fi, err := f.Stat()
+// writeMarc writes the marc records given by getMarc for each record of a source.
+// Records whose marc can't be read are skipped; it returns the number of marc records written
+func writeMarc(out io.Writer, source recordSource, format string, getMarc func(Record) (marc.Record, error)) (int, error) {
+	var written int
+
+	w := bufio.NewWriter(out)
+	mw, err := marc.NewWriter(w, format)
 	if err != nil {
-		logger.Error.Printf("couldn't get file info: %v", err)
-		return 0
+		return 0, err
+	}
+
+	// write each marc record in turn, as they come from the DB
+	_, err = source(func(record Record) error {
+		marcRecord, err := getMarc(record)
+		if err != nil {
+			logger.Error.Printf("couldn't parse marc for record %v: %v", record.ID, err)
+			return nil
+		}
+		if err := mw.Write(marcRecord); err != nil {
+			if err == marc.ErrRecordTooLong {
+				logger.Error.Printf("couldn't write marc for record %v: %v", record.ID, err)
+				return nil
+			}
+			return err // the output failed, e.g. the client went away
+		}
+		written++
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+
+	if err := mw.Close(); err != nil {
+		return written, err
 	}
-	return fi.Size()
+	return written, w.Flush()
 }
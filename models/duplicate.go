@@ -0,0 +1,477 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+)
+
+const (
+	DuplicatePending   = iota // Status of a duplicate candidate: waiting for a review
+	DuplicateMerged           // Status of a duplicate candidate: the records were merged
+	DuplicateDismissed        // Status of a duplicate candidate: the records aren't the same title
+)
+
+// duplicateThreshold is the min. similarity of 2 records, in percent, for them to be a duplicate candidate
+const duplicateThreshold = 80
+
+// duplicateTitleThreshold is the min. similarity of the titles of 2 records, in percent,
+// for the rest of the records to be compared
+const duplicateTitleThreshold = 70
+
+// DuplicateCandidate is a pair of records which may be the same title, though they share no identifier.
+// RecordA is the lower ID of the pair, so that a pair is only found once
+type DuplicateCandidate struct {
+	ID           bson.ObjectId `bson:"_id"`
+	RecordA      bson.ObjectId
+	RecordB      bson.ObjectId
+	Score        int      // similarity of the records, in percent
+	Reasons      []string // what the records have in common
+	Status       int
+	DateCreated  time.Time
+	DateReviewed time.Time `bson:",omitempty"`
+	ReviewedBy   string    `bson:",omitempty"`
+}
+
+// DuplicatePair is a duplicate candidate along with its records, for a review
+type DuplicatePair struct {
+	DuplicateCandidate
+	A, B Record
+}
+
+var (
+	// ErrDuplicateReviewed is returned when merging or dismissing a candidate already reviewed
+	ErrDuplicateReviewed = errors.New("the duplicate candidate was already reviewed")
+	// ErrDuplicateKeep is returned when the record to keep isn't one of the pair
+	ErrDuplicateKeep = errors.New("the record to keep isn't one of the duplicate candidate")
+)
+
+// duplicateStopWords are left out of titles: they tell nothing about a title
+var duplicateStopWords = map[string]bool{
+	"a": true, "an": true, "the": true, "of": true, "and": true, "in": true, "on": true, "for": true, "to": true,
+	"le": true, "la": true, "les": true, "l": true, "un": true, "une": true, "de": true, "des": true, "du": true,
+	"d": true, "et": true, "en": true, "au": true, "aux": true,
+}
+
+// duplicateFolder folds the accented letters of latin languages, so that "Economie" matches "Économie"
+var duplicateFolder = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"ç", "c",
+	"è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i",
+	"ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "ö", "o", "õ", "o", "ø", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u",
+	"ý", "y", "ÿ", "y",
+	"œ", "oe", "æ", "ae", "ß", "ss",
+)
+
+// yearRegexp finds a year in a date, e.g. 2012 in 2012-05-01
+var yearRegexp = regexp.MustCompile(`\b(1[5-9]|20)[0-9]{2}\b`)
+
+// duplicateTokens returns the normalized words of a string: lower case, without accents nor punctuation.
+// Stop words are left out if need be
+func duplicateTokens(s string, skipStopWords bool) []string {
+	s = duplicateFolder.Replace(strings.ToLower(s))
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var tokens []string
+	for _, w := range words {
+		if skipStopWords && duplicateStopWords[w] {
+			continue
+		}
+		tokens = append(tokens, w)
+	}
+	return tokens
+}
+
+// dice is the similarity of 2 sets of words, in percent: twice the words in common over the words of both
+func dice(a, b []string) int {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	inA := make(map[string]bool)
+	for _, w := range a {
+		inA[w] = true
+	}
+	inB := make(map[string]bool)
+	for _, w := range b {
+		inB[w] = true
+	}
+
+	var common int
+	for w := range inA {
+		if inB[w] {
+			common++
+		}
+	}
+	return 200 * common / (len(inA) + len(inB))
+}
+
+// duplicateEntry is what the finder knows of a record
+type duplicateEntry struct {
+	id        bson.ObjectId
+	title     []string // the words of the title
+	main      []string // the words of the title, minus its subtitle
+	author    []string
+	publisher []string
+	year      string
+	volume    string
+	edition   string
+	dois      []string
+}
+
+// newDuplicateEntry returns the entry of a record for the finder
+func newDuplicateEntry(r Record) duplicateEntry {
+	e := duplicateEntry{
+		id:        r.ID,
+		title:     duplicateTokens(r.PublicationTitle, true),
+		author:    duplicateTokens(r.FirstAuthor, false),
+		publisher: duplicateTokens(r.PublisherName, true),
+		volume:    strings.TrimSpace(r.MonographVolume),
+		edition:   strings.Join(duplicateTokens(r.MonographEdition, true), " "),
+	}
+
+	main := r.PublicationTitle
+	if i := strings.IndexAny(main, ":;"); i > 0 {
+		main = main[:i]
+	}
+	e.main = duplicateTokens(main, true)
+
+	for _, date := range []string{r.DateMonographPublishedPrint, r.DateMonographPublishedOnline, r.DateFirstIssueOnline} {
+		if year := yearRegexp.FindString(date); year != "" {
+			e.year = year
+			break
+		}
+	}
+
+	for _, id := range r.Identifiers {
+		if id.IDType == IDTypeDOI {
+			e.dois = append(e.dois, id.Identifier)
+		}
+	}
+
+	return e
+}
+
+// duplicateScore tells how similar 2 records are, in percent, and why.
+// The title counts most; the author, publisher & year count when both records have them.
+// Records with different DOIs, volumes or editions are different titles
+func duplicateScore(a, b duplicateEntry) (int, []string) {
+	if len(a.dois) > 0 && len(b.dois) > 0 && dice(a.dois, b.dois) == 0 {
+		return 0, nil
+	}
+	if a.volume != "" && b.volume != "" && a.volume != b.volume {
+		return 0, nil
+	}
+	if a.edition != "" && b.edition != "" && a.edition != b.edition {
+		return 0, nil
+	}
+
+	title := dice(a.title, b.title)
+	if main := dice(a.main, b.main); main > title {
+		title = main
+	}
+	if title < duplicateTitleThreshold {
+		return 0, nil
+	}
+
+	var reasons []string
+	if title == 100 {
+		reasons = append(reasons, "same title")
+	} else {
+		reasons = append(reasons, "similar title")
+	}
+
+	// weights of the title, author, publisher & year
+	score, weights := 6*title, 6
+	if len(a.author) > 0 && len(b.author) > 0 {
+		author := dice(a.author, b.author)
+		score, weights = score+2*author, weights+2
+		if author >= 50 {
+			reasons = append(reasons, "same author")
+		}
+	}
+	if len(a.publisher) > 0 && len(b.publisher) > 0 {
+		publisher := dice(a.publisher, b.publisher)
+		score, weights = score+publisher, weights+1
+		if publisher >= 50 {
+			reasons = append(reasons, "same publisher")
+		}
+	}
+	if a.year != "" && b.year != "" {
+		if a.year == b.year {
+			score += 100
+			reasons = append(reasons, "same year")
+		}
+		weights++
+	}
+
+	return score / weights, reasons
+}
+
+// DuplicatesFind looks for the records which may be the same title, though they share no identifier,
+// and queues the pairs found for a review. Pairs already reviewed aren't queued again.
+// Records are only compared with the records whose title starts with the same word.
+// It returns the number of records compared, and the number of pairs queued
+func DuplicatesFind() (int, int, error) {
+	// records, by the first word of their title
+	blocks := make(map[string][]duplicateEntry)
+	count, err := RecordsIter(RecordsFilter{}, func(r Record) error {
+		e := newDuplicateEntry(r)
+		if len(e.title) > 0 {
+			blocks[e.title[0]] = append(blocks[e.title[0]], e)
+		}
+		return nil
+	})
+	if err != nil {
+		return count, 0, err
+	}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getDuplicatesColl()
+
+	// the pending candidates are found again, unless their records changed
+	if _, err := coll.RemoveAll(bson.M{"status": DuplicatePending}); err != nil {
+		return count, 0, err
+	}
+
+	var found int
+	for _, block := range blocks {
+		for i := 0; i < len(block); i++ {
+			for j := i + 1; j < len(block); j++ {
+				score, reasons := duplicateScore(block[i], block[j])
+				if score < duplicateThreshold {
+					continue
+				}
+
+				a, b := block[i].id, block[j].id
+				if b < a {
+					a, b = b, a
+				}
+				c := DuplicateCandidate{
+					ID:          bson.NewObjectId(),
+					RecordA:     a,
+					RecordB:     b,
+					Score:       score,
+					Reasons:     reasons,
+					Status:      DuplicatePending,
+					DateCreated: time.Now(),
+				}
+				err := coll.Insert(c)
+				if mgo.IsDup(err) { // already reviewed
+					continue
+				}
+				if err != nil {
+					return count, found, err
+				}
+				found++
+			}
+		}
+	}
+
+	return count, found, nil
+}
+
+// DuplicatesCount counts the duplicate candidates with a given status
+func DuplicatesCount(status int) int {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getDuplicatesColl()
+
+	n, _ := coll.Find(bson.M{"status": status}).Count()
+	return n
+}
+
+// DuplicatesGetPending retrieves the duplicate candidates waiting for a review, most similar first, with their records.
+// Candidates one record of which was deleted since are left out
+func DuplicatesGetPending(skip, limit int) ([]DuplicatePair, error) {
+	var candidates []DuplicateCandidate
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getDuplicatesColl()
+
+	q := coll.Find(bson.M{"status": DuplicatePending}).Sort("-score", "_id").Skip(skip)
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	if err := q.All(&candidates); err != nil {
+		return nil, err
+	}
+
+	var pairs []DuplicatePair
+	for _, c := range candidates {
+		a, errA := RecordGetByID(c.RecordA.Hex())
+		b, errB := RecordGetByID(c.RecordB.Hex())
+		if errA != nil || errB != nil || a.Deleted || b.Deleted {
+			continue
+		}
+		pairs = append(pairs, DuplicatePair{DuplicateCandidate: c, A: a, B: b})
+	}
+
+	return pairs, nil
+}
+
+// duplicateGetPending retrieves a duplicate candidate waiting for a review, given its mongodb ID
+func duplicateGetPending(ID string) (DuplicateCandidate, error) {
+	var c DuplicateCandidate
+
+	if !bson.IsObjectIdHex(ID) {
+		return c, mgo.ErrNotFound
+	}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getDuplicatesColl()
+
+	if err := coll.FindId(bson.ObjectIdHex(ID)).One(&c); err != nil {
+		return c, err
+	}
+	if c.Status != DuplicatePending {
+		return c, ErrDuplicateReviewed
+	}
+	return c, nil
+}
+
+// duplicateReviewed saves the outcome of the review of a duplicate candidate
+func duplicateReviewed(c DuplicateCandidate, status int, src ChangeSource) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getDuplicatesColl()
+
+	return coll.UpdateId(c.ID, bson.M{"$set": bson.M{
+		"status":       status,
+		"datereviewed": time.Now(),
+		"reviewedby":   src.User,
+	}})
+}
+
+// DuplicateDismiss marks a duplicate candidate as 2 different titles: the pair won't be queued again
+func DuplicateDismiss(ID string, src ChangeSource) error {
+	c, err := duplicateGetPending(ID)
+	if err != nil {
+		return err
+	}
+	return duplicateReviewed(c, DuplicateDismissed, src)
+}
+
+// DuplicateMerge merges the records of a duplicate candidate into the one to keep, and returns it.
+// As for a record found again by an upload, the record kept gets the identifiers & target services of the other,
+// and its fields are merged following the merge policy for a manual edit. The other record is moved to the trash, without its identifiers
+func DuplicateMerge(ID string, keep bson.ObjectId, src ChangeSource) (Record, error) {
+	c, err := duplicateGetPending(ID)
+	if err != nil {
+		return Record{}, err
+	}
+
+	dropID := c.RecordB
+	switch keep {
+	case c.RecordA:
+	case c.RecordB:
+		dropID = c.RecordA
+	default:
+		return Record{}, ErrDuplicateKeep
+	}
+
+	kept, err := RecordGetByID(keep.Hex())
+	if err != nil {
+		return kept, err
+	}
+	dropped, err := RecordGetByID(dropID.Hex())
+	if err != nil {
+		return kept, err
+	}
+	if kept.Deleted || dropped.Deleted {
+		return kept, ErrRecordDeleted
+	}
+
+	// the record kept comes first, as a manual edit would
+	policy, err := MergePolicyGet()
+	if err != nil {
+		return kept, err
+	}
+	merged := kept
+	recordsMerge(&merged, dropped, SourceManual, policy)
+	merged.ID, merged.DateCreated = kept.ID, kept.DateCreated
+	if kept.RecordUnimarc != "" || kept.RecordMarc21 != "" {
+		merged.RecordUnimarc, merged.RecordMarc21 = kept.RecordUnimarc, kept.RecordMarc21
+	}
+	merged.Acquired = kept.Acquired || dropped.Acquired
+	merged.Active = kept.Active || dropped.Active
+
+	// identifiers are unique: the other record gives them up before the record kept gets them,
+	// and gets them back if the record kept can't be saved
+	deleted, err := recordDeleteMerged(dropped, kept.ID, src)
+	if err != nil {
+		return kept, err
+	}
+	if err := merged.RecordUpdate(src); err != nil {
+		if undoErr := recordPut(dropped); undoErr != nil {
+			logger.Error.Printf("couldn't put back the record %s merged into %s: %v", dropID.Hex(), kept.ID.Hex(), undoErr)
+		}
+		return kept, err
+	}
+
+	rev := newRevision(dropped.ID, RevisionDeleted, src)
+	rev.Changes = recordsDiff(dropped, deleted)
+	rev.Before = &dropped
+	rev.create()
+
+	if err := duplicateReviewed(c, DuplicateMerged, src); err != nil {
+		return merged, err
+	}
+
+	// the other pairs of the record merged are moot
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	_, err = getDuplicatesColl().RemoveAll(bson.M{
+		"status": DuplicatePending,
+		"$or":    []bson.M{{"recorda": dropID}, {"recordb": dropID}},
+	})
+
+	return merged, err
+}
+
+// recordDeleteMerged moves a record merged into another to the trash, without its identifiers, and returns it.
+// The revision is left to the caller, once the merge is saved
+func recordDeleteMerged(before Record, into bson.ObjectId, src ChangeSource) (Record, error) {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRecordsColl()
+
+	deleted := before
+	deleted.Identifiers = nil
+	deleted.Deleted = true
+	deleted.DateDeleted = time.Now()
+	deleted.DeletedBy = src.User
+	deleted.MergedInto = into
+	err := coll.UpdateId(before.ID, bson.M{
+		"$set": bson.M{
+			"deleted":     true,
+			"datedeleted": deleted.DateDeleted,
+			"deletedby":   deleted.DeletedBy,
+			"mergedinto":  into,
+		},
+		"$unset": bson.M{"identifiers": ""},
+	})
+	return deleted, err
+}
+
+// recordPut saves a record as it is, e.g. to undo a change which couldn't be completed
+func recordPut(r Record) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	return getRecordsColl().UpdateId(r.ID, r)
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDuplicateTokens(t *testing.T) {
+	tests := []struct {
+		s             string
+		skipStopWords bool
+		want          []string
+	}{
+		{"Économie du développement", true, []string{"economie", "developpement"}},
+		{"Économie du développement", false, []string{"economie", "du", "developpement"}},
+		{"L'Œuvre d'art : une introduction", true, []string{"oeuvre", "art", "introduction"}},
+		{"The Art of Computer Programming, vol. 1", true, []string{"art", "computer", "programming", "vol", "1"}},
+		{"  ", true, nil},
+	}
+
+	for _, tt := range tests {
+		if got := duplicateTokens(tt.s, tt.skipStopWords); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("duplicateTokens(%q, %v) = %q, want %q", tt.s, tt.skipStopWords, got, tt.want)
+		}
+	}
+}
+
+func TestDice(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want int
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, 100},
+		{[]string{"a", "b"}, []string{"b", "a", "a"}, 100},
+		{[]string{"a", "b", "c"}, []string{"a", "b"}, 80},
+		{[]string{"a", "b"}, []string{"c", "d"}, 0},
+		{nil, []string{"a"}, 0},
+		{nil, nil, 0},
+	}
+
+	for _, tt := range tests {
+		if got := dice(tt.a, tt.b); got != tt.want {
+			t.Errorf("dice(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicateScore(t *testing.T) {
+	book := Record{
+		PublicationTitle:            "Économie du développement",
+		FirstAuthor:                 "Dupont, Jean",
+		PublisherName:               "Armand Colin",
+		DateMonographPublishedPrint: "2012-05-01",
+	}
+	with := func(edit func(r *Record)) Record {
+		r := book
+		edit(&r)
+		return r
+	}
+
+	tests := []struct {
+		name        string
+		a, b        Record
+		wantScore   int
+		wantReasons []string
+	}{
+		{
+			"same book",
+			book, book,
+			100, []string{"same title", "same author", "same publisher", "same year"},
+		},
+		{
+			"accents & punctuation, nothing else known",
+			Record{PublicationTitle: "Economie du developpement"},
+			Record{PublicationTitle: "ÉCONOMIE DU DÉVELOPPEMENT."},
+			100, []string{"same title"},
+		},
+		{
+			"subtitle",
+			book,
+			with(func(r *Record) { r.PublicationTitle = "Économie du développement : une introduction" }),
+			100, []string{"same title", "same author", "same publisher", "same year"},
+		},
+		{
+			"year in the online date",
+			with(func(r *Record) { r.DateMonographPublishedPrint, r.DateMonographPublishedOnline = "", "2012" }),
+			book,
+			100, []string{"same title", "same author", "same publisher", "same year"},
+		},
+		{
+			"other year",
+			Record{PublicationTitle: "Économie du développement", DateMonographPublishedPrint: "2012"},
+			Record{PublicationTitle: "Économie du développement", DateMonographPublishedPrint: "2015"},
+			85, []string{"same title"},
+		},
+		{
+			"similar title, other author",
+			Record{PublicationTitle: "Introduction à la sociologie", FirstAuthor: "Durand, Marie"},
+			Record{PublicationTitle: "Introduction à la sociologie politique", FirstAuthor: "Martin, Paul"},
+			60, []string{"similar title"},
+		},
+		{
+			"titles too far apart",
+			Record{PublicationTitle: "Histoire de France"},
+			Record{PublicationTitle: "Géographie de la France"},
+			0, nil,
+		},
+		{
+			"other volume",
+			with(func(r *Record) { r.MonographVolume = "1" }),
+			with(func(r *Record) { r.MonographVolume = "2" }),
+			0, nil,
+		},
+		{
+			"volume on one side only",
+			with(func(r *Record) { r.MonographVolume = "1" }),
+			book,
+			100, []string{"same title", "same author", "same publisher", "same year"},
+		},
+		{
+			"other edition",
+			with(func(r *Record) { r.MonographEdition = "2e édition" }),
+			with(func(r *Record) { r.MonographEdition = "3e édition" }),
+			0, nil,
+		},
+		{
+			"other DOI",
+			with(func(r *Record) { r.Identifiers = []Identifier{{Identifier: "10.1000/a", IDType: IDTypeDOI}} }),
+			with(func(r *Record) { r.Identifiers = []Identifier{{Identifier: "10.1000/b", IDType: IDTypeDOI}} }),
+			0, nil,
+		},
+		{
+			"same DOI",
+			with(func(r *Record) { r.Identifiers = []Identifier{{Identifier: "10.1000/a", IDType: IDTypeDOI}} }),
+			with(func(r *Record) { r.Identifiers = []Identifier{{Identifier: "10.1000/a", IDType: IDTypeDOI}} }),
+			100, []string{"same title", "same author", "same publisher", "same year"},
+		},
+	}
+
+	for _, tt := range tests {
+		score, reasons := duplicateScore(newDuplicateEntry(tt.a), newDuplicateEntry(tt.b))
+		if score != tt.wantScore || !reflect.DeepEqual(reasons, tt.wantReasons) {
+			t.Errorf("%s: duplicateScore = %d %q, want %d %q", tt.name, score, reasons, tt.wantScore, tt.wantReasons)
+		}
+		// the order of the records doesn't matter
+		if reverse, _ := duplicateScore(newDuplicateEntry(tt.b), newDuplicateEntry(tt.a)); reverse != score {
+			t.Errorf("%s: duplicateScore = %d one way, %d the other", tt.name, score, reverse)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/marc"
+)
+
+// EnrichmentRuleSet holds the local fields added to the Unimarc records of a target service when they are exported
+type EnrichmentRuleSet struct {
+	ID          bson.ObjectId `bson:"_id,omitempty"`
+	TSName      string
+	Rules       []EnrichmentRule
+	DateUpdated time.Time `bson:",omitempty"`
+}
+
+// EnrichmentRule adds a data field to a record. Subfield values may hold placeholders, e.g. {TitleURL},
+// replaced by the values of the record or of the target service
+type EnrichmentRule struct {
+	Tag       string
+	Ind1      string
+	Ind2      string
+	Subfields []marc.Subfield
+}
+
+// DefaultEnrichmentRules are suggested for a target service without rules yet:
+// link to the resource, access note from embargo & coverage, local field with the target service name
+const DefaultEnrichmentRules = `856 4_ $u{TitleURL}
+371 0_ $a{EmbargoInfo}$a{CoverageNotes}
+991 __ $a{TSName}$b{TSDisplayName}`
+
+// enrichmentPlaceholders lists the values available to the rules
+var enrichmentPlaceholders = map[string]func(Record, TargetService) string{
+	"TitleURL":         func(r Record, ts TargetService) string { return r.TitleURL },
+	"EmbargoInfo":      func(r Record, ts TargetService) string { return r.EmbargoInfo },
+	"CoverageNotes":    func(r Record, ts TargetService) string { return r.CoverageNotes },
+	"CoverageDepth":    func(r Record, ts TargetService) string { return r.CoverageDepth },
+	"PublicationTitle": func(r Record, ts TargetService) string { return r.PublicationTitle },
+	"TitleID":          func(r Record, ts TargetService) string { return r.TitleID },
+	"TSName":           func(r Record, ts TargetService) string { return ts.Name },
+	"TSDisplayName":    func(r Record, ts TargetService) string { return ts.DisplayName },
+}
+
+var (
+	enrichmentRuleRe    = regexp.MustCompile(`^([0-9]{3}) ([0-9a-z_#]{2}) (\$.+)$`)
+	enrichmentPlaceRe   = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+	enrichmentSubcodeRe = regexp.MustCompile(`^[0-9a-z]$`)
+)
+
+// ParseEnrichmentRules reads rules written one per line, e.g. 856 4_ $u{TitleURL}$zOnline access
+// where _ or # stand for a blank indicator
+func ParseEnrichmentRules(text string) ([]EnrichmentRule, error) {
+	var rules []EnrichmentRule
+
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		m := enrichmentRuleRe.FindStringSubmatch(line)
+		if m == nil {
+			return rules, fmt.Errorf("line %d: expected e.g. \"856 4_ $u{TitleURL}\", got %q", i+1, line)
+		}
+		if m[1] < "010" {
+			return rules, fmt.Errorf("line %d: %s is not a data field", i+1, m[1])
+		}
+
+		rule := EnrichmentRule{
+			Tag:  m[1],
+			Ind1: blankIndicator(m[2][0:1]),
+			Ind2: blankIndicator(m[2][1:2]),
+		}
+		for _, sf := range strings.Split(m[3], "$")[1:] {
+			if len(sf) < 2 || !enrichmentSubcodeRe.MatchString(sf[0:1]) {
+				return rules, fmt.Errorf("line %d: invalid subfield %q", i+1, "$"+sf)
+			}
+			for _, p := range enrichmentPlaceRe.FindAllStringSubmatch(sf, -1) {
+				if _, ok := enrichmentPlaceholders[p[1]]; !ok {
+					return rules, fmt.Errorf("line %d: unknown placeholder %s", i+1, p[0])
+				}
+			}
+			rule.Subfields = append(rule.Subfields, marc.Subfield{Code: sf[0:1], Value: sf[1:]})
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// blankIndicator turns the characters standing for a blank into a blank
+func blankIndicator(s string) string {
+	if s == "_" || s == "#" {
+		return " "
+	}
+	return s
+}
+
+// String writes a rule back the way it is read by ParseEnrichmentRules
+func (rule EnrichmentRule) String() string {
+	ind := strings.Replace(rule.Ind1+rule.Ind2, " ", "_", -1)
+	s := rule.Tag + " " + ind + " "
+	for _, sf := range rule.Subfields {
+		s += "$" + sf.Code + sf.Value
+	}
+	return s
+}
+
+// EnrichmentRulesText writes rules one per line, the way they are edited
+func EnrichmentRulesText(rules []EnrichmentRule) string {
+	var lines []string
+	for _, rule := range rules {
+		lines = append(lines, rule.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// apply builds the field added by a rule for a record.
+// Subfields whose placeholders are all empty are dropped, and so is a field left without subfields
+func (rule EnrichmentRule) apply(r Record, ts TargetService) (marc.DataField, bool) {
+	f := marc.DataField{Tag: rule.Tag, Ind1: rule.Ind1, Ind2: rule.Ind2}
+	for _, sf := range rule.Subfields {
+		filled := false
+		value := enrichmentPlaceRe.ReplaceAllStringFunc(sf.Value, func(p string) string {
+			v := enrichmentPlaceholders[p[1:len(p)-1]](r, ts)
+			if v != "" {
+				filled = true
+			}
+			return v
+		})
+		if !filled && enrichmentPlaceRe.MatchString(sf.Value) {
+			continue
+		}
+		f.Subfields = append(f.Subfields, marc.Subfield{Code: sf.Code, Value: strings.TrimSpace(value)})
+	}
+	return f, len(f.Subfields) > 0
+}
+
+// Apply adds the fields of a rule set to the Unimarc record of a record, and returns the fields added
+func (set EnrichmentRuleSet) Apply(r Record, ts TargetService, unimarc *marc.Record) []marc.DataField {
+	var added []marc.DataField
+	// the URL, embargo... of the record in this package
+	r = r.ForTargetService(ts.Name)
+	for _, rule := range set.Rules {
+		f, ok := rule.apply(r, ts)
+		if !ok {
+			continue
+		}
+		unimarc.AddField(f)
+		added = append(added, f)
+	}
+	return added
+}
+
+// EnrichmentRulesGet retrieves the rule set of a target service.
+// A target service without rules gets an empty rule set
+func EnrichmentRulesGet(tsname string) (EnrichmentRuleSet, error) {
+	set := EnrichmentRuleSet{TSName: tsname}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getEnrichmentColl()
+
+	err := coll.Find(bson.M{"tsname": tsname}).One(&set)
+	if err == mgo.ErrNotFound {
+		return set, nil
+	}
+	return set, err
+}
+
+// EnrichmentRulesSave saves the rule set of a target service, replacing the previous one
+func EnrichmentRulesSave(set EnrichmentRuleSet) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getEnrichmentColl()
+
+	set.ID = ""
+	set.DateUpdated = time.Now()
+	_, err := coll.Upsert(bson.M{"tsname": set.TSName}, bson.M{"$set": set})
+	return err
+}
+
+// EnrichmentRulesDelete removes the rule set of a target service, e.g. when the target service is deleted
+func EnrichmentRulesDelete(tsname string) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getEnrichmentColl()
+
+	_, err := coll.RemoveAll(bson.M{"tsname": tsname})
+	return err
+}
+
+// EnrichmentPreview is the result of the rules of a target service on a record
+type EnrichmentPreview struct {
+	TS    TargetService
+	Added []marc.DataField
+}
+
+// EnrichmentPreviews tells which fields each target service of a record adds to its Unimarc record on export
+func EnrichmentPreviews(r Record) ([]EnrichmentPreview, error) {
+	var previews []EnrichmentPreview
+
+	unimarc, err := r.Unimarc()
+	if err != nil {
+		return previews, err
+	}
+
+	for _, ts := range r.TargetServices {
+		set, err := EnrichmentRulesGet(ts.Name)
+		if err != nil {
+			return previews, err
+		}
+		enriched := unimarc
+		enriched.DataFields = append([]marc.DataField(nil), unimarc.DataFields...)
+		previews = append(previews, EnrichmentPreview{TS: ts, Added: set.Apply(r, ts, &enriched)})
+	}
+
+	return previews, nil
+}
+
+// unimarcEnricher returns the function getting the Unimarc record of a record, enriched for export.
+// The rules are those of tsname, or those of each target service of the record if tsname is empty
+func unimarcEnricher(tsname string) func(Record) (marc.Record, error) {
+	sets := make(map[string]EnrichmentRuleSet)
+
+	return func(r Record) (marc.Record, error) {
+		unimarc, err := r.Unimarc()
+		if err != nil {
+			return unimarc, err
+		}
+
+		for _, ts := range r.TargetServices {
+			if tsname != "" && ts.Name != tsname {
+				continue
+			}
+			set, ok := sets[ts.Name]
+			if !ok {
+				set, err = EnrichmentRulesGet(ts.Name)
+				if err != nil {
+					return unimarc, err
+				}
+				sets[ts.Name] = set
+			}
+			set.Apply(r, ts, &unimarc)
+		}
+
+		return unimarc, nil
+	}
+}
@@ -0,0 +1,202 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/cron"
+	"github.com/nicomo/abacaxi/marc"
+)
+
+// Types of exports
+const (
+	ExportKbart   = "kbart"
+	ExportUnimarc = "unimarc"
+	ExportMarc21  = "marc21"
+)
+
+// ExportSchedule is an export of the records of a target service run at regular times by the scheduler,
+// the file being written to a directory, e.g. the folder the ILS loads its records from
+type ExportSchedule struct {
+	ID          bson.ObjectId `bson:"_id"`
+	TSName      string
+	ExportType  string        // kbart, unimarc or marc21
+	Format      string        `bson:",omitempty"` // marc export format
+	Filter      RecordsFilter // active, acquired, unimarc, ppn
+	Schedule    string        // cron-like, e.g. "0 2 * * *" every night at 2
+	Destination string        // directory the files are written to
+	ChangedOnly bool          // only the records created or updated since the last run
+	Enabled     bool
+	User        string `bson:",omitempty"`
+	DateCreated time.Time
+	NextRun     time.Time     `bson:",omitempty"`
+	LastRun     time.Time     `bson:",omitempty"`
+	LastReport  bson.ObjectId `bson:",omitempty"`
+}
+
+// Validate checks an export schedule before it's saved: known export type & format,
+// valid schedule, existing destination directory
+func (s ExportSchedule) Validate() error {
+	switch s.ExportType {
+	case ExportKbart:
+	case ExportUnimarc, ExportMarc21:
+		switch s.Format {
+		case marc.FormatISO2709, marc.FormatMarcXML, marc.FormatJSON:
+		default:
+			return marc.ErrUnknownFormat
+		}
+	default:
+		return errors.New("unknown export type " + s.ExportType)
+	}
+
+	if s.TSName == "" {
+		return errors.New("a target service is required")
+	}
+
+	if _, err := cron.Parse(s.Schedule); err != nil {
+		return err
+	}
+
+	if !filepath.IsAbs(s.Destination) {
+		return errors.New("the destination must be an absolute path")
+	}
+	fi, err := os.Stat(s.Destination)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return errors.New(s.Destination + " is not a directory")
+	}
+
+	return nil
+}
+
+// nextRun returns the next time the export is due after t, zero if it's disabled
+func (s ExportSchedule) nextRun(t time.Time) time.Time {
+	if !s.Enabled {
+		return time.Time{}
+	}
+	schedule, err := cron.Parse(s.Schedule)
+	if err != nil {
+		return time.Time{}
+	}
+	return schedule.Next(t)
+}
+
+// ExportScheduleCreate saves a new export schedule, after validating it
+func ExportScheduleCreate(s *ExportSchedule) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getExportSchedulesColl()
+
+	s.ID = bson.NewObjectId()
+	s.DateCreated = time.Now()
+	s.NextRun = s.nextRun(s.DateCreated)
+
+	return coll.Insert(s)
+}
+
+// ExportSchedulesGet retrieves all the export schedules, by target service
+func ExportSchedulesGet() ([]ExportSchedule, error) {
+	var schedules []ExportSchedule
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getExportSchedulesColl()
+
+	err := coll.Find(nil).Sort("tsname", "datecreated").All(&schedules)
+	return schedules, err
+}
+
+// ExportScheduleGetByID retrieves an export schedule given its mongodb ID
+func ExportScheduleGetByID(ID string) (ExportSchedule, error) {
+	var s ExportSchedule
+
+	if !bson.IsObjectIdHex(ID) {
+		return s, mgo.ErrNotFound
+	}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getExportSchedulesColl()
+
+	err := coll.FindId(bson.ObjectIdHex(ID)).One(&s)
+	return s, err
+}
+
+// ExportScheduleDelete removes an export schedule
+func ExportScheduleDelete(ID string) error {
+	if !bson.IsObjectIdHex(ID) {
+		return mgo.ErrNotFound
+	}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getExportSchedulesColl()
+
+	return coll.RemoveId(bson.ObjectIdHex(ID))
+}
+
+// ExportScheduleSetEnabled enables or disables an export schedule.
+// An enabled export is next due according to its schedule, from now on
+func ExportScheduleSetEnabled(ID string, enabled bool) error {
+	s, err := ExportScheduleGetByID(ID)
+	if err != nil {
+		return err
+	}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getExportSchedulesColl()
+
+	s.Enabled = enabled
+	return coll.UpdateId(s.ID, bson.M{"$set": bson.M{"enabled": enabled, "nextrun": s.nextRun(time.Now())}})
+}
+
+// ExportSchedulesClaimDue returns the enabled exports due at t, and sets their next run.
+// An export is claimed only once, even if several schedulers look at the same time
+func ExportSchedulesClaimDue(t time.Time) ([]ExportSchedule, error) {
+	var due, claimed []ExportSchedule
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getExportSchedulesColl()
+
+	err := coll.Find(bson.M{"enabled": true, "nextrun": bson.M{"$lte": t}}).All(&due)
+	if err != nil {
+		return claimed, err
+	}
+
+	for _, s := range due {
+		err := coll.Update(bson.M{"_id": s.ID, "nextrun": s.NextRun},
+			bson.M{"$set": bson.M{"nextrun": s.nextRun(t)}})
+		if err == mgo.ErrNotFound { // claimed by someone else
+			continue
+		}
+		if err != nil {
+			return claimed, err
+		}
+		claimed = append(claimed, s)
+	}
+
+	return claimed, nil
+}
+
+// ExportScheduleRunDone records the run of an export which started at started, and its report.
+// The next run of a "changed only" export includes the records changed since started
+func ExportScheduleRunDone(ID bson.ObjectId, started time.Time, reportID bson.ObjectId) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getExportSchedulesColl()
+
+	return coll.UpdateId(ID, bson.M{"$set": bson.M{"lastrun": started, "lastreport": reportID}})
+}
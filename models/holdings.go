@@ -0,0 +1,300 @@
+package models
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Holding is a title of a package as far as access goes: its identifiers, its coverage and its URL
+type Holding struct {
+	RecordID             bson.ObjectId `bson:",omitempty"`
+	PublicationTitle     string
+	Identifiers          []Identifier `bson:",omitempty"`
+	DateFirstIssueOnline string       `bson:",omitempty"`
+	NumFirstVolOnline    string       `bson:",omitempty"`
+	NumFirstIssueOnline  string       `bson:",omitempty"`
+	DateLastIssueOnline  string       `bson:",omitempty"`
+	NumLastVolOnline     string       `bson:",omitempty"`
+	NumLastIssueOnline   string       `bson:",omitempty"`
+	CoverageDepth        string       `bson:",omitempty"`
+	EmbargoInfo          string       `bson:",omitempty"`
+	TitleURL             string       `bson:",omitempty"`
+	TitleID              string       `bson:",omitempty"`
+
+	// enough of the rest of the record for a KBART file
+	FirstAuthor     string `bson:",omitempty"`
+	PublisherName   string `bson:",omitempty"`
+	PublicationType string `bson:",omitempty"`
+}
+
+// holdingFromRecord returns the holding of a record
+func holdingFromRecord(r Record) Holding {
+	return Holding{
+		RecordID:             r.ID,
+		PublicationTitle:     r.PublicationTitle,
+		Identifiers:          r.Identifiers,
+		DateFirstIssueOnline: r.DateFirstIssueOnline,
+		NumFirstVolOnline:    r.NumFirstVolOnline,
+		NumFirstIssueOnline:  r.NumFirstIssueOnline,
+		DateLastIssueOnline:  r.DateLastIssueOnline,
+		NumLastVolOnline:     r.NumLastVolOnline,
+		NumLastIssueOnline:   r.NumLastIssueOnline,
+		CoverageDepth:        r.CoverageDepth,
+		EmbargoInfo:          r.EmbargoInfo,
+		TitleURL:             r.TitleURL,
+		TitleID:              r.TitleID,
+		FirstAuthor:          r.FirstAuthor,
+		PublisherName:        r.PublisherName,
+		PublicationType:      r.PublicationType,
+	}
+}
+
+// record returns the record a holding was taken from, as far as the holding knows it
+func (h Holding) record() Record {
+	return Record{
+		ID:                   h.RecordID,
+		PublicationTitle:     h.PublicationTitle,
+		Identifiers:          h.Identifiers,
+		DateFirstIssueOnline: h.DateFirstIssueOnline,
+		NumFirstVolOnline:    h.NumFirstVolOnline,
+		NumFirstIssueOnline:  h.NumFirstIssueOnline,
+		DateLastIssueOnline:  h.DateLastIssueOnline,
+		NumLastVolOnline:     h.NumLastVolOnline,
+		NumLastIssueOnline:   h.NumLastIssueOnline,
+		CoverageDepth:        h.CoverageDepth,
+		EmbargoInfo:          h.EmbargoInfo,
+		TitleURL:             h.TitleURL,
+		TitleID:              h.TitleID,
+		FirstAuthor:          h.FirstAuthor,
+		PublisherName:        h.PublisherName,
+		PublicationType:      h.PublicationType,
+	}
+}
+
+// Coverage sums up the coverage of a holding, e.g. "2001 v.1 n.1 - 2010 v.10, fulltext"
+func (h Holding) Coverage() string {
+	return PackageCoverage{
+		DateFirstIssueOnline: h.DateFirstIssueOnline,
+		NumFirstVolOnline:    h.NumFirstVolOnline,
+		NumFirstIssueOnline:  h.NumFirstIssueOnline,
+		DateLastIssueOnline:  h.DateLastIssueOnline,
+		NumLastVolOnline:     h.NumLastVolOnline,
+		NumLastIssueOnline:   h.NumLastIssueOnline,
+		CoverageDepth:        h.CoverageDepth,
+		EmbargoInfo:          h.EmbargoInfo,
+	}.String()
+}
+
+// TSHoldings retrieves the holdings of a target service, i.e. the holdings of its records
+// with their coverage in this package, in title order
+func TSHoldings(tsname string) ([]Holding, error) {
+	var holdings []Holding
+
+	_, err := RecordsIter(RecordsFilter{TSName: tsname}, func(r Record) error {
+		holdings = append(holdings, holdingFromRecord(r.ForTargetService(tsname)))
+		return nil
+	})
+
+	return holdings, err
+}
+
+// holdingsDiff lists the differences of coverage & URL between 2 holdings of a title
+func holdingsDiff(a, b Holding) []FieldChange {
+	var changes []FieldChange
+
+	fields := []struct {
+		name string
+		a, b string
+	}{
+		{"DateFirstIssueOnline", a.DateFirstIssueOnline, b.DateFirstIssueOnline},
+		{"NumFirstVolOnline", a.NumFirstVolOnline, b.NumFirstVolOnline},
+		{"NumFirstIssueOnline", a.NumFirstIssueOnline, b.NumFirstIssueOnline},
+		{"DateLastIssueOnline", a.DateLastIssueOnline, b.DateLastIssueOnline},
+		{"NumLastVolOnline", a.NumLastVolOnline, b.NumLastVolOnline},
+		{"NumLastIssueOnline", a.NumLastIssueOnline, b.NumLastIssueOnline},
+		{"CoverageDepth", a.CoverageDepth, b.CoverageDepth},
+		{"EmbargoInfo", a.EmbargoInfo, b.EmbargoInfo},
+		{"TitleURL", a.TitleURL, b.TitleURL},
+	}
+	for _, f := range fields {
+		if f.a != f.b {
+			changes = append(changes, FieldChange{Field: f.name, Old: f.a, New: f.b})
+		}
+	}
+
+	return changes
+}
+
+// HoldingsPair is a title found in both holdings compared, with its differences of coverage & URL, if any
+type HoldingsPair struct {
+	A, B    Holding
+	Changes []FieldChange
+}
+
+// HoldingsComparison is the comparison of 2 holdings, e.g. 2 target services
+type HoldingsComparison struct {
+	OnlyA []Holding      // titles only in A
+	OnlyB []Holding      // titles only in B
+	Both  []HoldingsPair // titles in A & B
+}
+
+// CompareHoldings compares 2 holdings. Titles are matched on their identifiers:
+// 2 holdings with an identifier in common are the same title.
+// Holdings without identifiers are matched on their record
+func CompareHoldings(a, b []Holding) HoldingsComparison {
+	var c HoldingsComparison
+
+	// index B on its identifiers
+	byID := make(map[string]int)
+	byRecord := make(map[bson.ObjectId]int)
+	for j, h := range b {
+		for _, id := range h.Identifiers {
+			if _, ok := byID[id.matchKey()]; !ok && id.Identifier != "" {
+				byID[id.matchKey()] = j
+			}
+		}
+		if h.RecordID != "" {
+			byRecord[h.RecordID] = j
+		}
+	}
+
+	matched := make([]bool, len(b))
+	for _, h := range a {
+		j, found := -1, false
+		for _, id := range h.Identifiers {
+			if k, ok := byID[id.matchKey()]; ok && !matched[k] {
+				j, found = k, true
+				break
+			}
+		}
+		if !found && len(h.Identifiers) == 0 && h.RecordID != "" {
+			if k, ok := byRecord[h.RecordID]; ok && !matched[k] {
+				j, found = k, true
+			}
+		}
+
+		if !found {
+			c.OnlyA = append(c.OnlyA, h)
+			continue
+		}
+		matched[j] = true
+		c.Both = append(c.Both, HoldingsPair{A: h, B: b[j], Changes: holdingsDiff(h, b[j])})
+	}
+
+	for j, h := range b {
+		if !matched[j] {
+			c.OnlyB = append(c.OnlyB, h)
+		}
+	}
+
+	return c
+}
+
+// Changed lists the titles in A & B whose coverage or URL differ
+func (c HoldingsComparison) Changed() []HoldingsPair {
+	var changed []HoldingsPair
+	for _, p := range c.Both {
+		if len(p.Changes) > 0 {
+			changed = append(changed, p)
+		}
+	}
+	return changed
+}
+
+// OverlapA is the share of the titles of A which are in B, in percent
+func (c HoldingsComparison) OverlapA() int {
+	if total := len(c.OnlyA) + len(c.Both); total > 0 {
+		return 100 * len(c.Both) / total
+	}
+	return 0
+}
+
+// OverlapB is the share of the titles of B which are in A, in percent
+func (c HoldingsComparison) OverlapB() int {
+	if total := len(c.OnlyB) + len(c.Both); total > 0 {
+		return 100 * len(c.Both) / total
+	}
+	return 0
+}
+
+// comparisonHeader lists the columns of a comparison export, in order
+var comparisonHeader = []string{
+	"status",
+	"publication_title",
+	"identifiers",
+	"coverage_a",
+	"coverage_b",
+	"title_url_a",
+	"title_url_b",
+	"differences",
+}
+
+// comparisonLine returns the columns of a comparison export for a title
+func comparisonLine(status string, a, b Holding, changes []FieldChange) []string {
+	title, ids := a.PublicationTitle, a.Identifiers
+	if title == "" {
+		title, ids = b.PublicationTitle, b.Identifiers
+	}
+
+	var identifiers []string
+	for _, id := range ids {
+		identifiers = append(identifiers, id.Identifier)
+	}
+
+	var differences []string
+	for _, change := range changes {
+		differences = append(differences, fmt.Sprintf("%s: %s -> %s", change.Field, change.Old, change.New))
+	}
+
+	return []string{
+		status,
+		title,
+		strings.Join(identifiers, " "),
+		a.Coverage(),
+		b.Coverage(),
+		a.TitleURL,
+		b.TitleURL,
+		strings.Join(differences, " ; "),
+	}
+}
+
+// WriteComparison writes a comparison as a tab delimited file, one title per line:
+// titles only in A, only in B, then in both, with their differences.
+// It returns the number of titles written
+func WriteComparison(out io.Writer, c HoldingsComparison) (int, error) {
+	w := bufio.NewWriter(out)
+
+	if err := writeKbartLine(w, append([]string(nil), comparisonHeader...)); err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, h := range c.OnlyA {
+		if err := writeKbartLine(w, comparisonLine("only_a", h, Holding{}, nil)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	for _, h := range c.OnlyB {
+		if err := writeKbartLine(w, comparisonLine("only_b", Holding{}, h, nil)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	for _, p := range c.Both {
+		status := "both"
+		if len(p.Changes) > 0 {
+			status = "both_changed"
+		}
+		if err := writeKbartLine(w, comparisonLine(status, p.A, p.B, p.Changes)); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, w.Flush()
+}
@@ -0,0 +1,226 @@
+package models
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/issn"
+)
+
+// Schemes of the print & online identifiers, told apart by their form
+const (
+	SchemeISBN13 = "ISBN-13"
+	SchemeISBN10 = "ISBN-10"
+	SchemeISSN   = "ISSN"
+)
+
+var (
+	// ErrInvalidDOI is returned for a string which isn't a DOI
+	ErrInvalidDOI = errors.New("not a DOI")
+	// ErrInvalidOCLC is returned for a string which isn't an OCLC number
+	ErrInvalidOCLC = errors.New("not an OCLC number")
+	// ErrInvalidProprietary is returned for a proprietary identifier which doesn't say which publisher it belongs to
+	ErrInvalidProprietary = errors.New("a proprietary identifier is made of a publisher and a title ID, e.g. Springer:12345")
+)
+
+// doiRegexp matches a DOI: the 10. directory indicator, a registrant code, a slash and a suffix
+var doiRegexp = regexp.MustCompile(`^10\.\d{4,9}/\S+$`)
+
+// doiPrefixes are the prefixes DOIs are often given in citations & URLs
+var doiPrefixes = []string{"https://doi.org/", "http://doi.org/", "https://dx.doi.org/", "http://dx.doi.org/", "doi:"}
+
+// doiURLRegexp finds a DOI in the URL of a publisher platform, e.g. https://www.example.com/doi/book/10.1007/978-3-319-12345-6
+var doiURLRegexp = regexp.MustCompile(`(?i)/doi/(?:[a-z]+/)?(10\.\d{4,9}/[^?#\s]+)`)
+
+// oclcRegexp matches an OCLC number, with the prefixes found in MARC records & KBART files: (OCoLC), ocm, ocn, on
+var oclcRegexp = regexp.MustCompile(`^(\(ocolc\))?\s*(ocm|ocn|on)?\s*0*([1-9][0-9]*)$`)
+
+// oclcURLRegexp finds an OCLC number in a WorldCat URL, e.g. https://www.worldcat.org/oclc/12345678
+var oclcURLRegexp = regexp.MustCompile(`(?i)worldcat\.org/(?:.*/)?oclc/([0-9]+)`)
+
+// ParseDOI validates a DOI, and returns it without prefix & in lower case, since DOIs are case insensitive,
+// e.g. "https://doi.org/10.1000/XYZ123" gives 10.1000/xyz123
+func ParseDOI(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	for _, p := range doiPrefixes {
+		if len(s) >= len(p) && strings.EqualFold(s[:len(p)], p) {
+			s = strings.TrimSpace(s[len(p):])
+			break
+		}
+	}
+
+	s = strings.ToLower(s)
+	if !doiRegexp.MatchString(s) {
+		return "", ErrInvalidDOI
+	}
+	return s, nil
+}
+
+// ParseOCLC validates an OCLC number, and returns it without prefix nor leading zeros, e.g. "(OCoLC)ocm00012345" gives 12345
+func ParseOCLC(s string) (string, error) {
+	m := oclcRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return "", ErrInvalidOCLC
+	}
+	return m[3], nil
+}
+
+// Scheme tells an ISBN-13 from an ISBN-10 or an ISSN, for the print & online identifiers.
+// It's empty for the other identifiers, or when the form of the identifier doesn't say
+func (id Identifier) Scheme() string {
+	if id.IDType != IDTypePrint && id.IDType != IDTypeOnline {
+		return ""
+	}
+
+	s := id.Identifier
+	switch {
+	case len(s) == 13 && isDigits(s) && (strings.HasPrefix(s, "978") || strings.HasPrefix(s, "979")):
+		return SchemeISBN13
+	case len(s) == 10 && isDigits(s[:9]) && (isDigits(s[9:]) || s[9] == 'X'):
+		return SchemeISBN10
+	case issn.Valid(s):
+		return SchemeISSN
+	}
+	return ""
+}
+
+// isDigits tells whether a string is only made of digits
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Label is the human readable type of an identifier, e.g. "Print, ISBN-13"
+func (id Identifier) Label() string {
+	label := IDTypeLabel(id.IDType)
+	if scheme := id.Scheme(); scheme != "" {
+		label += ", " + scheme
+	}
+	return label
+}
+
+// ProprietaryID returns the proprietary identifier of a title for a publisher.
+// The title IDs of publishers are only unique among their titles, hence the prefix
+func ProprietaryID(publisher, titleID string) (Identifier, error) {
+	publisher, titleID = strings.TrimSpace(publisher), strings.TrimSpace(titleID)
+	if publisher == "" || titleID == "" {
+		return Identifier{}, ErrInvalidProprietary
+	}
+	return Identifier{Identifier: publisher + ":" + titleID, IDType: IDTypeProprietary}, nil
+}
+
+// URL is the link resolving an identifier, for DOIs & OCLC numbers
+func (id Identifier) URL() string {
+	switch id.IDType {
+	case IDTypeDOI:
+		return "https://doi.org/" + id.Identifier
+	case IDTypeOCLC:
+		return "https://www.worldcat.org/oclc/" + id.Identifier
+	}
+	return ""
+}
+
+// typed tells whether an identifier only matches the identifiers of the same type,
+// e.g. an OCLC number could be taken for an ISSN
+func (id Identifier) typed() bool {
+	return id.IDType == IDTypeDOI || id.IDType == IDTypeOCLC || id.IDType == IDTypeProprietary
+}
+
+// matchKey is the key 2 identifiers of the same title share.
+// It's stored as the Key of the identifiers, which the unique index is on:
+// an OCLC number is then unique among the OCLC numbers, and doesn't clash with a PPN or an SFX ID made of the same digits
+func (id Identifier) matchKey() string {
+	if !id.typed() {
+		return id.Identifier
+	}
+	return IDTypeLabel(id.IDType) + ":" + id.Identifier
+}
+
+// setIdentifierKeys sets the Key of the identifiers of a record, before it's saved
+func (r *Record) setIdentifierKeys() {
+	for i := range r.Identifiers {
+		r.Identifiers[i].Key = r.Identifiers[i].matchKey()
+	}
+}
+
+// matchTerms returns the conditions of a query matching the records sharing an identifier.
+// ISSNs also match their ISSN-L
+func (id Identifier) matchTerms() []bson.M {
+	if id.typed() {
+		return []bson.M{{"identifiers.key": id.matchKey()}}
+	}
+
+	var terms []bson.M
+	for _, term := range issnTerms(id) {
+		terms = append(terms, bson.M{"identifiers.identifier": term})
+	}
+	return terms
+}
+
+// AddTitleIdentifiers adds the identifiers found in the title_id & title_url of a record:
+// a DOI or an OCLC number, else the title_id as the proprietary identifier of the publisher.
+// Identifiers the record already has are left out
+func (r *Record) AddTitleIdentifiers() {
+	add := func(id Identifier) {
+		for _, v := range r.Identifiers {
+			if v.Identifier == id.Identifier {
+				return
+			}
+		}
+		r.Identifiers = append(r.Identifiers, id)
+	}
+
+	if titleID := strings.TrimSpace(r.TitleID); titleID != "" {
+		if doi, err := ParseDOI(titleID); err == nil {
+			add(Identifier{Identifier: doi, IDType: IDTypeDOI})
+		} else if oclc, err := ParseOCLC(titleID); err == nil && oclcPrefixed(titleID) {
+			add(Identifier{Identifier: oclc, IDType: IDTypeOCLC})
+		} else if id, err := ProprietaryID(r.PublisherName, titleID); err == nil && !r.HasIdentifier(strings.Replace(titleID, "-", "", -1)) {
+			// the title_id is sometimes just the ISBN
+			add(id)
+		}
+	}
+
+	if titleURL := strings.TrimSpace(r.TitleURL); titleURL != "" {
+		// the slash of a DOI is often escaped in URLs
+		if unescaped, err := url.PathUnescape(titleURL); err == nil {
+			titleURL = unescaped
+		}
+		if doi, err := ParseDOI(titleURL); err == nil {
+			add(Identifier{Identifier: doi, IDType: IDTypeDOI})
+		} else if m := doiURLRegexp.FindStringSubmatch(titleURL); m != nil {
+			if doi, err := ParseDOI(m[1]); err == nil {
+				add(Identifier{Identifier: doi, IDType: IDTypeDOI})
+			}
+		}
+		if m := oclcURLRegexp.FindStringSubmatch(titleURL); m != nil {
+			if oclc, err := ParseOCLC(m[1]); err == nil {
+				add(Identifier{Identifier: oclc, IDType: IDTypeOCLC})
+			}
+		}
+	}
+}
+
+// oclcPrefixed tells whether a string is an OCLC number with its prefix: without it, it's just a number
+func oclcPrefixed(s string) bool {
+	m := oclcRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	return m != nil && (m[1] != "" || m[2] != "")
+}
+
+// HasIdentifier tells whether a record has an identifier, whatever its type
+func (r Record) HasIdentifier(s string) bool {
+	for _, id := range r.Identifiers {
+		if id.Identifier == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDOI(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr error
+	}{
+		{"10.1000/xyz123", "10.1000/xyz123", nil},
+		{"10.1000/XYZ123", "10.1000/xyz123", nil},
+		{" 10.1007/978-3-319-12345-6 ", "10.1007/978-3-319-12345-6", nil},
+		{"https://doi.org/10.1000/XYZ123", "10.1000/xyz123", nil},
+		{"http://dx.doi.org/10.1000/xyz123", "10.1000/xyz123", nil},
+		{"HTTPS://DOI.ORG/10.1000/xyz123", "10.1000/xyz123", nil},
+		{"doi:10.1000/xyz123", "10.1000/xyz123", nil},
+		{"DOI: 10.1000/xyz123", "10.1000/xyz123", nil},
+		{"10.123456789/long.registrant", "10.123456789/long.registrant", nil},
+		{"10.123/short.registrant", "", ErrInvalidDOI},
+		{"10.1000/", "", ErrInvalidDOI},
+		{"10.1000/with space", "", ErrInvalidDOI},
+		{"11.1000/xyz123", "", ErrInvalidDOI},
+		{"https://www.example.com/doi/10.1000/xyz123", "", ErrInvalidDOI},
+		{"9782070368228", "", ErrInvalidDOI},
+		{"", "", ErrInvalidDOI},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseDOI(tt.s)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("ParseDOI(%q) = %q, %v, want %q, %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseOCLC(t *testing.T) {
+	tests := []struct {
+		s            string
+		want         string
+		wantErr      error
+		wantPrefixed bool
+	}{
+		{"12345678", "12345678", nil, false},
+		{"00012345", "12345", nil, false},
+		{"(OCoLC)12345678", "12345678", nil, true},
+		{"(OCoLC) 12345678", "12345678", nil, true},
+		{"(OCoLC)ocm00012345", "12345", nil, true},
+		{"ocm00012345", "12345", nil, true},
+		{"ocn123456789", "123456789", nil, true},
+		{"on1234567890", "1234567890", nil, true},
+		{" OCN 123456789 ", "123456789", nil, true},
+		{"(OCoLC)", "", ErrInvalidOCLC, false},
+		{"00000000", "", ErrInvalidOCLC, false},
+		{"ocm", "", ErrInvalidOCLC, false},
+		{"12345x", "", ErrInvalidOCLC, false},
+		{"(DE-101)12345", "", ErrInvalidOCLC, false},
+		{"", "", ErrInvalidOCLC, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseOCLC(tt.s)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("ParseOCLC(%q) = %q, %v, want %q, %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+		if prefixed := oclcPrefixed(tt.s); prefixed != tt.wantPrefixed {
+			t.Errorf("oclcPrefixed(%q) = %v, want %v", tt.s, prefixed, tt.wantPrefixed)
+		}
+	}
+}
+
+func TestIdentifierScheme(t *testing.T) {
+	tests := []struct {
+		id   Identifier
+		want string
+	}{
+		{Identifier{Identifier: "9782070368228", IDType: IDTypePrint}, SchemeISBN13},
+		{Identifier{Identifier: "979100000000X", IDType: IDTypePrint}, ""},
+		{Identifier{Identifier: "207036822X", IDType: IDTypeOnline}, SchemeISBN10},
+		{Identifier{Identifier: "03785955", IDType: IDTypeOnline}, SchemeISSN},
+		{Identifier{Identifier: "03785954", IDType: IDTypeOnline}, ""},
+		{Identifier{Identifier: "03785955", IDType: IDTypeISSNL}, ""},
+		{Identifier{Identifier: "9782070368228", IDType: IDTypeOCLC}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.id.Scheme(); got != tt.want {
+			t.Errorf("Scheme of %+v = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestAddTitleIdentifiers(t *testing.T) {
+	tests := []struct {
+		name   string
+		record Record
+		want   []Identifier
+	}{
+		{
+			"DOI as title_id",
+			Record{TitleID: "10.1007/978-3-319-12345-6"},
+			[]Identifier{{Identifier: "10.1007/978-3-319-12345-6", IDType: IDTypeDOI}},
+		},
+		{
+			"OCLC number as title_id",
+			Record{TitleID: "(OCoLC)ocm00012345", PublisherName: "Cairn"},
+			[]Identifier{{Identifier: "12345", IDType: IDTypeOCLC}},
+		},
+		{
+			"number as title_id, proprietary",
+			Record{TitleID: "12345", PublisherName: "Cairn"},
+			[]Identifier{{Identifier: "Cairn:12345", IDType: IDTypeProprietary}},
+		},
+		{
+			"title_id without publisher",
+			Record{TitleID: "12345"},
+			nil,
+		},
+		{
+			"ISBN as title_id",
+			Record{
+				TitleID:       "978-2-07-036822-8",
+				PublisherName: "Gallimard",
+				Identifiers:   []Identifier{{Identifier: "9782070368228", IDType: IDTypePrint}},
+			},
+			[]Identifier{{Identifier: "9782070368228", IDType: IDTypePrint}},
+		},
+		{
+			"DOI in an escaped title_url",
+			Record{TitleURL: "https://link.example.com/doi/book/10.1007%2F978-3-319-12345-6?from=kbart"},
+			[]Identifier{{Identifier: "10.1007/978-3-319-12345-6", IDType: IDTypeDOI}},
+		},
+		{
+			"DOI as title_url",
+			Record{TitleURL: "https://doi.org/10.1000/XYZ123"},
+			[]Identifier{{Identifier: "10.1000/xyz123", IDType: IDTypeDOI}},
+		},
+		{
+			"WorldCat title_url, DOI as title_id",
+			Record{TitleID: "doi:10.1000/xyz123", TitleURL: "https://www.worldcat.org/title/some-title/oclc/12345678"},
+			[]Identifier{{Identifier: "10.1000/xyz123", IDType: IDTypeDOI}, {Identifier: "12345678", IDType: IDTypeOCLC}},
+		},
+		{
+			"same DOI twice",
+			Record{TitleID: "10.1000/xyz123", TitleURL: "https://doi.org/10.1000/xyz123"},
+			[]Identifier{{Identifier: "10.1000/xyz123", IDType: IDTypeDOI}},
+		},
+	}
+
+	for _, tt := range tests {
+		r := tt.record
+		r.AddTitleIdentifiers()
+		if !reflect.DeepEqual(r.Identifiers, tt.want) {
+			t.Errorf("%s: identifiers = %+v, want %+v", tt.name, r.Identifiers, tt.want)
+		}
+	}
+}
+
+func TestSetIdentifierKeys(t *testing.T) {
+	r := Record{Identifiers: []Identifier{
+		{Identifier: "12345678", IDType: IDTypePPN},
+		{Identifier: "12345678", IDType: IDTypeOCLC},
+		{Identifier: "9782070368228", IDType: IDTypePrint},
+		{Identifier: "10.1000/xyz123", IDType: IDTypeDOI},
+		{Identifier: "Cairn:12345", IDType: IDTypeProprietary},
+	}}
+	r.setIdentifierKeys()
+
+	// an OCLC number doesn't clash with a PPN made of the same digits
+	want := []string{"12345678", "OCLC:12345678", "9782070368228", "DOI:10.1000/xyz123", "Proprietary:Cairn:12345"}
+	for i, id := range r.Identifiers {
+		if id.Key != want[i] {
+			t.Errorf("key of %s %q = %q, want %q", IDTypeLabel(id.IDType), id.Identifier, id.Key, want[i])
+		}
+	}
+}
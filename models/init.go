@@ -2,11 +2,13 @@ package models
 
 import (
 	"log"
+	"strings"
 	"time"
 
 	"github.com/nicomo/abacaxi/config"
 	"github.com/nicomo/abacaxi/logger"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // FIXME: a package level var is not the right way to maintena a mongo session
@@ -17,10 +19,12 @@ import (
 var mgoSession *mgo.Session
 var conf config.Conf
 
-func init() {
+// Init connects to mongoDB with the info of the conf, and creates the collections & indexes the models need.
+// It's called once at startup, before the models are used: the pure functions of the package don't need it, e.g. in tests
+func Init(c config.Conf) {
 
-	// get the basic info for mongo
-	conf = config.GetConfig()
+	// the basic info for mongo
+	conf = c
 
 	// info required to get a session to mongoDB
 	mgoDBDialInfo := &mgo.DialInfo{
@@ -80,16 +84,35 @@ func init() {
 		logger.Error.Println(err)
 	}
 
-	// create an index on records identifiers
+	// identifiers are unique on their key, see Identifier.Key: the records saved before keys existed get theirs first
+	err = recordsSetIdentifierKeys(recordsColl)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	// the index is sparse: records without identifiers, e.g. those merged into another record, don't clash
+	recordKeyIndex := mgo.Index{
+		Key:        []string{"identifiers.key"},
+		Unique:     true,
+		DropDups:   false,
+		Background: true,
+		Sparse:     true,
+	}
+
+	err = ensureIndex(recordsColl, recordKeyIndex)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+
+	// create an index on records identifiers, for the lookups of ISBNs, ISSNs, PPNs, etc.
 	recordIDIndex := mgo.Index{
 		Key:        []string{"identifiers.identifier"},
-		Unique:     true,
+		Unique:     false,
 		DropDups:   false,
 		Background: true,
 		Sparse:     false,
 	}
 
-	err = recordsColl.EnsureIndex(recordIDIndex)
+	err = ensureIndex(recordsColl, recordIDIndex)
 	if err != nil {
 		logger.Error.Println(err)
 	}
@@ -106,4 +129,125 @@ func init() {
 	if err != nil {
 		logger.Error.Println(err)
 	}
+
+	// create an index on jobs status, used by the workers polling the queue
+	jobsColl := mgoSession.DB(conf.AuthDatabase).C("jobs")
+	jobStatusIndex := mgo.Index{
+		Key:        []string{"status", "datecreated"},
+		Unique:     false,
+		DropDups:   false,
+		Background: true,
+		Sparse:     false,
+	}
+	err = jobsColl.EnsureIndex(jobStatusIndex)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+
+	// the jobs which can't be queued twice are unique among the queued & running jobs, see Job.DedupKey.
+	// mgo.Index has no partial filter, hence the command
+	err = mgoSession.DB(conf.AuthDatabase).Run(bson.D{
+		{Name: "createIndexes", Value: "jobs"},
+		{Name: "indexes", Value: []bson.M{{
+			"key":    bson.M{"dedupkey": 1},
+			"name":   "dedupkey_queued_running",
+			"unique": true,
+			"partialFilterExpression": bson.M{
+				"dedupkey": bson.M{"$exists": true},
+				"status":   bson.M{"$lte": JobRunning},
+			},
+		}}},
+	}, nil)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+
+	// create indexes on revisions, to get the history of a record, the changes made by a batch or since a date
+	revisionsColl := mgoSession.DB(conf.AuthDatabase).C("revisions")
+	for _, key := range []string{"recordid", "reportid", "datecreated"} {
+		revisionIndex := mgo.Index{
+			Key:        []string{key},
+			Unique:     false,
+			DropDups:   false,
+			Background: true,
+			Sparse:     true,
+		}
+		err = revisionsColl.EnsureIndex(revisionIndex)
+		if err != nil {
+			logger.Error.Println(err)
+		}
+	}
+
+	// create indexes on snapshots, to list the snapshots of a target service, and read the titles of a snapshot
+	snapshotsColl := mgoSession.DB(conf.AuthDatabase).C("snapshots")
+	snapshotIndex := mgo.Index{
+		Key:        []string{"tsname", "datecreated"},
+		Unique:     false,
+		DropDups:   false,
+		Background: true,
+		Sparse:     false,
+	}
+	err = snapshotsColl.EnsureIndex(snapshotIndex)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+
+	snapshotHoldingsColl := mgoSession.DB(conf.AuthDatabase).C("snapshotholdings")
+	snapshotHoldingIndex := mgo.Index{
+		Key:        []string{"snapshotid", "publicationtitle"},
+		Unique:     false,
+		DropDups:   false,
+		Background: true,
+		Sparse:     false,
+	}
+	err = snapshotHoldingsColl.EnsureIndex(snapshotHoldingIndex)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+
+	// create a unique index on the pairs of duplicate candidates, so that a pair reviewed isn't queued again
+	duplicatesColl := mgoSession.DB(conf.AuthDatabase).C("duplicates")
+	duplicateIndex := mgo.Index{
+		Key:        []string{"recorda", "recordb"},
+		Unique:     true,
+		DropDups:   false,
+		Background: true,
+		Sparse:     false,
+	}
+	err = duplicatesColl.EnsureIndex(duplicateIndex)
+	if err != nil {
+		logger.Error.Println(err)
+	}
+}
+
+// ensureIndex creates an index, replacing an index on the same fields
+// which isn't unique (or sparse) the same way, e.g. the unique index identifiers were once given
+func ensureIndex(coll *mgo.Collection, index mgo.Index) error {
+	indexes, err := coll.Indexes()
+	if err != nil {
+		return err
+	}
+	for _, v := range indexes {
+		if strings.Join(v.Key, ",") == strings.Join(index.Key, ",") && (v.Unique != index.Unique || v.Sparse != index.Sparse) {
+			logger.Info.Printf("replacing the index %s", v.Name)
+			if err := coll.DropIndexName(v.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return coll.EnsureIndex(index)
+}
+
+// recordsSetIdentifierKeys sets the key of the identifiers of the records saved before identifiers had one
+func recordsSetIdentifierKeys(coll *mgo.Collection) error {
+	iter := coll.Find(bson.M{"identifiers": bson.M{"$elemMatch": bson.M{"key": bson.M{"$exists": false}}}}).Select(bson.M{"identifiers": 1}).Iter()
+	var record Record
+	for iter.Next(&record) {
+		record.setIdentifierKeys()
+		if err := coll.UpdateId(record.ID, bson.M{"$set": bson.M{"identifiers": record.Identifiers}}); err != nil {
+			logger.Error.Printf("couldn't set the identifier keys of the record %s: %v", record.ID.Hex(), err)
+		}
+		record = Record{}
+	}
+	return iter.Close()
 }
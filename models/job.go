@@ -0,0 +1,352 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	JobQueued    = iota // Status of a job: waiting for a worker
+	JobRunning          // Status of a job: being processed by a worker
+	JobDone             // Status of a job: completed
+	JobFailed           // Status of a job: failed, and no attempt left
+	JobCancelled        // Status of a job: cancelled by a user
+	JobPending          // Status of a job: on hold until a user confirms it, e.g. after an upload preview
+)
+
+const (
+	JobUpload          = iota // Types of job: parse an uploaded file & save the records
+	JobSudocRecords           // Types of job: retrieve Unimarc Records from Sudoc for a target service
+	JobRevertReport           // Types of job: undo the changes made to records by a batch operation
+	JobScheduledExport        // Types of job: run a scheduled export, writing the file to its destination
+	JobPurgeTrash             // Types of job: remove for good the records in the trash for longer than the retention period
+	JobFindDuplicates         // Types of job: look for the records which may be duplicates, for a review
+)
+
+var (
+	// ErrJobDuplicate is returned when the same job is already queued or running
+	ErrJobDuplicate = errors.New("the same job is already queued or running")
+	// ErrJobCancelled is returned by a job runner which stopped because the job was cancelled
+	ErrJobCancelled = errors.New("job cancelled")
+)
+
+// Job is a background batch operation, persisted in DB
+// so that it survives a restart of the server
+type Job struct {
+	ID              bson.ObjectId `bson:"_id"`
+	JobType         int
+	Status          int
+	TSName          string
+	User            string `bson:",omitempty"`
+	Progress        int    // number of items processed so far
+	Total           int    // number of items to process
+	Attempts        int
+	MaxAttempts     int
+	CancelRequested bool   `bson:",omitempty"`
+	DedupKey        string `bson:",omitempty"` // what a job which can't be queued twice is about, unique among the queued & running jobs
+	Error           string `bson:",omitempty"` // error returned by the last attempt
+	DateCreated     time.Time
+	DateStarted     time.Time `bson:",omitempty"`
+	DateEnded       time.Time `bson:",omitempty"`
+
+	// upload parameters
+	FilePath     string         `bson:",omitempty"`
+	FileType     string         `bson:",omitempty"`
+	Delimiter    string         `bson:",omitempty"`
+	CSVConf      map[string]int `bson:",omitempty"`
+	FullHoldings bool           `bson:",omitempty"` // the file lists all the titles of the target service
+
+	// sudoc parameters: the records selected, instead of those of the target service
+	RecordIDs []bson.ObjectId `bson:",omitempty"`
+
+	// revert parameters: the report of the batch operation to undo
+	ReportID bson.ObjectId `bson:",omitempty"`
+
+	// scheduled export parameters: the export to run
+	ScheduleID bson.ObjectId `bson:",omitempty"`
+}
+
+// dedupKey tells what a job is about, for the jobs which can't be queued or run twice at once:
+// the target service of a Sudoc crawl (or its records), the report of a revert, the scheduled export, or just the type of job.
+// It's empty for the other jobs, e.g. uploads
+func (job Job) dedupKey() string {
+	key := strconv.Itoa(job.JobType)
+	switch job.JobType {
+	case JobSudocRecords:
+		if len(job.RecordIDs) == 0 {
+			return key + ":" + job.TSName
+		}
+		// the same selection of records, in any order
+		var ids []string
+		for _, v := range job.RecordIDs {
+			ids = append(ids, v.Hex())
+		}
+		sort.Strings(ids)
+		h := sha1.Sum([]byte(strings.Join(ids, ",")))
+		return key + ":records:" + hex.EncodeToString(h[:])
+	case JobRevertReport:
+		return key + ":" + job.ReportID.Hex()
+	case JobScheduledExport:
+		return key + ":" + job.ScheduleID.Hex()
+	case JobPurgeTrash, JobFindDuplicates:
+		return key
+	}
+	return ""
+}
+
+// JobCreate queues a new job.
+// Sudoc jobs are refused if the same target service (or the same selection of records) is already queued or being crawled,
+// revert jobs if the same report is already being reverted,
+// scheduled exports if the previous run of the same export isn't over,
+// trash purges & searches for duplicates if one is already queued.
+// The unique index on DedupKey enforces it, so that 2 requests at once can't both queue the same job
+func JobCreate(job *Job) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	job.ID = bson.NewObjectId()
+	job.DedupKey = job.dedupKey()
+
+	// jobs are queued right away, unless they wait for a confirmation
+	if job.Status != JobPending {
+		job.Status = JobQueued
+	}
+	job.DateCreated = time.Now()
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = 1
+	}
+
+	if err := coll.Insert(job); err != nil {
+		if mgo.IsDup(err) {
+			return ErrJobDuplicate
+		}
+		return err
+	}
+	return nil
+}
+
+// JobGetByID retrieves a job given its mongodb ID
+func JobGetByID(ID string) (Job, error) {
+	job := Job{}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	if err := coll.FindId(bson.ObjectIdHex(ID)).One(&job); err != nil {
+		return job, err
+	}
+	return job, nil
+}
+
+// JobsGet retrieves jobs, most recent first.
+// status filters on the status of the job, use -1 for all
+func JobsGet(status, skip, limit int) ([]Job, int, error) {
+	var jobs []Job
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	qry := bson.M{}
+	if status >= 0 {
+		qry["status"] = status
+	}
+
+	total, err := coll.Find(qry).Count()
+	if err != nil {
+		return jobs, total, err
+	}
+
+	q := coll.Find(qry).Sort("-datecreated").Skip(skip)
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	if err := q.All(&jobs); err != nil {
+		return jobs, total, err
+	}
+	return jobs, total, nil
+}
+
+// JobClaim marks the oldest queued job as running and returns it.
+// Jobs for a target service which already has a running job of the same type are skipped.
+// Returns mgo.ErrNotFound if there's nothing to do
+func JobClaim() (Job, error) {
+	job := Job{}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	// which target services are busy, for each type of job
+	var running []Job
+	if err := coll.Find(bson.M{"status": JobRunning}).Select(bson.M{"jobtype": 1, "tsname": 1}).All(&running); err != nil {
+		return job, err
+	}
+	qry := bson.M{"status": JobQueued}
+	var busy []bson.M
+	for _, v := range running {
+		busy = append(busy, bson.M{"jobtype": v.JobType, "tsname": v.TSName})
+	}
+	if len(busy) > 0 {
+		qry["$nor"] = busy
+	}
+
+	change := mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{"status": JobRunning, "datestarted": time.Now()},
+			"$inc": bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}
+	if _, err := coll.Find(qry).Sort("datecreated").Apply(change, &job); err != nil {
+		return job, err
+	}
+	return job, nil
+}
+
+// JobProgress saves the progress of a running job.
+// Returns false if the job has been cancelled in the meantime and should stop
+func (job *Job) JobProgress(progress, total int) bool {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	job.Progress, job.Total = progress, total
+
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"progress": progress, "total": total}},
+		ReturnNew: true,
+	}
+	var saved Job
+	if _, err := coll.FindId(job.ID).Apply(change, &saved); err != nil {
+		// not worth stopping the job for
+		return true
+	}
+	return !saved.CancelRequested
+}
+
+// JobFinish records the outcome of a job run:
+// done, cancelled, queued again if attempts are left, failed otherwise
+func (job *Job) JobFinish(jobErr error) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	job.Error = ""
+	switch {
+	case jobErr == nil:
+		job.Status = JobDone
+	case jobErr == ErrJobCancelled:
+		job.Status = JobCancelled
+	case job.Attempts < job.MaxAttempts:
+		job.Status = JobQueued
+		job.Error = jobErr.Error()
+	default:
+		job.Status = JobFailed
+		job.Error = jobErr.Error()
+	}
+
+	update := bson.M{"status": job.Status, "error": job.Error}
+	if job.Status != JobQueued {
+		job.DateEnded = time.Now()
+		update["dateended"] = job.DateEnded
+	}
+
+	if err := coll.UpdateId(job.ID, bson.M{"$set": update}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// JobConfirm queues a job which was waiting for a confirmation
+func JobConfirm(ID string) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	err := coll.Update(bson.M{"_id": bson.ObjectIdHex(ID), "status": JobPending},
+		bson.M{"$set": bson.M{"status": JobQueued}})
+	if err == mgo.ErrNotFound {
+		return errors.New("this job is not waiting for a confirmation")
+	}
+	return err
+}
+
+// JobCancel cancels a queued or pending job right away,
+// or asks a running job to stop
+func JobCancel(ID string) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	objectID := bson.ObjectIdHex(ID)
+
+	err := coll.Update(bson.M{"_id": objectID, "status": bson.M{"$in": []int{JobQueued, JobPending}}},
+		bson.M{"$set": bson.M{"status": JobCancelled, "dateended": time.Now()}})
+	if err != mgo.ErrNotFound {
+		return err
+	}
+
+	err = coll.Update(bson.M{"_id": objectID, "status": JobRunning},
+		bson.M{"$set": bson.M{"cancelrequested": true}})
+	if err == mgo.ErrNotFound {
+		return errors.New("only queued, pending or running jobs can be cancelled")
+	}
+	return err
+}
+
+// JobRetry queues again a failed or cancelled job
+func JobRetry(ID string) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	job, err := JobGetByID(ID)
+	if err != nil {
+		return err
+	}
+	if job.Status != JobFailed && job.Status != JobCancelled {
+		return errors.New("only failed or cancelled jobs can be retried")
+	}
+
+	// we'd rather not run 2 crawls of the same package at once: the unique index on DedupKey refuses it
+	err = coll.UpdateId(job.ID, bson.M{
+		"$set":   bson.M{"status": JobQueued, "attempts": 0, "progress": 0},
+		"$unset": bson.M{"cancelrequested": "", "error": "", "dateended": ""},
+	})
+	if mgo.IsDup(err) {
+		return ErrJobDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// JobsRequeueRunning queues again the jobs which were running
+// when the server stopped. Returns the number of jobs requeued
+func JobsRequeueRunning() (int, error) {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getJobsColl()
+
+	// the interrupted attempt doesn't count
+	info, err := coll.UpdateAll(bson.M{"status": JobRunning}, bson.M{
+		"$set": bson.M{"status": JobQueued},
+		"$inc": bson.M{"attempts": -1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Updated, nil
+}
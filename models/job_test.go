@@ -0,0 +1,66 @@
+package models
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestJobDedupKey(t *testing.T) {
+	a, b, c := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+
+	tests := []struct {
+		name      string
+		job, same Job
+		other     Job
+	}{
+		{
+			"crawl of a target service",
+			Job{JobType: JobSudocRecords, TSName: "cairn"},
+			Job{JobType: JobSudocRecords, TSName: "cairn", User: "user2"},
+			Job{JobType: JobSudocRecords, TSName: "jstor"},
+		},
+		{
+			"crawl of records",
+			Job{JobType: JobSudocRecords, RecordIDs: []bson.ObjectId{a, b}},
+			Job{JobType: JobSudocRecords, RecordIDs: []bson.ObjectId{b, a}},
+			Job{JobType: JobSudocRecords, RecordIDs: []bson.ObjectId{a, c}},
+		},
+		{
+			"revert",
+			Job{JobType: JobRevertReport, ReportID: a},
+			Job{JobType: JobRevertReport, ReportID: a},
+			Job{JobType: JobRevertReport, ReportID: b},
+		},
+		{
+			"scheduled export",
+			Job{JobType: JobScheduledExport, ScheduleID: a},
+			Job{JobType: JobScheduledExport, ScheduleID: a},
+			Job{JobType: JobScheduledExport, ScheduleID: b},
+		},
+		{
+			"purge of the trash",
+			Job{JobType: JobPurgeTrash},
+			Job{JobType: JobPurgeTrash},
+			Job{JobType: JobFindDuplicates},
+		},
+	}
+
+	for _, tt := range tests {
+		key := tt.job.dedupKey()
+		if key == "" {
+			t.Errorf("%s: no key", tt.name)
+		}
+		if same := tt.same.dedupKey(); same != key {
+			t.Errorf("%s: keys %q & %q, want the same", tt.name, key, same)
+		}
+		if other := tt.other.dedupKey(); other == key {
+			t.Errorf("%s: key %q for another job", tt.name, other)
+		}
+	}
+
+	// uploads can be queued twice
+	if key := (Job{JobType: JobUpload, TSName: "cairn"}).dedupKey(); key != "" {
+		t.Errorf("key %q for an upload, want none", key)
+	}
+}
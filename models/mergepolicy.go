@@ -0,0 +1,385 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Types of sources records come from
+const (
+	SourceKbart  = "kbart"        // kbart file
+	SourceCSV    = "publishercsv" // publisher csv file
+	SourceSFX    = "sfxxml"       // sfx xml export
+	SourceManual = "manual"       // edited by a user, in the UI or through the API
+)
+
+// Merge rules, deciding the value of a field when a record is found again
+const (
+	RuleOverwrite = "overwrite" // the new value, even empty
+	RuleNonEmpty  = "nonempty"  // the new value, unless it's empty
+	RuleKeep      = "keep"      // the current value, unless it's empty
+	RuleUnion     = "union"     // both values
+	RulePrefer    = "prefer:"   // prefixes a source: the value from that source, once it gave one
+)
+
+// AllFields stands for all the fields of a record in a merge rule
+const AllFields = "*"
+
+// mergePolicyID is the ID of the merge policy in DB: there's only one
+const mergePolicyID = "mergepolicy"
+
+// MergeSources lists the types of sources, in the order they are displayed
+var MergeSources = []string{SourceKbart, SourceCSV, SourceSFX, SourceManual}
+
+// MergeFields lists the fields of a record merge rules apply to.
+// Identifiers and target services are always combined
+var MergeFields = []string{
+	"PublicationTitle",
+	"FirstAuthor",
+	"FirstEditor",
+	"PublisherName",
+	"PublicationType",
+	"TitleURL",
+	"TitleID",
+	"DateFirstIssueOnline",
+	"NumFirstVolOnline",
+	"NumFirstIssueOnline",
+	"DateLastIssueOnline",
+	"NumLastVolOnline",
+	"NumLastIssueOnline",
+	"EmbargoInfo",
+	"CoverageDepth",
+	"CoverageNotes",
+	"Notes",
+	"DateMonographPublishedPrint",
+	"DateMonographPublishedOnline",
+	"MonographVolume",
+	"MonographEdition",
+	"ParentPublicationTitleID",
+	"PrecedingPublicationTitleID",
+	"AccessType",
+}
+
+// MergeRule decides the value of a field when a record from a source is found again in DB
+type MergeRule struct {
+	Field  string // a field of MergeFields, or AllFields
+	Source string // a type of source, or empty for all of them
+	Rule   string
+}
+
+// MergePolicy is the set of merge rules. The most specific rule applies to a field:
+// the rule for the field & the source, then for the field, then for all fields & the source, then for all fields
+type MergePolicy struct {
+	ID          string `bson:"_id"`
+	Rules       []MergeRule
+	DateUpdated time.Time `bson:",omitempty"`
+	UpdatedBy   string    `bson:",omitempty"`
+}
+
+// MergeStats counts the decisions of the merge rules over a batch of records, e.g. for a report
+type MergeStats map[string]int
+
+// ErrMergeRuleInvalid is returned for a merge rule with an unknown field, source or rule
+var ErrMergeRuleInvalid = errors.New("unknown field, source or rule")
+
+// DefaultMergePolicy is the policy used until one is saved: manual edits are kept,
+// and no field is overwritten with an empty value
+func DefaultMergePolicy() MergePolicy {
+	return MergePolicy{
+		ID:    mergePolicyID,
+		Rules: []MergeRule{{Field: AllFields, Rule: RulePrefer + SourceManual}},
+	}
+}
+
+// MergeRuleNames lists the rules available, in the order they are displayed
+func MergeRuleNames() []string {
+	names := []string{RuleNonEmpty, RuleOverwrite, RuleKeep, RuleUnion}
+	for _, source := range MergeSources {
+		names = append(names, RulePrefer+source)
+	}
+	return names
+}
+
+// MergeSourceLabel returns a human readable label for a type of source
+func MergeSourceLabel(source string) string {
+	switch source {
+	case SourceKbart:
+		return "KBART"
+	case SourceCSV:
+		return "Publisher CSV"
+	case SourceSFX:
+		return "SFX XML"
+	case SourceManual:
+		return "Manual edit"
+	case "":
+		return "Any source"
+	}
+	return source
+}
+
+// MergeRuleLabel returns a human readable label for a rule
+func MergeRuleLabel(rule string) string {
+	switch rule {
+	case RuleOverwrite:
+		return "always take the new value"
+	case RuleNonEmpty:
+		return "never overwrite with empty"
+	case RuleKeep:
+		return "keep the current value, only fill empty fields"
+	case RuleUnion:
+		return "combine both values"
+	case RulePrefer + SourceManual:
+		return "keep manual edits"
+	}
+	if strings.HasPrefix(rule, RulePrefer) {
+		return "prefer " + MergeSourceLabel(strings.TrimPrefix(rule, RulePrefer))
+	}
+	return rule
+}
+
+// valid tells whether a merge rule has a known field, source & rule
+func (mr MergeRule) valid() bool {
+	fieldOK := mr.Field == AllFields
+	for _, f := range MergeFields {
+		fieldOK = fieldOK || f == mr.Field
+	}
+	sourceOK := mr.Source == ""
+	for _, s := range MergeSources {
+		sourceOK = sourceOK || s == mr.Source
+	}
+	ruleOK := false
+	for _, r := range MergeRuleNames() {
+		ruleOK = ruleOK || r == mr.Rule
+	}
+	return fieldOK && sourceOK && ruleOK
+}
+
+// ruleFor returns the rule applying to a field for a source.
+// Without any rule, a field is never overwritten with an empty value
+func (p MergePolicy) ruleFor(field, source string) string {
+	candidates := [][2]string{{field, source}, {field, ""}, {AllFields, source}, {AllFields, ""}}
+	for _, c := range candidates {
+		for _, mr := range p.Rules {
+			if mr.Field == c[0] && mr.Source == c[1] {
+				return mr.Rule
+			}
+		}
+	}
+	return RuleNonEmpty
+}
+
+// mergeValue decides the value of a field from the value incoming, from a source,
+// and the current value, from another source. It tells whether the value kept is the new one
+func mergeValue(rule, incoming, current, source, currentSource string) (string, bool) {
+	switch {
+	case rule == RuleOverwrite:
+		return incoming, true
+	case rule == RuleKeep:
+		if current == "" {
+			return incoming, true
+		}
+		return current, false
+	case rule == RuleUnion:
+		if incoming == "" || strings.Contains(current, incoming) {
+			return current, false
+		}
+		if current == "" {
+			return incoming, true
+		}
+		return current + " ; " + incoming, true
+	case strings.HasPrefix(rule, RulePrefer):
+		preferred := strings.TrimPrefix(rule, RulePrefer)
+		if incoming == "" {
+			return current, false
+		}
+		if source != preferred && currentSource == preferred && current != "" {
+			return current, false
+		}
+		return incoming, true
+	}
+
+	// RuleNonEmpty
+	if incoming == "" {
+		return current, false
+	}
+	return incoming, true
+}
+
+// mergeFields merges the fields of an incoming record from a source into the record in DB, following the policy.
+// r keeps the values decided, and the source of each of them; the rule which decided each change is noted,
+// for the revision. It returns the decisions made, when the 2 values differed
+func (p MergePolicy) mergeFields(r *Record, current Record, source string) MergeStats {
+	stats := make(MergeStats)
+
+	sources := make(map[string]string)
+	for k, v := range current.FieldSources {
+		sources[k] = v
+	}
+	r.mergeRules = make(map[string]string)
+
+	vr, vc := reflect.ValueOf(r).Elem(), reflect.ValueOf(current)
+	for _, field := range MergeFields {
+		incoming, currentValue := vr.FieldByName(field).String(), vc.FieldByName(field).String()
+		if incoming == currentValue {
+			continue
+		}
+
+		rule := p.ruleFor(field, source)
+		value, fromIncoming := mergeValue(rule, incoming, currentValue, source, sources[field])
+		vr.FieldByName(field).SetString(value)
+		if fromIncoming && source != "" {
+			sources[field] = source
+		}
+
+		outcome := "kept the current value"
+		if value != currentValue {
+			outcome = "updated"
+			r.mergeRules[field] = MergeRuleLabel(rule)
+		}
+		stats[fmt.Sprintf("%s: %s (%s)", field, outcome, MergeRuleLabel(rule))]++
+	}
+
+	if len(sources) > 0 {
+		r.FieldSources = sources
+	}
+	return stats
+}
+
+// setFieldSources notes the source of the values of a new record
+func (r *Record) setFieldSources(source string) {
+	if source == "" {
+		return
+	}
+	v := reflect.ValueOf(r).Elem()
+	for _, field := range MergeFields {
+		if v.FieldByName(field).String() == "" {
+			continue
+		}
+		if r.FieldSources == nil {
+			r.FieldSources = make(map[string]string)
+		}
+		r.FieldSources[field] = source
+	}
+}
+
+// SetManualSources notes the fields changed by a user since the version before of the record,
+// so that the rules preferring manual edits keep them
+func (r *Record) SetManualSources(before Record) {
+	sources := make(map[string]string)
+	for k, v := range before.FieldSources {
+		sources[k] = v
+	}
+
+	vr, vb := reflect.ValueOf(r).Elem(), reflect.ValueOf(before)
+	for _, field := range MergeFields {
+		if vr.FieldByName(field).String() != vb.FieldByName(field).String() {
+			sources[field] = SourceManual
+		}
+	}
+
+	r.FieldSources = nil
+	if len(sources) > 0 {
+		r.FieldSources = sources
+	}
+}
+
+// Add counts the decisions of another batch
+func (s MergeStats) Add(other MergeStats) {
+	for k, n := range other {
+		s[k] += n
+	}
+}
+
+// Lines returns the decisions counted, one per line, in field order
+func (s MergeStats) Lines() []string {
+	var lines []string
+	for k, n := range s {
+		lines = append(lines, fmt.Sprintf("%s: %d records", k, n))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// MergePolicyGet retrieves the merge policy, or the default one if none was saved
+func MergePolicyGet() (MergePolicy, error) {
+	var p MergePolicy
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getMergePolicyColl()
+
+	err := coll.FindId(mergePolicyID).One(&p)
+	if err == mgo.ErrNotFound {
+		return DefaultMergePolicy(), nil
+	}
+	if err != nil {
+		return DefaultMergePolicy(), err
+	}
+	return p, nil
+}
+
+// mergePolicySave saves the merge policy, its rules sorted by field & source
+func mergePolicySave(p MergePolicy, src ChangeSource) error {
+	sort.SliceStable(p.Rules, func(i, j int) bool {
+		if p.Rules[i].Field != p.Rules[j].Field {
+			return p.Rules[i].Field < p.Rules[j].Field
+		}
+		return p.Rules[i].Source < p.Rules[j].Source
+	})
+	p.ID = mergePolicyID
+	p.DateUpdated = time.Now()
+	p.UpdatedBy = src.User
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getMergePolicyColl()
+
+	_, err := coll.UpsertId(mergePolicyID, p)
+	return err
+}
+
+// MergePolicySetRule adds a rule to the merge policy, replacing the rule for the same field & source if any
+func MergePolicySetRule(mr MergeRule, src ChangeSource) error {
+	if !mr.valid() {
+		return ErrMergeRuleInvalid
+	}
+
+	p, err := MergePolicyGet()
+	if err != nil {
+		return err
+	}
+
+	var rules []MergeRule
+	for _, existing := range p.Rules {
+		if existing.Field != mr.Field || existing.Source != mr.Source {
+			rules = append(rules, existing)
+		}
+	}
+	p.Rules = append(rules, mr)
+
+	return mergePolicySave(p, src)
+}
+
+// MergePolicyDeleteRule removes the rule for a field & source from the merge policy
+func MergePolicyDeleteRule(field, source string, src ChangeSource) error {
+	p, err := MergePolicyGet()
+	if err != nil {
+		return err
+	}
+
+	var rules []MergeRule
+	for _, existing := range p.Rules {
+		if existing.Field != field || existing.Source != source {
+			rules = append(rules, existing)
+		}
+	}
+	p.Rules = rules
+
+	return mergePolicySave(p, src)
+}
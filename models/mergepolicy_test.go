@@ -0,0 +1,194 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeValue(t *testing.T) {
+	preferManual := RulePrefer + SourceManual
+
+	tests := []struct {
+		rule          string
+		incoming      string
+		current       string
+		source        string
+		currentSource string
+		want          string
+		wantIncoming  bool
+	}{
+		{RuleOverwrite, "new", "current", SourceKbart, SourceManual, "new", true},
+		{RuleOverwrite, "", "current", SourceKbart, SourceKbart, "", true},
+
+		{RuleNonEmpty, "new", "current", SourceKbart, SourceManual, "new", true},
+		{RuleNonEmpty, "", "current", SourceKbart, SourceKbart, "current", false},
+		{RuleNonEmpty, "new", "", SourceKbart, "", "new", true},
+
+		{RuleKeep, "new", "current", SourceKbart, SourceKbart, "current", false},
+		{RuleKeep, "new", "", SourceKbart, SourceKbart, "new", true},
+		{RuleKeep, "", "", SourceKbart, "", "", true},
+
+		{RuleUnion, "b", "a", SourceKbart, SourceCSV, "a ; b", true},
+		{RuleUnion, "b", "a ; b", SourceKbart, SourceCSV, "a ; b", false},
+		{RuleUnion, "", "a", SourceKbart, SourceCSV, "a", false},
+		{RuleUnion, "b", "", SourceKbart, SourceCSV, "b", true},
+
+		// a manual edit is kept, whatever the files say
+		{preferManual, "new", "edited", SourceKbart, SourceManual, "edited", false},
+		{preferManual, "new", "current", SourceKbart, SourceKbart, "new", true},
+		{preferManual, "new", "current", SourceKbart, "", "new", true},
+		{preferManual, "edited again", "edited", SourceManual, SourceManual, "edited again", true},
+		{preferManual, "edited", "current", SourceManual, SourceKbart, "edited", true},
+		{preferManual, "", "current", SourceKbart, SourceKbart, "current", false},
+		{preferManual, "new", "", SourceKbart, SourceManual, "new", true},
+		{RulePrefer + SourceSFX, "new", "from sfx", SourceKbart, SourceSFX, "from sfx", false},
+	}
+
+	for _, tt := range tests {
+		got, fromIncoming := mergeValue(tt.rule, tt.incoming, tt.current, tt.source, tt.currentSource)
+		if got != tt.want || fromIncoming != tt.wantIncoming {
+			t.Errorf("mergeValue(%q, %q, %q, %q, %q) = %q, %v, want %q, %v",
+				tt.rule, tt.incoming, tt.current, tt.source, tt.currentSource, got, fromIncoming, tt.want, tt.wantIncoming)
+		}
+	}
+}
+
+func TestRuleFor(t *testing.T) {
+	p := MergePolicy{Rules: []MergeRule{
+		{Field: AllFields, Rule: RulePrefer + SourceManual},
+		{Field: AllFields, Source: SourceSFX, Rule: RuleKeep},
+		{Field: "TitleURL", Rule: RuleOverwrite},
+		{Field: "TitleURL", Source: SourceCSV, Rule: RuleUnion},
+	}}
+
+	tests := []struct {
+		field, source string
+		want          string
+	}{
+		{"TitleURL", SourceCSV, RuleUnion},
+		{"TitleURL", SourceKbart, RuleOverwrite},
+		{"TitleURL", SourceSFX, RuleOverwrite},
+		{"PublicationTitle", SourceSFX, RuleKeep},
+		{"PublicationTitle", SourceKbart, RulePrefer + SourceManual},
+		{"PublicationTitle", "", RulePrefer + SourceManual},
+	}
+	for _, tt := range tests {
+		if got := p.ruleFor(tt.field, tt.source); got != tt.want {
+			t.Errorf("ruleFor(%q, %q) = %q, want %q", tt.field, tt.source, got, tt.want)
+		}
+	}
+
+	if got := (MergePolicy{}).ruleFor("TitleURL", SourceKbart); got != RuleNonEmpty {
+		t.Errorf("ruleFor without rules = %q, want %q", got, RuleNonEmpty)
+	}
+}
+
+func TestMergeRuleValid(t *testing.T) {
+	tests := []struct {
+		mr   MergeRule
+		want bool
+	}{
+		{MergeRule{Field: AllFields, Rule: RuleKeep}, true},
+		{MergeRule{Field: "TitleURL", Source: SourceKbart, Rule: RulePrefer + SourceManual}, true},
+		{MergeRule{Field: "Identifiers", Rule: RuleKeep}, false},
+		{MergeRule{Field: "TitleURL", Source: "marc", Rule: RuleKeep}, false},
+		{MergeRule{Field: "TitleURL", Rule: "newest"}, false},
+		{MergeRule{Field: "TitleURL", Rule: RulePrefer + "marc"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.mr.valid(); got != tt.want {
+			t.Errorf("%+v valid = %v, want %v", tt.mr, got, tt.want)
+		}
+	}
+}
+
+func TestMergeFields(t *testing.T) {
+	current := Record{
+		PublicationTitle: "Edited title",
+		TitleURL:         "http://old.example.com",
+		Notes:            "a note",
+		FieldSources:     map[string]string{"PublicationTitle": SourceManual, "TitleURL": SourceKbart, "Notes": SourceKbart},
+	}
+	incoming := Record{
+		PublicationTitle: "Title from the file",
+		TitleURL:         "http://new.example.com",
+		FirstAuthor:      "Dupont, Jean",
+	}
+
+	stats := DefaultMergePolicy().mergeFields(&incoming, current, SourceKbart)
+
+	want := Record{
+		PublicationTitle: "Edited title",
+		TitleURL:         "http://new.example.com",
+		FirstAuthor:      "Dupont, Jean",
+		Notes:            "a note",
+	}
+	for _, field := range []string{"PublicationTitle", "TitleURL", "FirstAuthor", "Notes"} {
+		got := reflect.ValueOf(incoming).FieldByName(field).String()
+		if expected := reflect.ValueOf(want).FieldByName(field).String(); got != expected {
+			t.Errorf("%s = %q, want %q", field, got, expected)
+		}
+	}
+
+	wantSources := map[string]string{
+		"PublicationTitle": SourceManual,
+		"TitleURL":         SourceKbart,
+		"FirstAuthor":      SourceKbart,
+		"Notes":            SourceKbart,
+	}
+	if !reflect.DeepEqual(incoming.FieldSources, wantSources) {
+		t.Errorf("sources = %v, want %v", incoming.FieldSources, wantSources)
+	}
+	// the current sources aren't changed
+	if current.FieldSources["FirstAuthor"] != "" {
+		t.Errorf("the sources of the current record were changed: %v", current.FieldSources)
+	}
+
+	label := MergeRuleLabel(RulePrefer + SourceManual)
+	wantStats := MergeStats{
+		"PublicationTitle: kept the current value (" + label + ")": 1,
+		"TitleURL: updated (" + label + ")":                        1,
+		"FirstAuthor: updated (" + label + ")":                     1,
+		"Notes: kept the current value (" + label + ")":            1,
+	}
+	if !reflect.DeepEqual(stats, wantStats) {
+		t.Errorf("stats = %v, want %v", stats, wantStats)
+	}
+
+	wantRules := map[string]string{"TitleURL": label, "FirstAuthor": label}
+	if !reflect.DeepEqual(incoming.mergeRules, wantRules) {
+		t.Errorf("rules of the changes = %v, want %v", incoming.mergeRules, wantRules)
+	}
+}
+
+func TestRecordsMerge(t *testing.T) {
+	coverage := &PackageCoverage{DateFirstIssueOnline: "2001"}
+	current := Record{
+		ID:             "123456789012",
+		Deleted:        true,
+		DeletedBy:      "user1",
+		RecordUnimarc:  "<record/>",
+		Identifiers:    []Identifier{{Identifier: "03785955", IDType: IDTypePrint}},
+		TargetServices: []TargetService{{Name: "cairn", Coverage: coverage}, {Name: "jstor"}},
+	}
+	incoming := Record{
+		PublicationTitle: "Title",
+		Identifiers:      []Identifier{{Identifier: "14764687", IDType: IDTypeOnline}},
+		TargetServices:   []TargetService{{Name: "cairn"}},
+	}
+
+	recordsMerge(&incoming, current, SourceKbart, DefaultMergePolicy())
+
+	if incoming.ID != current.ID || incoming.RecordUnimarc != current.RecordUnimarc {
+		t.Errorf("ID & marc records aren't kept: %q %q", incoming.ID, incoming.RecordUnimarc)
+	}
+	if !incoming.Deleted || incoming.DeletedBy != "user1" {
+		t.Errorf("the trash state isn't kept: deleted %v by %q", incoming.Deleted, incoming.DeletedBy)
+	}
+	if len(incoming.Identifiers) != 2 {
+		t.Errorf("identifiers = %v, want both", incoming.Identifiers)
+	}
+	if len(incoming.TargetServices) != 2 || incoming.TargetServices[0].Coverage != coverage {
+		t.Errorf("target services = %+v, want both, with the current coverage", incoming.TargetServices)
+	}
+}
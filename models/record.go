@@ -1,18 +1,27 @@
 package models
 
 import (
+	"errors"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/nicomo/abacaxi/issn"
 	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/marc"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
 const (
-	IDTypeOnline = iota // Types of Identifiers: mostly online ISBN / ISSN
-	IDTypePrint         // Types of Identifiers: mostly print ISBN / ISSN
-	IDTypePPN           // Types of Identifiers: unimarc record ID in Sudoc catalog
-	IDTypeSFX           // Types of Identifiers: ID in Ex Libris' SFX Open resolver
+	IDTypeOnline      = iota // Types of Identifiers: mostly online ISBN / ISSN
+	IDTypePrint              // Types of Identifiers: mostly print ISBN / ISSN
+	IDTypePPN                // Types of Identifiers: unimarc record ID in Sudoc catalog
+	IDTypeSFX                // Types of Identifiers: ID in Ex Libris' SFX Open resolver
+	IDTypeISSNL              // Types of Identifiers: linking ISSN, grouping the print & online ISSNs of a serial
+	IDTypeDOI                // Types of Identifiers: Digital Object Identifier, in lower case
+	IDTypeOCLC               // Types of Identifiers: OCLC number, ID of the WorldCat record
+	IDTypeProprietary        // Types of Identifiers: title ID of a publisher, prefixed with the publisher, e.g. Springer:978-3-319
 )
 
 // Record stores a full record for a resource
@@ -30,19 +39,23 @@ type Record struct {
 	DateMonographPublishedPrint  string    `bson:",omitempty"`
 	DateUpdated                  time.Time `bson:",omitempty"`
 	Deleted                      bool
-	EmbargoInfo                  string       `bson:",omitempty"`
-	FirstAuthor                  string       `bson:",omitempty"`
-	FirstEditor                  string       `bson:",omitempty"`
-	Identifiers                  []Identifier `bson:",omitempty"`
-	MonographEdition             string       `bson:",omitempty"`
-	MonographVolume              string       `bson:",omitempty"`
-	Notes                        string       `bson:",omitempty"`
-	NumFirstIssueOnline          string       `bson:",omitempty"`
-	NumFirstVolOnline            string       `bson:",omitempty"`
-	NumLastIssueOnline           string       `bson:",omitempty"`
-	NumLastVolOnline             string       `bson:",omitempty"`
-	ParentPublicationTitleID     string       `bson:",omitempty"`
-	PrecedingPublicationTitleID  string       `bson:",omitempty"`
+	DateDeleted                  time.Time         `bson:",omitempty"`
+	DeletedBy                    string            `bson:",omitempty"`
+	MergedInto                   bson.ObjectId     `bson:",omitempty"` // the record this one was merged into, as a duplicate
+	EmbargoInfo                  string            `bson:",omitempty"`
+	FieldSources                 map[string]string `bson:",omitempty"` // the type of source each field value comes from, for the merge policy
+	FirstAuthor                  string            `bson:",omitempty"`
+	FirstEditor                  string            `bson:",omitempty"`
+	Identifiers                  []Identifier      `bson:",omitempty"`
+	MonographEdition             string            `bson:",omitempty"`
+	MonographVolume              string            `bson:",omitempty"`
+	Notes                        string            `bson:",omitempty"`
+	NumFirstIssueOnline          string            `bson:",omitempty"`
+	NumFirstVolOnline            string            `bson:",omitempty"`
+	NumLastIssueOnline           string            `bson:",omitempty"`
+	NumLastVolOnline             string            `bson:",omitempty"`
+	ParentPublicationTitleID     string            `bson:",omitempty"`
+	PrecedingPublicationTitleID  string            `bson:",omitempty"`
 	PublicationTitle             string
 	PublicationType              string          `bson:",omitempty"`
 	PublisherName                string          `bson:",omitempty"`
@@ -51,15 +64,160 @@ type Record struct {
 	TargetServices               []TargetService `bson:",omitempty"` // this is the name of the package in SFX, e.g. CAIRN QSJ
 	TitleID                      string          `bson:",omitempty"`
 	TitleURL                     string          `bson:",omitempty"`
+
+	mergeRules map[string]string // the merge rule which decided the value of each field changed, for the revision
 }
 
 // Identifier embedded in an record
 type Identifier struct {
 	Identifier string `bson:",omitempty"`
 	IDType     int
+	Key        string `bson:",omitempty" json:"-"` // the value identifiers are unique on, set when the record is saved, see matchKey
+}
+
+// RecordsFilter holds the optional conditions used to select records
+// nil / empty values mean the condition is not applied
+type RecordsFilter struct {
+	TSName      string // records belonging to this target service
+	Text        string // full text search on the records text index
+	Acquired    *bool
+	Active      *bool
+	HasUnimarc  *bool
+	HasPPN      *bool
+	IDs         []bson.ObjectId // only these records, e.g. a single record export
+	Since       time.Time       // records created or updated since then, e.g. since the last scheduled export
+	NewSince    time.Time       // records created since then, or attached to the target service: see AttachedIDs
+	ModSince    time.Time       // records created before then, and updated since, but not attached to the target service since
+	AttachedIDs []bson.ObjectId // with NewSince & ModSince: records created before then, attached to the target service since
+	Trash       bool            // deleted records, instead of the others
+}
+
+// String describes the conditions of a RecordsFilter, e.g. for a report
+func (f RecordsFilter) String() string {
+	var conditions []string
+	describe := func(b *bool, yes, no string) {
+		if b == nil {
+			return
+		}
+		if *b {
+			conditions = append(conditions, yes)
+		} else {
+			conditions = append(conditions, no)
+		}
+	}
+	describe(f.Active, "active", "inactive")
+	describe(f.Acquired, "acquired", "not acquired")
+	describe(f.HasUnimarc, "with Unimarc", "without Unimarc")
+	describe(f.HasPPN, "with PPN", "without PPN")
+	if f.Text != "" {
+		conditions = append(conditions, "matching \""+f.Text+"\"")
+	}
+	if len(f.IDs) > 0 {
+		conditions = append(conditions, strconv.Itoa(len(f.IDs))+" selected")
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "changed since "+f.Since.Format("2006-01-02 15:04"))
+	}
+	if !f.NewSince.IsZero() {
+		conditions = append(conditions, "new since "+f.NewSince.Format("2006-01-02 15:04"))
+	}
+	if !f.ModSince.IsZero() {
+		conditions = append(conditions, "modified since "+f.ModSince.Format("2006-01-02 15:04"))
+	}
+	if f.Trash {
+		conditions = append(conditions, "in the trash")
+	}
+
+	if len(conditions) == 0 {
+		return "all records"
+	}
+	return strings.Join(conditions, ", ")
+}
+
+// matches tells whether a record meets the conditions of a RecordsFilter on target service & booleans,
+// e.g. for records which are no longer in DB
+func (f RecordsFilter) matches(r Record) bool {
+	is := func(b *bool, v bool) bool {
+		return b == nil || *b == v
+	}
+	inTS := f.TSName == ""
+	for _, ts := range r.TargetServices {
+		if ts.Name == f.TSName {
+			inTS = true
+		}
+	}
+	return inTS &&
+		is(f.Active, r.Active) &&
+		is(f.Acquired, r.Acquired) &&
+		is(f.HasUnimarc, r.RecordUnimarc != "") &&
+		is(f.HasPPN, len(r.GetPPN()) > 0)
+}
+
+// query builds the mongo selector for a RecordsFilter
+func (f RecordsFilter) query() bson.M {
+	qry := bson.M{"deleted": bson.M{"$ne": true}}
+	if f.Trash {
+		qry["deleted"] = true
+	}
+	if f.TSName != "" {
+		qry["targetservices.name"] = f.TSName
+	}
+	if f.Text != "" {
+		qry["$text"] = bson.M{"$search": f.Text}
+	}
+	if f.Acquired != nil {
+		// acquired is omitted from the document when false
+		if *f.Acquired {
+			qry["acquired"] = true
+		} else {
+			qry["acquired"] = bson.M{"$ne": true}
+		}
+	}
+	if f.Active != nil {
+		qry["active"] = *f.Active
+	}
+	if f.HasUnimarc != nil {
+		qry["recordunimarc"] = bson.M{"$exists": *f.HasUnimarc}
+	}
+	if len(f.IDs) > 0 {
+		qry["_id"] = bson.M{"$in": f.IDs}
+	}
+
+	// conditions on dates may apply to the same fields
+	var dates []bson.M
+	if !f.Since.IsZero() {
+		dates = append(dates, bson.M{"$or": []bson.M{
+			{"datecreated": bson.M{"$gte": f.Since}},
+			{"dateupdated": bson.M{"$gte": f.Since}},
+		}})
+	}
+	if !f.NewSince.IsZero() {
+		dates = append(dates, bson.M{"$or": []bson.M{
+			{"datecreated": bson.M{"$gte": f.NewSince}},
+			{"_id": bson.M{"$in": f.AttachedIDs}},
+		}})
+	}
+	if !f.ModSince.IsZero() {
+		dates = append(dates, bson.M{
+			"datecreated": bson.M{"$lt": f.ModSince},
+			"dateupdated": bson.M{"$gte": f.ModSince},
+			"_id":         bson.M{"$nin": f.AttachedIDs},
+		})
+	}
+	if len(dates) > 0 {
+		qry["$and"] = dates
+	}
+	if f.HasPPN != nil {
+		if *f.HasPPN {
+			qry["identifiers.idtype"] = IDTypePPN
+		} else {
+			qry["identifiers.idtype"] = bson.M{"$ne": IDTypePPN}
+		}
+	}
+	return qry
 }
 
-func (r Record) create() error {
+func (r *Record) create(src ChangeSource) error {
 	// Request a socket connection from the session to process our query.
 	mgoSession := mgoSession.Copy()
 	defer mgoSession.Close()
@@ -67,15 +225,30 @@ func (r Record) create() error {
 	// collection records
 	coll := getRecordsColl()
 
+	// we set the ID ourselves so that the caller knows it
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	if r.DateCreated.IsZero() {
+		r.DateCreated = time.Now()
+	}
+	r.setIdentifierKeys()
+
 	err := coll.Insert(r)
 	if err != nil {
 		return err
 	}
+
+	rev := newRevision(r.ID, RevisionCreated, src)
+	rev.Changes = recordsDiff(Record{}, *r)
+	rev.create()
+
 	return nil
 }
 
-// RecordDelete deletes a single ebook from DB
-func RecordDelete(ID string) error {
+// RecordDelete puts a single ebook in the trash: it's marked as deleted, by whom and when,
+// and hidden from listings & searches until it's restored or purged, see RecordRestore & RecordsPurge
+func RecordDelete(ID string, src ChangeSource) error {
 
 	// Request a socket connection from the session to process our query.
 	mgoSession := mgoSession.Copy()
@@ -84,19 +257,98 @@ func RecordDelete(ID string) error {
 	// collection records
 	coll := getRecordsColl()
 
-	// cast ID as ObjectID
-	objectID := bson.ObjectIdHex(ID)
+	// keep the record in its last revision, so that it can be restored
+	before, err := RecordGetByID(ID)
+	if err != nil {
+		return err
+	}
+	if before.Deleted {
+		return ErrRecordDeleted
+	}
 
-	// delete record
-	qry := bson.M{"_id": objectID}
-	err := coll.Remove(qry)
+	// mark record as deleted
+	deleted := before
+	deleted.Deleted = true
+	deleted.DateDeleted = time.Now()
+	deleted.DeletedBy = src.User
+	err = coll.UpdateId(before.ID, bson.M{"$set": bson.M{
+		"deleted":     true,
+		"datedeleted": deleted.DateDeleted,
+		"deletedby":   deleted.DeletedBy,
+	}})
 	if err != nil {
 		return err
 	}
 
+	rev := newRevision(before.ID, RevisionDeleted, src)
+	rev.Changes = recordsDiff(before, deleted)
+	rev.Before = &before
+	rev.create()
+
 	return nil
 }
 
+// ErrRecordDeleted is returned when deleting a record already in the trash
+var ErrRecordDeleted = errors.New("the record is already in the trash")
+
+// ErrRecordInTrash is returned when saving a record whose identifiers match a record in the trash:
+// the record in the trash is left as it is, it must be restored first
+var ErrRecordInTrash = errors.New("a record with the same identifiers is in the trash")
+
+// ErrRecordNotDeleted is returned when restoring a record which isn't in the trash
+var ErrRecordNotDeleted = errors.New("the record is not in the trash")
+
+// ErrRecordMerged is returned when restoring a record merged into another one: that record has its identifiers
+var ErrRecordMerged = errors.New("the record was merged into another record, which has its identifiers")
+
+// RecordRestore takes a record out of the trash.
+// A record merged into another one as a duplicate can't be restored
+func RecordRestore(ID string, src ChangeSource) error {
+	record, err := RecordGetByID(ID)
+	if err != nil {
+		return err
+	}
+	if !record.Deleted {
+		return ErrRecordNotDeleted
+	}
+	if record.MergedInto != "" {
+		return ErrRecordMerged
+	}
+
+	record.Deleted = false
+	record.DateDeleted = time.Time{}
+	record.DeletedBy = ""
+	return record.RecordUpdate(src)
+}
+
+// RecordsPurge removes for good the records put in the trash before a given time.
+// Their history is kept. Returns the number of records removed
+func RecordsPurge(before time.Time) (int, error) {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRecordsColl()
+
+	info, err := coll.RemoveAll(bson.M{"deleted": true, "datedeleted": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// RecordsGetTrash retrieves the records in the trash, most recently deleted first.
+// skip & limit are used to paginate
+func RecordsGetTrash(skip, limit int) ([]Record, error) {
+	var result []Record
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRecordsColl()
+
+	q := coll.Find(RecordsFilter{Trash: true}.query()).Sort("-datedeleted").Skip(skip).Limit(limit)
+	err := q.All(&result)
+	return result, err
+}
+
 // RecordGetByID retrieves a record given its mongodb ID
 func RecordGetByID(ID string) (Record, error) {
 	record := Record{}
@@ -120,7 +372,25 @@ func RecordGetByID(ID string) (Record, error) {
 	return record, nil
 }
 
-// RecordGetByIdentifiers searches for a record using the identifiers (ISSN, ISBN, PPN, etc)
+// issnTerms returns the values an ISSN identifier matches: the ISSN in its canonical form, and its ISSN-L.
+// Any other identifier only matches itself
+func issnTerms(id Identifier) []string {
+	if id.IDType != IDTypePrint && id.IDType != IDTypeOnline && id.IDType != IDTypeISSNL {
+		return []string{id.Identifier}
+	}
+	i, err := issn.Parse(id.Identifier)
+	if err != nil {
+		return []string{id.Identifier}
+	}
+	if l := issn.Linking(i); l != i {
+		return []string{string(i), string(l)}
+	}
+	return []string{string(i)}
+}
+
+// RecordGetByIdentifiers searches for a record using the identifiers (ISSN, ISBN, PPN, DOI, etc).
+// ISSNs also match the records having the same ISSN-L, e.g. the print & online versions of a serial.
+// DOIs, OCLC numbers & proprietary IDs only match identifiers of the same type (and publisher)
 func RecordGetByIdentifiers(identifiers []Identifier) (Record, error) {
 	record := Record{}
 
@@ -134,8 +404,7 @@ func RecordGetByIdentifiers(identifiers []Identifier) (Record, error) {
 	// selectorQry
 	var qryIDs []bson.M
 	for i := 0; i < len(identifiers); i++ {
-		sTerm := bson.M{"identifiers.identifier": identifiers[i].Identifier}
-		qryIDs = append(qryIDs, sTerm)
+		qryIDs = append(qryIDs, identifiers[i].matchTerms()...)
 	}
 	qry := bson.M{
 		"$or": qryIDs,
@@ -160,39 +429,104 @@ func (r Record) GetPPN() []string {
 	return PPN
 }
 
+// Unimarc parses the Unimarc record retrieved from Sudoc, if any
+func (r Record) Unimarc() (marc.Record, error) {
+	if r.RecordUnimarc == "" {
+		return marc.Record{}, marc.ErrNoRecord
+	}
+	return marc.Parse(r.RecordUnimarc)
+}
+
+// Marc21 parses the MARC21 record, if any.
+// Records retrieved from Sudoc before MARC21 was stored get it derived from their Unimarc record
+func (r Record) Marc21() (marc.Record, error) {
+	if r.RecordMarc21 == "" {
+		unimarc, err := r.Unimarc()
+		if err != nil {
+			return unimarc, err
+		}
+		return marc.ToMarc21(unimarc), nil
+	}
+	return marc.Parse(r.RecordMarc21)
+}
+
 // RecordUpdate saves an updated record struct to DB
-func (r *Record) RecordUpdate() error {
+// and the changes made as a new revision of the record
+func (r *Record) RecordUpdate(src ChangeSource) error {
+	_, err := r.recordUpdate(src)
+	return err
+}
+
+// recordUpdate saves an updated record as RecordUpdate does, and tells whether there was anything to save
+func (r *Record) recordUpdate(src ChangeSource) (bool, error) {
 	// Request a socket connection from the session to process our query.
 	mgoSession := mgoSession.Copy()
 	defer mgoSession.Close()
 	coll := getRecordsColl()
 
+	// the record as it is now, to keep in the revision
+	before, err := RecordGetByID(r.ID.Hex())
+	if err != nil {
+		logger.Error.Printf("Couldn't update record: %v", err)
+		return false, err
+	}
+
+	// nothing to save, e.g. a file uploaded twice: the record doesn't count as updated
+	changes := recordsDiff(before, *r)
+	if len(changes) == 0 {
+		r.DateUpdated = before.DateUpdated
+		return false, nil
+	}
+	for i := range changes {
+		changes[i].Rule = r.mergeRules[changes[i].Field]
+	}
+
 	// let's add the time and save
 	r.DateUpdated = time.Now()
+	r.setIdentifierKeys()
 
 	// we select on the record's ID
 	selector := bson.M{"_id": r.ID}
 
-	err := coll.Update(selector, &r)
+	err = coll.Update(selector, &r)
 	if err != nil {
 		logger.Error.Printf("Couldn't update record: %v", err)
-		return err
+		return false, err
 	}
 
-	return nil
+	rev := newRevision(r.ID, RevisionUpdated, src)
+	rev.Changes = changes
+	rev.Before = &before
+	rev.create()
+
+	return true, nil
+}
+
+// RecordUpsert inserts or updates a single record in DB,
+// deduplicating on identifiers the same way file uploads do.
+// r.ID is set to the ID of the record saved. It returns the number of records updated & inserted:
+// none if an existing record had nothing to change
+func (r *Record) RecordUpsert(src ChangeSource) (int, int, error) {
+	policy, err := MergePolicyGet()
+	if err != nil {
+		logger.Error.Printf("couldn't get the merge policy, using the default one: %v", err)
+	}
+	return r.recordUpsert(src, policy, make(MergeStats))
 }
 
 // recordUpsert inserts or updates a record in DB
 // not using the upsert of mongodb because we want
-// fine grained control of fields protected, merged, etc
-func (r Record) recordUpsert() (int, int, error) {
+// fine grained control of fields protected, merged, etc.
+// The decisions of the merge policy are added to stats
+func (r *Record) recordUpsert(src ChangeSource, policy MergePolicy, stats MergeStats) (int, int, error) {
 
 	var updated, inserted int
 
 	existingRecord, err := RecordGetByIdentifiers(r.Identifiers)
 
 	if err != nil { // no existing record returned, we just create one as is
-		err := r.create()
+		r.setFieldSources(src.Type)
+		err := r.create(src)
 		if err != nil {
 			return updated, inserted, err
 		}
@@ -201,33 +535,46 @@ func (r Record) recordUpsert() (int, int, error) {
 		return updated, inserted, nil
 	}
 
+	// a record in the trash was deleted on purpose: it's neither updated nor restored by the way.
+	// r gets its ID, so that the caller can point to it
+	if existingRecord.Deleted {
+		r.ID = existingRecord.ID
+		return updated, inserted, ErrRecordInTrash
+	}
+
 	// we have an existing record
-	recordsMerge(&r, existingRecord)
+	stats.Add(recordsMerge(r, existingRecord, src.Type, policy))
 
 	// update existing record in DB
-	err = r.RecordUpdate()
+	changed, err := r.recordUpdate(src)
 	if err != nil {
 		return updated, inserted, err
 	}
 
-	updated++
+	if changed {
+		updated++
+	}
 	return updated, inserted, nil
 }
 
-// FIXME: should be a method, not a function
+// recordToKbart returns the 25 KBART Phase II columns for a record, in the order of kbartHeader
 func recordToKbart(record Record) []string {
 	var printID, onlineID string
 
+	// KBART recommends the ISBN-13 over the ISBN-10
 	for _, v := range record.Identifiers {
-		if v.IDType == IDTypePrint {
+		if v.IDType == IDTypePrint && (printID == "" || v.Scheme() == SchemeISBN13) {
 			printID = v.Identifier
-			continue
 		}
-		if v.IDType == IDTypeOnline {
+		if v.IDType == IDTypeOnline && (onlineID == "" || v.Scheme() == SchemeISBN13) {
 			onlineID = v.Identifier
-			continue
 		}
-		break
+	}
+
+	// notes were called coverage_notes before KBART Phase II
+	notes := record.Notes
+	if notes == "" {
+		notes = record.CoverageNotes
 	}
 
 	result := []string{
@@ -235,8 +582,8 @@ func recordToKbart(record Record) []string {
 		printID,
 		onlineID,
 		record.DateFirstIssueOnline,
-		record.NumFirstIssueOnline,
 		record.NumFirstVolOnline,
+		record.NumFirstIssueOnline,
 		record.DateLastIssueOnline,
 		record.NumLastVolOnline,
 		record.NumLastIssueOnline,
@@ -245,8 +592,17 @@ func recordToKbart(record Record) []string {
 		record.TitleID,
 		record.EmbargoInfo,
 		record.CoverageDepth,
-		record.CoverageNotes,
+		notes,
 		record.PublisherName,
+		record.PublicationType,
+		record.DateMonographPublishedPrint,
+		record.DateMonographPublishedOnline,
+		record.MonographVolume,
+		record.MonographEdition,
+		record.FirstEditor,
+		record.ParentPublicationTitleID,
+		record.PrecedingPublicationTitleID,
+		record.AccessType,
 	}
 
 	return result
@@ -262,8 +618,8 @@ func RecordsCount() int {
 	// collection ebooks
 	coll := getRecordsColl()
 
-	//  query ebooks
-	qry := coll.Find(nil)
+	//  query ebooks, leaving out the trash
+	qry := coll.Find(bson.M{"deleted": bson.M{"$ne": true}})
 	count, err := qry.Count()
 
 	if err != nil {
@@ -273,6 +629,22 @@ func RecordsCount() int {
 	return count
 }
 
+// RecordsCountFiltered counts the records matching a RecordsFilter
+func RecordsCountFiltered(f RecordsFilter) int {
+	// Request a socket connection from the session to process our query.
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+
+	coll := getRecordsColl()
+
+	count, err := coll.Find(f.query()).Count()
+	if err != nil {
+		logger.Error.Println(err)
+	}
+
+	return count
+}
+
 // RecordsCountUnimarc retrieves the number of record that have a RecordUnimarc field
 func RecordsCountUnimarc() int {
 	// Request a socket connection from the session to process our query.
@@ -283,7 +655,7 @@ func RecordsCountUnimarc() int {
 	coll := getRecordsColl()
 
 	//  query ebooks
-	qry := coll.Find(bson.M{"recordunimarc": bson.M{"$exists": true}})
+	qry := coll.Find(bson.M{"recordunimarc": bson.M{"$exists": true}, "deleted": bson.M{"$ne": true}})
 	count, err := qry.Count()
 
 	if err != nil {
@@ -306,7 +678,7 @@ func RecordsGetByTSName(tsname string, n int) ([]Record, error) {
 	// collection ebooks
 	coll := getRecordsColl()
 
-	q := coll.Find(bson.M{"targetservices.name": tsname}).Sort("publicationtitle")
+	q := coll.Find(bson.M{"targetservices.name": tsname, "deleted": bson.M{"$ne": true}}).Sort("publicationtitle")
 
 	// skip to result number n
 	// NOTE: if we want to paginate on large sets, we shouldn't skip
@@ -323,31 +695,62 @@ func RecordsGetByTSName(tsname string, n int) ([]Record, error) {
 	return result, nil
 }
 
-// RecordsGetNoPPNByTSName retrieves all records with conditions : no PPN, given TS
-// used to prepare query to sudoc isbn2ppn web service
-func RecordsGetNoPPNByTSName(tsname string) ([]Record, error) {
+// RecordsIter calls fn for each record matching a RecordsFilter, in title order.
+// Records are read from a cursor one at a time, so that large target services are handled in constant memory.
+// It returns the number of records fn was called for, and stops at the first error fn returns
+func RecordsIter(f RecordsFilter, fn func(Record) error) (int, error) {
+	var count int
+
+	// Request a socket connection from the session to process our query.
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+
+	coll := getRecordsColl()
+
+	iter := coll.Find(f.query()).Sort("publicationtitle").Iter()
+
+	var record Record
+	for iter.Next(&record) {
+		count++
+		if err := fn(record); err != nil {
+			iter.Close()
+			return count, err
+		}
+		record = Record{} // Next doesn't reset the fields missing from the next document
+	}
+
+	return count, iter.Close()
+}
+
+// RecordsGet retrieves the records matching a RecordsFilter, sorted by title.
+// skip and limit are used to paginate, a limit of 0 means no limit
+func RecordsGet(f RecordsFilter, skip, limit int) ([]Record, error) {
 	var result []Record
 
 	// Request a socket connection from the session to process our query.
 	mgoSession := mgoSession.Copy()
 	defer mgoSession.Close()
 
-	// collection ebooks
 	coll := getRecordsColl()
 
-	//  query ebooks by package name, aka Target Service in SFX (and in models.Record struct) and checks that PPN does not exist
-	err := coll.Find(bson.M{"targetservices.name": tsname, "identifiers.idtype": bson.M{"$ne": IDTypePPN}}).All(&result)
-	if err != nil {
-		logger.Error.Println(err)
+	q := coll.Find(f.query()).Sort("publicationtitle")
+	if skip > 0 {
+		q = q.Skip(skip)
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	if err := q.All(&result); err != nil {
 		return result, err
 	}
 
 	return result, nil
 }
 
-// RecordsGetWithPPNByTSName retrieves all records with condition : has PPN, given TS
-// used to prepare query to sudoc get record web service
-func RecordsGetWithPPNByTSName(tsname string) ([]Record, error) {
+// RecordsGetNoPPNByTSName retrieves all records with conditions : no PPN, given TS
+// used to prepare query to sudoc isbn2ppn web service
+func RecordsGetNoPPNByTSName(tsname string) ([]Record, error) {
 	var result []Record
 
 	// Request a socket connection from the session to process our query.
@@ -357,8 +760,8 @@ func RecordsGetWithPPNByTSName(tsname string) ([]Record, error) {
 	// collection ebooks
 	coll := getRecordsColl()
 
-	//  query ebooks by package name, aka Target Service in SFX (and in models.Record struct) and checks if PPN exists
-	err := coll.Find(bson.M{"targetservices.name": tsname, "identifiers.idtype": IDTypePPN}).All(&result)
+	//  query ebooks by package name, aka Target Service in SFX (and in models.Record struct) and checks that PPN does not exist
+	err := coll.Find(bson.M{"targetservices.name": tsname, "identifiers.idtype": bson.M{"$ne": IDTypePPN}, "deleted": bson.M{"$ne": true}}).All(&result)
 	if err != nil {
 		logger.Error.Println(err)
 		return result, err
@@ -367,8 +770,9 @@ func RecordsGetWithPPNByTSName(tsname string) ([]Record, error) {
 	return result, nil
 }
 
-// RecordsGetWithUnimarcByTSName retrieves all records with condition : has Unimarc Record, given TS
-func RecordsGetWithUnimarcByTSName(tsname string) ([]Record, error) {
+// RecordsGetWithPPNByTSName retrieves all records with condition : has PPN, given TS
+// used to prepare query to sudoc get record web service
+func RecordsGetWithPPNByTSName(tsname string) ([]Record, error) {
 	var result []Record
 
 	// Request a socket connection from the session to process our query.
@@ -379,7 +783,7 @@ func RecordsGetWithUnimarcByTSName(tsname string) ([]Record, error) {
 	coll := getRecordsColl()
 
 	//  query ebooks by package name, aka Target Service in SFX (and in models.Record struct) and checks if PPN exists
-	err := coll.Find(bson.M{"targetservices.name": tsname, "recordunimarc": bson.M{"$exists": true}}).All(&result)
+	err := coll.Find(bson.M{"targetservices.name": tsname, "identifiers.idtype": IDTypePPN, "deleted": bson.M{"$ne": true}}).All(&result)
 	if err != nil {
 		logger.Error.Println(err)
 		return result, err
@@ -388,8 +792,9 @@ func RecordsGetWithUnimarcByTSName(tsname string) ([]Record, error) {
 	return result, nil
 }
 
-// recordsMerge protects and merges fields between 2 records
-func recordsMerge(r1 *Record, r2 Record) {
+// recordsMerge protects and merges fields between an incoming record, from a type of source, and the record in DB.
+// The fields of MergeFields are merged following the merge policy; it returns the decisions made
+func recordsMerge(r1 *Record, r2 Record, source string, policy MergePolicy) MergeStats {
 
 	r1.ID = r2.ID
 
@@ -397,6 +802,25 @@ func recordsMerge(r1 *Record, r2 Record) {
 	r1.DateCreated = r2.DateCreated
 	r1.RecordMarc21 = r2.RecordMarc21
 	r1.RecordUnimarc = r2.RecordUnimarc
+	r1.Deleted = r2.Deleted
+	r1.DateDeleted = r2.DateDeleted
+	r1.DeletedBy = r2.DeletedBy
+
+	// the record stays in the target services it already belongs to, with its coverage in each package
+	for _, ts2 := range r2.TargetServices {
+		var exists bool
+		for i, ts1 := range r1.TargetServices {
+			if ts2.Name == ts1.Name {
+				exists = true
+				if ts1.Coverage == nil {
+					r1.TargetServices[i].Coverage = ts2.Coverage
+				}
+			}
+		}
+		if !exists {
+			r1.TargetServices = append(r1.TargetServices, ts2)
+		}
+	}
 
 	// merge identifiers between incoming record and DB record
 	for _, v2 := range r2.Identifiers {
@@ -410,19 +834,43 @@ func recordsMerge(r1 *Record, r2 Record) {
 			r1.Identifiers = append(r1.Identifiers, v2)
 		}
 	}
+
+	return policy.mergeFields(r1, r2, source)
 }
 
-// RecordsUpsert updates or inserts a number of records in DB
-func RecordsUpsert(records []Record) (int, int) {
+// UpsertResult sums up what RecordsUpsert did with a batch of records
+type UpsertResult struct {
+	Updated   int
+	Inserted  int
+	Unchanged int        // records found in DB, with nothing to change
+	Stats     MergeStats // the decisions the merge policy made on the fields of the records updated
+	InTrash   []Record   // records left out because they match a record in the trash, with the ID of that record
+	Failed    []Record   // records which couldn't be saved
+}
 
-	var recordsUpdates, recordsInserts int
-	for _, r := range records {
-		updated, upserted, err := r.recordUpsert()
-		if err != nil {
+// RecordsUpsert updates or inserts a number of records in DB.
+// Each record saved gets the ID it has in DB: records which couldn't be saved may have one too, see UpsertResult.Failed
+func RecordsUpsert(records []Record, src ChangeSource) UpsertResult {
+	result := UpsertResult{Stats: make(MergeStats)}
+
+	policy, err := MergePolicyGet()
+	if err != nil {
+		logger.Error.Printf("couldn't get the merge policy, using the default one: %v", err)
+	}
+
+	for i := range records {
+		updated, inserted, err := records[i].recordUpsert(src, policy, result.Stats)
+		switch {
+		case err == ErrRecordInTrash:
+			result.InTrash = append(result.InTrash, records[i])
+		case err != nil:
 			logger.Error.Println(err)
+			result.Failed = append(result.Failed, records[i])
+		case updated+inserted == 0:
+			result.Unchanged++
 		}
-		recordsUpdates += updated
-		recordsInserts += upserted
+		result.Updated += updated
+		result.Inserted += inserted
 	}
-	return recordsUpdates, recordsInserts
+	return result
 }
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+)
+
+// FieldChange is the change of a single field between 2 versions of a record
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+	Rule  string `bson:",omitempty"` // the merge rule which decided the change, if any
+}
+
+// RecordChange describes how an existing record would be changed
+type RecordChange struct {
+	Record  Record // the record as it is in DB
+	Changes []FieldChange
+}
+
+// UpsertPreview sums up what RecordsUpsert would do with a batch of records
+type UpsertPreview struct {
+	Inserts   []Record
+	Updates   []RecordChange
+	Unchanged int
+	InTrash   []Record // records in the trash the batch matches, which would be left as they are
+
+	matched map[bson.ObjectId]bool // records in DB the batch would update, or leave unchanged
+}
+
+// IDTypeLabel returns a human readable label for a type of identifier
+func IDTypeLabel(idType int) string {
+	switch idType {
+	case IDTypeOnline:
+		return "Online"
+	case IDTypePrint:
+		return "Print"
+	case IDTypePPN:
+		return "PPN"
+	case IDTypeSFX:
+		return "SFX"
+	case IDTypeISSNL:
+		return "ISSN-L"
+	case IDTypeDOI:
+		return "DOI"
+	case IDTypeOCLC:
+		return "OCLC"
+	case IDTypeProprietary:
+		return "Proprietary"
+	}
+	return "Unknown"
+}
+
+// fieldString formats the value of a record field so that 2 versions can be compared.
+// slices are sorted: the order of identifiers or target services doesn't matter
+func fieldString(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case []Identifier:
+		var s []string
+		for _, id := range x {
+			s = append(s, id.Identifier+" ("+id.Label()+")")
+		}
+		sort.Strings(s)
+		return strings.Join(s, ", ")
+	case []TargetService:
+		var s []string
+		for _, ts := range x {
+			if ts.Coverage != nil && ts.Coverage.String() != "" {
+				s = append(s, ts.Name+" ("+ts.Coverage.String()+")")
+				continue
+			}
+			s = append(s, ts.Name)
+		}
+		sort.Strings(s)
+		return strings.Join(s, ", ")
+	case time.Time:
+		if x.IsZero() {
+			return ""
+		}
+		return x.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// recordsDiff lists the fields which differ between 2 versions of a record.
+// The ID, the dates of creation / update and the sources of the fields are not compared
+func recordsDiff(before, after Record) []FieldChange {
+	var changes []FieldChange
+
+	vb, va := reflect.ValueOf(before), reflect.ValueOf(after)
+	t := vb.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if name == "ID" || name == "DateCreated" || name == "DateUpdated" || name == "FieldSources" || t.Field(i).PkgPath != "" {
+			continue
+		}
+		oldValue, newValue := fieldString(vb.Field(i)), fieldString(va.Field(i))
+		if oldValue != newValue {
+			changes = append(changes, FieldChange{Field: name, Old: oldValue, New: newValue})
+		}
+	}
+
+	return changes
+}
+
+// RecordsUpsertPreview tells what RecordsUpsert would do with a batch of records from a type of source,
+// i.e. which records would be inserted, and which fields would change in existing records, and by which merge rule,
+// without saving anything
+func RecordsUpsertPreview(records []Record, source string) UpsertPreview {
+	preview := UpsertPreview{matched: make(map[bson.ObjectId]bool)}
+
+	policy, err := MergePolicyGet()
+	if err != nil {
+		logger.Error.Printf("couldn't get the merge policy, using the default one: %v", err)
+	}
+
+	for _, r := range records {
+		existing, err := RecordGetByIdentifiers(r.Identifiers)
+		if err != nil { // no existing record, it would be created
+			preview.Inserts = append(preview.Inserts, r)
+			continue
+		}
+		preview.matched[existing.ID] = true
+		if existing.Deleted {
+			preview.InTrash = append(preview.InTrash, existing)
+			continue
+		}
+
+		// merge as recordUpsert would, on a copy
+		merged := r
+		merged.Identifiers = append([]Identifier(nil), r.Identifiers...)
+		recordsMerge(&merged, existing, source, policy)
+
+		changes := recordsDiff(existing, merged)
+		if len(changes) == 0 {
+			preview.Unchanged++
+			continue
+		}
+		for i := range changes {
+			changes[i].Rule = merged.mergeRules[changes[i].Field]
+		}
+		preview.Updates = append(preview.Updates, RecordChange{Record: existing, Changes: changes})
+	}
+
+	return preview
+}
+
+// Dropped lists the records of a target service the batch doesn't have,
+// i.e. the records which would be detached from it if the batch is its full holdings
+func (p UpsertPreview) Dropped(tsname string) ([]Record, error) {
+	var dropped []Record
+
+	records, err := RecordsGetByTSName(tsname, 0)
+	if err != nil {
+		return dropped, err
+	}
+	for _, record := range records {
+		if !p.matched[record.ID] {
+			dropped = append(dropped, record)
+		}
+	}
+
+	return dropped, nil
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// ErrKbartDate is returned for a date which isn't a KBART date: YYYY-MM-DD, YYYY-MM or YYYY
+	ErrKbartDate = errors.New("not a KBART date: YYYY-MM-DD, YYYY-MM or YYYY")
+	// ErrKbartDateOrder is returned when the last issue online is older than the first one
+	ErrKbartDateOrder = errors.New("the last issue online is older than the first one")
+	// ErrCoverageDepth is returned for an unknown coverage depth
+	ErrCoverageDepth = errors.New("not a KBART coverage depth: fulltext, selected articles or abstracts")
+	// ErrPublicationTitle is returned for a record without title
+	ErrPublicationTitle = errors.New("a record needs a publication title")
+	// ErrNoIdentifier is returned for a record without identifier
+	ErrNoIdentifier = errors.New("a record needs at least one identifier")
+)
+
+// kbartDateLayouts are the date formats KBART accepts
+var kbartDateLayouts = []string{"2006-01-02", "2006-01", "2006"}
+
+// kbartCoverageDepths are the coverage depths of KBART, the Phase I spelling included
+var kbartCoverageDepths = []string{"fulltext", "selected articles", "selectedArticles", "abstracts"}
+
+// FieldError is a problem with the value of a field of a record
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+// ValidKbartDate tells whether a date has one of the KBART date formats. An empty date is valid
+func ValidKbartDate(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, layout := range kbartDateLayouts {
+		if _, err := time.Parse(layout, s); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidCoverageDepth tells whether a coverage depth is one of the KBART values. An empty coverage depth is valid
+func ValidCoverageDepth(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, v := range kbartCoverageDepths {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks a record edited by hand: title, identifiers, KBART dates & coverage depth.
+// It returns the problems found, one per field
+func (r Record) Validate() []FieldError {
+	var problems []FieldError
+
+	if strings.TrimSpace(r.PublicationTitle) == "" {
+		problems = append(problems, FieldError{"PublicationTitle", ErrPublicationTitle})
+	}
+	if len(r.Identifiers) == 0 {
+		problems = append(problems, FieldError{"Identifiers", ErrNoIdentifier})
+	}
+
+	dates := []struct{ field, value string }{
+		{"DateFirstIssueOnline", r.DateFirstIssueOnline},
+		{"DateLastIssueOnline", r.DateLastIssueOnline},
+		{"DateMonographPublishedPrint", r.DateMonographPublishedPrint},
+		{"DateMonographPublishedOnline", r.DateMonographPublishedOnline},
+	}
+	for _, d := range dates {
+		if !ValidKbartDate(d.value) {
+			problems = append(problems, FieldError{d.field, ErrKbartDate})
+		}
+	}
+	// KBART dates sort as strings, down to the precision of the less precise one
+	first, last := r.DateFirstIssueOnline, r.DateLastIssueOnline
+	if first != "" && last != "" && ValidKbartDate(first) && ValidKbartDate(last) {
+		n := len(first)
+		if len(last) < n {
+			n = len(last)
+		}
+		if last[:n] < first[:n] {
+			problems = append(problems, FieldError{"DateLastIssueOnline", ErrKbartDateOrder})
+		}
+	}
+
+	if !ValidCoverageDepth(r.CoverageDepth) {
+		problems = append(problems, FieldError{"CoverageDepth", ErrCoverageDepth})
+	}
+
+	return problems
+}
+
+// IdentifiersTaken returns the identifiers of a record which another record already has, the trash included,
+// with the ID of that record: an identifier belongs to a single record.
+// DOIs, OCLC numbers & proprietary IDs are only taken by an identifier of the same type, see matchKey
+func (r Record) IdentifiersTaken() (map[string]bson.ObjectId, error) {
+	taken := make(map[string]bson.ObjectId)
+
+	keys := make(map[string]string)
+	var values []string
+	for _, id := range r.Identifiers {
+		keys[id.matchKey()] = id.Identifier
+		values = append(values, id.matchKey())
+	}
+	if len(values) == 0 {
+		return taken, nil
+	}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRecordsColl()
+
+	qry := bson.M{"identifiers.key": bson.M{"$in": values}}
+	if r.ID != "" {
+		qry["_id"] = bson.M{"$ne": r.ID}
+	}
+
+	iter := coll.Find(qry).Select(bson.M{"identifiers": 1}).Iter()
+	for {
+		var other Record
+		if !iter.Next(&other) {
+			break
+		}
+		for _, id := range other.Identifiers {
+			if value, ok := keys[id.matchKey()]; ok {
+				taken[value] = other.ID
+			}
+		}
+	}
+	return taken, iter.Close()
+}
@@ -11,6 +11,11 @@ const (
 	UploadKbart        // Types of batch operation: kbart csv upload
 	UploadSfx          // Types of batch operation: sfx xml upload
 	SudocWs            // Types of batch operation: retrieve Unimarc Records from Sudoc Web Service
+	RevertBatch        // Types of batch operation: undo the changes made to records by another batch operation
+	Export             // Types of batch operation: export of the records of a target service
+	Purge              // Types of batch operation: removal for good of the records in the trash
+	Duplicates         // Types of batch operation: search for the records which may be duplicates
+	Bulk               // Types of batch operation: bulk action on a selection of records
 )
 
 // Report is a report about a batch operation, stored in DB
@@ -39,14 +44,85 @@ func ReportsGet() ([]Report, error) {
 }
 
 // ReportCreate inserts a report into the DB
+// the ID may have been set beforehand, to link the changes made by a batch operation to its report
 func (report *Report) ReportCreate() error {
 	mgoSession := mgoSession.Copy()
 	defer mgoSession.Close()
 	coll := getReportsColl()
-	report.ID = bson.NewObjectId()
+	if report.ID == "" {
+		report.ID = bson.NewObjectId()
+	}
 	report.DateCreated = time.Now()
 	if err := coll.Insert(report); err != nil {
 		return err
 	}
 	return nil
 }
+
+// ReportGetByID retrieves a report given its mongodb ID
+func ReportGetByID(ID string) (Report, error) {
+	report := Report{}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getReportsColl()
+
+	err := coll.FindId(bson.ObjectIdHex(ID)).One(&report)
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// ReportsGetPage retrieves reports, most recent first.
+// reportType filters on the type of batch operation, use -1 for all types
+func ReportsGetPage(reportType, skip, limit int) ([]Report, int, error) {
+	var reports []Report
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getReportsColl()
+
+	qry := bson.M{}
+	if reportType >= 0 {
+		qry["reporttype"] = reportType
+	}
+
+	total, err := coll.Find(qry).Count()
+	if err != nil {
+		return reports, total, err
+	}
+
+	q := coll.Find(qry).Sort("-datecreated").Skip(skip)
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	if err := q.All(&reports); err != nil {
+		return reports, total, err
+	}
+	return reports, total, nil
+}
+
+// ReportUpdate saves an updated report to DB
+func (report *Report) ReportUpdate() error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getReportsColl()
+
+	if err := coll.UpdateId(report.ID, report); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReportDelete removes a report from DB
+func ReportDelete(ID string) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getReportsColl()
+
+	if err := coll.RemoveId(bson.ObjectIdHex(ID)); err != nil {
+		return err
+	}
+	return nil
+}
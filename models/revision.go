@@ -0,0 +1,173 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/nicomo/abacaxi/logger"
+)
+
+const (
+	RevisionCreated  = iota // Types of revision: record created
+	RevisionUpdated         // Types of revision: record updated
+	RevisionDeleted         // Types of revision: record deleted
+	RevisionReverted        // Types of revision: record reverted to the state before another revision
+)
+
+// ChangeSource tells who changes records, and in which batch operation if any
+type ChangeSource struct {
+	User     string
+	ReportID bson.ObjectId `bson:",omitempty"` // the report of the batch operation
+	Type     string        `bson:",omitempty"` // the type of source of the records, for the merge policy: kbart, publishercsv, sfxxml or manual
+}
+
+// Revision stores a change made to a record, with the full record as it was before,
+// so that the change can be reverted
+type Revision struct {
+	ID           bson.ObjectId `bson:"_id"`
+	RecordID     bson.ObjectId
+	DateCreated  time.Time
+	User         string        `bson:",omitempty"`
+	ReportID     bson.ObjectId `bson:",omitempty"`
+	RevisionType int
+	RevertOf     bson.ObjectId `bson:",omitempty"` // for reverts, the revision which was reverted
+	Changes      []FieldChange `bson:",omitempty"`
+	Before       *Record       `bson:",omitempty"` // nil for creations
+}
+
+// newRevision prepares a revision for a change to a record
+func newRevision(recordID bson.ObjectId, revisionType int, src ChangeSource) Revision {
+	return Revision{
+		ID:           bson.NewObjectId(),
+		RecordID:     recordID,
+		DateCreated:  time.Now(),
+		User:         src.User,
+		ReportID:     src.ReportID,
+		RevisionType: revisionType,
+	}
+}
+
+// create saves a revision. Failing to do so is logged, but doesn't stop the change to the record
+func (rev Revision) create() {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRevisionsColl()
+
+	if err := coll.Insert(rev); err != nil {
+		logger.Error.Printf("couldn't save revision for record %v: %v", rev.RecordID, err)
+	}
+}
+
+// RevisionGetByID retrieves a revision given its mongodb ID
+func RevisionGetByID(ID string) (Revision, error) {
+	rev := Revision{}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRevisionsColl()
+
+	if err := coll.FindId(bson.ObjectIdHex(ID)).One(&rev); err != nil {
+		return rev, err
+	}
+	return rev, nil
+}
+
+// RevisionsGetByRecordID retrieves the history of a record, most recent first
+func RevisionsGetByRecordID(ID string) ([]Revision, error) {
+	var revisions []Revision
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRevisionsColl()
+
+	q := coll.Find(bson.M{"recordid": bson.ObjectIdHex(ID)}).Sort("-datecreated")
+	if err := q.All(&revisions); err != nil {
+		return revisions, err
+	}
+	return revisions, nil
+}
+
+// RevisionsCountByReportID counts the revisions made by a batch operation
+func RevisionsCountByReportID(ID string) int {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRevisionsColl()
+
+	count, err := coll.Find(bson.M{"reportid": bson.ObjectIdHex(ID)}).Count()
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	return count
+}
+
+// RevisionsGetFirstByReportID retrieves, for each record changed by a batch operation,
+// the first revision made by that batch, i.e. the one holding the record as it was before the batch
+func RevisionsGetFirstByReportID(ID string) ([]Revision, error) {
+	var revisions []Revision
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRevisionsColl()
+
+	q := coll.Find(bson.M{"reportid": bson.ObjectIdHex(ID)}).Sort("datecreated")
+	if err := q.All(&revisions); err != nil {
+		return revisions, err
+	}
+
+	var first []Revision
+	seen := make(map[bson.ObjectId]bool)
+	for _, rev := range revisions {
+		if seen[rev.RecordID] {
+			continue
+		}
+		seen[rev.RecordID] = true
+		first = append(first, rev)
+	}
+	return first, nil
+}
+
+// RevisionRevert puts a record back in the state it was before a revision:
+// a created record is deleted, a deleted record is restored, an updated record gets its previous values back
+func RevisionRevert(rev Revision, src ChangeSource) error {
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getRecordsColl()
+
+	current, err := RecordGetByID(rev.RecordID.Hex())
+	exists := err == nil
+
+	// the record didn't exist before this revision
+	if rev.Before == nil {
+		if !exists || current.Deleted {
+			return nil
+		}
+		return RecordDelete(rev.RecordID.Hex(), src)
+	}
+
+	restored := *rev.Before
+	restored.ID = rev.RecordID
+	restored.DateUpdated = time.Now()
+	restored.setIdentifierKeys()
+
+	revert := newRevision(rev.RecordID, RevisionReverted, src)
+	revert.RevertOf = rev.ID
+	if exists {
+		revert.Changes = recordsDiff(current, restored)
+		revert.Before = &current
+		err = coll.UpdateId(restored.ID, restored)
+	} else {
+		revert.Changes = recordsDiff(Record{}, restored)
+		err = coll.Insert(restored)
+	}
+	if err != nil {
+		return err
+	}
+
+	revert.create()
+	return nil
+}
+
+// ErrNothingToRevert is returned when a batch operation didn't change any record
+var ErrNothingToRevert = errors.New("no record was changed by this operation")
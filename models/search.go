@@ -30,7 +30,7 @@ func Search(r *http.Request) ([]Record, string, error) {
 
 	// build query
 	qryString := p.Sanitize(r.FormValue("search_terms"))
-	qry := bson.M{"$text": bson.M{"$search": qryString}}
+	qry := bson.M{"$text": bson.M{"$search": qryString}, "deleted": bson.M{"$ne": true}}
 
 	//TODO: sort by relevance. See https://docs.mongodb.com/manual/reference/operator/query/text/#sort-by-text-search-score
 	// execute query
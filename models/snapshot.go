@@ -0,0 +1,189 @@
+package models
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Why a snapshot was taken
+const (
+	SnapshotUpload = "upload" // after an upload to the target service
+	SnapshotManual = "manual" // on demand
+)
+
+// snapshotBatchSize is the number of titles of a snapshot inserted at once
+const snapshotBatchSize = 1000
+
+// Snapshot is the list of the titles of a target service at a given time, with their identifiers, coverage & URL.
+// Snapshots are never changed once taken. Their titles are stored in their own collection,
+// so that the snapshot of a large target service isn't limited by the size of a document
+type Snapshot struct {
+	ID          bson.ObjectId `bson:"_id"`
+	TSName      string
+	DateCreated time.Time
+	Trigger     string        // upload or manual
+	User        string        `bson:",omitempty"`
+	ReportID    bson.ObjectId `bson:",omitempty"` // report of the upload the snapshot was taken after
+	Count       int           // number of titles
+}
+
+// snapshotHolding is a title of a snapshot, as stored in DB
+type snapshotHolding struct {
+	ID         bson.ObjectId `bson:"_id"`
+	SnapshotID bson.ObjectId
+	Holding    `bson:",inline"`
+}
+
+// ErrSnapshotNotFound is returned when there's no snapshot of a target service at a given time
+var ErrSnapshotNotFound = errors.New("no snapshot of the target service at that time")
+
+// SnapshotCreate takes a snapshot of the titles of a target service.
+// The snapshot is listed once all its titles are saved
+func SnapshotCreate(tsname, trigger string, src ChangeSource) (Snapshot, error) {
+	s := Snapshot{
+		ID:          bson.NewObjectId(),
+		TSName:      tsname,
+		DateCreated: time.Now(),
+		Trigger:     trigger,
+		User:        src.User,
+		ReportID:    src.ReportID,
+	}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	holdingsColl := getSnapshotHoldingsColl()
+
+	// save the titles, a batch at a time
+	var batch []interface{}
+	insertBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := holdingsColl.Insert(batch...)
+		batch = batch[:0]
+		return err
+	}
+
+	count, err := RecordsIter(RecordsFilter{TSName: tsname}, func(r Record) error {
+		batch = append(batch, snapshotHolding{ID: bson.NewObjectId(), SnapshotID: s.ID, Holding: holdingFromRecord(r.ForTargetService(tsname))})
+		if len(batch) < snapshotBatchSize {
+			return nil
+		}
+		return insertBatch()
+	})
+	if err == nil {
+		err = insertBatch()
+	}
+	if err == nil {
+		s.Count = count
+		err = getSnapshotsColl().Insert(s)
+	}
+
+	// don't leave the titles of a partial snapshot behind
+	if err != nil {
+		holdingsColl.RemoveAll(bson.M{"snapshotid": s.ID})
+		return s, err
+	}
+
+	return s, nil
+}
+
+// SnapshotsGetByTSName retrieves the snapshots of a target service, most recent first
+func SnapshotsGetByTSName(tsname string) ([]Snapshot, error) {
+	var snapshots []Snapshot
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getSnapshotsColl()
+
+	err := coll.Find(bson.M{"tsname": tsname}).Sort("-datecreated").All(&snapshots)
+	return snapshots, err
+}
+
+// SnapshotGetByID retrieves a snapshot given its mongodb ID
+func SnapshotGetByID(ID string) (Snapshot, error) {
+	var s Snapshot
+
+	if !bson.IsObjectIdHex(ID) {
+		return s, mgo.ErrNotFound
+	}
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getSnapshotsColl()
+
+	err := coll.FindId(bson.ObjectIdHex(ID)).One(&s)
+	return s, err
+}
+
+// SnapshotAt retrieves the snapshot of a target service telling what it had at a given time,
+// i.e. the last snapshot taken before then
+func SnapshotAt(tsname string, t time.Time) (Snapshot, error) {
+	var s Snapshot
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getSnapshotsColl()
+
+	err := coll.Find(bson.M{"tsname": tsname, "datecreated": bson.M{"$lte": t}}).Sort("-datecreated").One(&s)
+	if err == mgo.ErrNotFound {
+		return s, ErrSnapshotNotFound
+	}
+	return s, err
+}
+
+// SnapshotPrevious retrieves the snapshot of the same target service taken before a snapshot
+func SnapshotPrevious(s Snapshot) (Snapshot, error) {
+	return SnapshotAt(s.TSName, s.DateCreated.Add(-time.Nanosecond))
+}
+
+// SnapshotHoldingsIter calls fn for each title of a snapshot, in title order.
+// It returns the number of titles fn was called for, and stops at the first error fn returns
+func SnapshotHoldingsIter(ID bson.ObjectId, fn func(Holding) error) (int, error) {
+	var count int
+
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+	coll := getSnapshotHoldingsColl()
+
+	iter := coll.Find(bson.M{"snapshotid": ID}).Sort("publicationtitle").Iter()
+
+	var sh snapshotHolding
+	for iter.Next(&sh) {
+		count++
+		if err := fn(sh.Holding); err != nil {
+			iter.Close()
+			return count, err
+		}
+		sh = snapshotHolding{} // Next doesn't reset the fields missing from the next document
+	}
+
+	return count, iter.Close()
+}
+
+// SnapshotHoldings retrieves the titles of a snapshot, in title order
+func SnapshotHoldings(ID bson.ObjectId) ([]Holding, error) {
+	var holdings []Holding
+
+	_, err := SnapshotHoldingsIter(ID, func(h Holding) error {
+		holdings = append(holdings, h)
+		return nil
+	})
+
+	return holdings, err
+}
+
+// WriteSnapshotKbart writes the titles of a snapshot as a KBART Phase II file.
+// It returns the number of titles written
+func WriteSnapshotKbart(out io.Writer, ID bson.ObjectId) (int, error) {
+	// the holdings already have the coverage of the package
+	return writeKbart(out, func(fn func(Record) error) (int, error) {
+		return SnapshotHoldingsIter(ID, func(h Holding) error {
+			return fn(h.record())
+		})
+	}, "")
+}
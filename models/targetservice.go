@@ -21,6 +21,14 @@ type TargetService struct {
 	DateCreated time.Time
 	DateUpdated time.Time `bson:",omitempty"`
 	Active      bool      `schema:"tsactive"`
+
+	// used to name KBART files: Provider_Region_PackageName_YYYY-MM-DD.txt
+	Provider    string `bson:",omitempty" schema:"provider"`
+	Region      string `bson:",omitempty" schema:"region"` // region or consortium
+	PackageName string `bson:",omitempty" schema:"packagename"`
+
+	// on the target services of a record only: the coverage of the title in this package
+	Coverage *PackageCoverage `bson:",omitempty" schema:"-"`
 }
 
 // GetTargetService retrieves a target service
@@ -71,7 +79,7 @@ func TSCountRecords(tsname string) int {
 	coll := getRecordsColl()
 
 	//  query records by target service name, aka Target Service in SFX (and in models.Records struct)
-	qry := coll.Find(bson.M{"targetservices.name": tsname})
+	qry := coll.Find(bson.M{"targetservices.name": tsname, "deleted": bson.M{"$ne": true}})
 	count, err := qry.Count()
 
 	if err != nil {
@@ -91,7 +99,7 @@ func TSCountRecordsUnimarc(tsname string) int {
 	coll := getRecordsColl()
 
 	//  query records by target service name, aka Target Service in SFX (and in models.Ebook struct)
-	qry := coll.Find(bson.M{"targetservices.name": tsname, "recordunimarc": bson.M{"$ne": nil}})
+	qry := coll.Find(bson.M{"targetservices.name": tsname, "recordunimarc": bson.M{"$ne": nil}, "deleted": bson.M{"$ne": true}})
 	count, err := qry.Count()
 
 	if err != nil {
@@ -143,6 +151,11 @@ func TSDelete(tsname string) error {
 		return err
 	}
 
+	// its export rules go with it
+	if err := EnrichmentRulesDelete(tsname); err != nil {
+		logger.Error.Printf("couldn't delete enrichment rules of %s: %v", tsname, err)
+	}
+
 	return nil
 }
 
@@ -164,3 +177,82 @@ func TSUpdate(ts TargetService) error {
 
 	return nil
 }
+
+// TSDetachRecords removes the link to a target service from all the records
+// which have it, and de-activates the records left without any target service
+func TSDetachRecords(tsname string, src ChangeSource) error {
+
+	records, err := RecordsGetByTSName(tsname, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		record.detachTS(tsname)
+		if err := record.RecordUpdate(src); err != nil {
+			logger.Error.Printf("could not update linked record: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// TSDetachMissingRecords removes the link to a target service from the records which have it
+// and aren't in kept, e.g. the titles dropped from a package, then de-activates the records left without any target service.
+// It returns the records detached, as they are now
+func TSDetachMissingRecords(tsname string, kept map[bson.ObjectId]bool, src ChangeSource) ([]Record, error) {
+	var dropped []Record
+
+	records, err := RecordsGetByTSName(tsname, 0)
+	if err != nil {
+		return dropped, err
+	}
+
+	for _, record := range records {
+		if kept[record.ID] {
+			continue
+		}
+		record.detachTS(tsname)
+		if err := record.RecordUpdate(src); err != nil {
+			logger.Error.Printf("could not update linked record: %v", err)
+			continue
+		}
+		dropped = append(dropped, record)
+	}
+
+	return dropped, nil
+}
+
+// detachTS removes the link to a target service from a record,
+// and de-activates it if it's left without any target service
+func (r *Record) detachTS(tsname string) {
+	var kept []TargetService
+	for _, ts := range r.TargetServices {
+		if ts.Name != tsname {
+			kept = append(kept, ts)
+		}
+	}
+	r.TargetServices = kept
+
+	if len(r.TargetServices) == 0 {
+		r.Active = false
+	}
+}
+
+// TSSetRecordsActive sets the boolean "active" for all the records linked to a target service
+func TSSetRecordsActive(tsname string, active bool, src ChangeSource) error {
+
+	records, err := RecordsGetByTSName(tsname, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		record.Active = active
+		if err := record.RecordUpdate(src); err != nil {
+			logger.Error.Printf("can't update record %v: %v", record.ID, err)
+		}
+	}
+
+	return nil
+}
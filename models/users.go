@@ -16,6 +16,7 @@ type User struct {
 	DateLastSeen time.Time `bson:",omitempty"`
 	Username     string    `bson:"username"`
 	Password     string    `bson:"password"`
+	APIToken     string    `bson:"apitoken,omitempty"` // hash of the token used to access the JSON API
 }
 
 // GetUsers retrieves the full list of users
@@ -80,6 +81,26 @@ func UserByUsername(username string) (User, error) {
 	return user, nil
 }
 
+// UserByAPIToken retrieves a user given the hash of her API token
+func UserByAPIToken(tokenHash string) (User, error) {
+	user := User{}
+
+	// Request a socket connection from the session to process our query.
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+
+	// collection users
+	coll := getUsersColl()
+
+	qry := bson.M{"apitoken": tokenHash}
+	err := coll.Find(qry).One(&user)
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
 // UserCreate creates a new user
 func UserCreate(username, password string) error {
 	now := time.Now()
@@ -135,6 +156,28 @@ func UserDelete(ID string) error {
 	return nil
 }
 
+// UserUpdateAPIToken saves the hash of a new API token for a user,
+// replacing the previous one if any
+func UserUpdateAPIToken(ID string, tokenHash string) error {
+	// Request a socket connection from the session to process our query.
+	mgoSession := mgoSession.Copy()
+	defer mgoSession.Close()
+
+	// collection users
+	coll := getUsersColl()
+
+	// update query
+	qry := bson.M{
+		"$set": bson.M{"apitoken": tokenHash},
+	}
+	err := coll.Update(bson.M{"_id": bson.ObjectIdHex(ID)}, qry)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // UserUpdateDateLastSeen updates a user's record when she logs in
 func UserUpdateDateLastSeen(u User) error {
 	// Request a socket connection from the session to process our query.
@@ -1,6 +1,9 @@
 package session
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
 
 	"golang.org/x/crypto/bcrypt"
@@ -50,3 +53,20 @@ func MatchString(hash, pw string) bool {
 
 	return false
 }
+
+// TokenCreate returns a new random API token
+func TokenCreate() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// TokenHash returns the hash of an API token, as stored in DB.
+// Unlike passwords, tokens are looked up by their hash, so no salt here
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
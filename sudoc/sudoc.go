@@ -10,8 +10,11 @@ import (
 	"time"
 
 	"github.com/nicomo/gosudoc"
+	"gopkg.in/mgo.v2/bson"
 
+	"github.com/nicomo/abacaxi/issn"
 	"github.com/nicomo/abacaxi/logger"
+	"github.com/nicomo/abacaxi/marc"
 	"github.com/nicomo/abacaxi/models"
 )
 
@@ -37,32 +40,96 @@ func FetchRecord(recordURL string) (string, error) {
 }
 
 // GenChannel creates the initial channel in the Fan out / Fan in process to crawl isbn2PPN web service
-func GenChannel(records []models.Record) <-chan models.Record {
+// closing done stops sending records down the pipeline
+func GenChannel(done <-chan struct{}, records []models.Record) <-chan models.Record {
 	out := make(chan models.Record)
 	go func() {
+		defer close(out)
 		for _, r := range records {
-			out <- r
+			select {
+			case out <- r:
+			case <-done:
+				return
+			}
 		}
-		close(out)
 	}()
 	return out
 }
 
 // GenI2Input generates the input to be consumed by the sudoc web services
-// we use both the ISBNs and ISSNs
+// we use both the ISBNs and ISSNs: an ISSN brings its ISSN-L, and the other ISSNs linked to it,
+// so that the Sudoc finds a serial whichever version it describes
 func GenI2Input(ri []models.Identifier) []string {
 	var s []string
+	seen := make(map[string]bool)
+	add := func(v string) {
+		if !seen[v] {
+			seen[v] = true
+			s = append(s, v)
+		}
+	}
+
 	for _, v := range ri {
-		if v.IDType == models.IDTypeOnline || v.IDType == models.IDTypePrint {
-			s = append(s, v.Identifier)
+		if v.IDType != models.IDTypeOnline && v.IDType != models.IDTypePrint && v.IDType != models.IDTypeISSNL {
+			continue
+		}
+		i, err := issn.Parse(v.Identifier)
+		if err != nil {
+			// an ISBN
+			if v.IDType != models.IDTypeISSNL {
+				add(v.Identifier)
+			}
 			continue
 		}
+		for _, linked := range issn.Group(i) {
+			add(string(linked))
+		}
 	}
 	return s
 }
 
+// splitI2Input tells the ISSNs from the ISBNs of the input to the sudoc web services,
+// which have a service for each
+func splitI2Input(input []string) (issns, isbns []string) {
+	for _, v := range input {
+		if i, err := issn.Parse(v); err == nil {
+			issns = append(issns, string(i))
+			continue
+		}
+		isbns = append(isbns, v)
+	}
+	return issns, isbns
+}
+
+// getPPNs gets the PPNs of the input from the sudoc web services: issn2ppn for the ISSNs, isbn2ppn for the ISBNs
+func getPPNs(input []string) (map[string][]string, error) {
+	issns, isbns := splitI2Input(input)
+
+	res := make(map[string][]string)
+	if len(issns) > 0 {
+		issnRes, err := gosudoc.Issn2ppn(issns)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range issnRes {
+			res[k] = v
+		}
+	}
+	if len(isbns) > 0 {
+		isbnRes, err := gosudoc.ID2ppn(isbns, "isbn2ppn")
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range isbnRes {
+			res[k] = v
+		}
+	}
+
+	return res, nil
+}
+
 // CrawlPPN takes a channel with a Record, passes it on to gosudoc package, retrieves the result
-func CrawlPPN(in <-chan models.Record) <-chan int {
+func CrawlPPN(in <-chan models.Record, src models.ChangeSource) <-chan int {
 	out := make(chan int)
 	go func() {
 		for record := range in {
@@ -75,22 +142,11 @@ func CrawlPPN(in <-chan models.Record) <-chan int {
 			}
 
 			// get PPN for input
-			var res map[string][]string
-			var err error
-			if len(i2input[0]) == 8 {
-				res, err = gosudoc.Issn2ppn(i2input)
-				if err != nil {
-					logger.Error.Printf("couldn't get PPN: %v", err)
-					out <- 0
-					continue
-				}
-			} else {
-				res, err = gosudoc.ID2ppn(i2input, "isbn2ppn")
-				if err != nil {
-					logger.Error.Printf("couldn't get PPN: %v", err)
-					out <- 0
-					continue
-				}
+			res, err := getPPNs(i2input)
+			if err != nil {
+				logger.Error.Printf("couldn't get PPN: %v", err)
+				out <- 0
+				continue
 			}
 
 			// update live record with PPNs
@@ -111,7 +167,7 @@ func CrawlPPN(in <-chan models.Record) <-chan int {
 			}
 
 			// update record in DB
-			err = record.RecordUpdate()
+			err = record.RecordUpdate(src)
 			if err != nil {
 				logger.Error.Println(err)
 				out <- 0
@@ -129,12 +185,12 @@ func CrawlPPN(in <-chan models.Record) <-chan int {
 }
 
 // CrawlRecords takes a channel with a record, passes it on to FetchRecord, retrieves the result
-func CrawlRecords(in <-chan models.Record) <-chan int {
+func CrawlRecords(in <-chan models.Record, src models.ChangeSource) <-chan int {
 
 	out := make(chan int)
 	go func() {
 		for record := range in {
-			if err := GetSudocRecord(record); err != nil {
+			if err := GetSudocRecord(record, src); err != nil {
 				logger.Error.Printf("failed to get Sudoc Unimarc for record %v: %v", record.ID, err)
 				out <- 0
 				continue
@@ -182,7 +238,7 @@ func MergeResults(cs ...<-chan int) <-chan int {
 // GetSudocRecord tries to retrieve a Unimarc record from Sudoc, in 2 passes :
 // get their ID from our IDs
 // get the actual record from their ID
-func GetSudocRecord(record models.Record) error {
+func GetSudocRecord(record models.Record, src models.ChangeSource) error {
 
 	// Do we already have a Unimarc record ID?
 	PPN := record.GetPPN()
@@ -200,17 +256,10 @@ func GetSudocRecord(record models.Record) error {
 			return err
 		}
 
-		// first ID look like an ISSN, let's try that
-		if len(input[0]) == 8 {
-			res, err = gosudoc.Issn2ppn(input)
-			if err != nil {
-				return err
-			}
-		} else { // we have isbns
-			res, err = gosudoc.ID2ppn(input, "isbn2ppn")
-			if err != nil {
-				return err
-			}
+		// ISSNs & ISBNs each have their web service
+		res, err = getPPNs(input)
+		if err != nil {
+			return err
 		}
 
 		// now we have PPNs, let's insert them into the live record struct
@@ -241,9 +290,25 @@ func GetSudocRecord(record models.Record) error {
 		return err
 	}
 
+	// make sure we got an actual record, not e.g. an error page
+	parsed, err := marc.Parse(unimarc)
+	if err != nil {
+		return fmt.Errorf("invalid Unimarc record for PPN %s: %v", PPN[0], err)
+	}
+	if errs := parsed.Validate(marc.Unimarc); len(errs) > 0 {
+		logger.Info.Printf("Unimarc record for PPN %s has %d problems, first one: %v", PPN[0], len(errs), errs[0])
+	}
+
+	// our partners use MARC21: derive it from the Unimarc record
+	marc21, err := marc.ToMarc21(parsed).MarshalMarcXML()
+	if err != nil {
+		return err
+	}
+
 	// actually save updated ebook struct to DB
 	record.RecordUnimarc = unimarc
-	err = record.RecordUpdate()
+	record.RecordMarc21 = marc21
+	err = record.RecordUpdate(src)
 	if err != nil {
 		return err
 	}
@@ -252,36 +317,61 @@ func GetSudocRecord(record models.Record) error {
 }
 
 // GetSudocRecords tries to get batches of unimarc record from Sudoc web services
-func GetSudocRecords(records []models.Record, tsname string) {
+// progress is saved in the job, which is stopped if cancelled
+func GetSudocRecords(records []models.Record, tsname string, job *models.Job) error {
+	// the report ID is known up front, so that the changes made to records can be linked to it
+	report := models.Report{
+		ID:         bson.NewObjectId(),
+		ReportType: models.SudocWs,
+	}
+	src := models.ChangeSource{User: job.User, ReportID: report.ID}
+
 	// set up the pipeline
-	in := GenChannel(records)
+	done := make(chan struct{})
+	in := GenChannel(done, records)
 
 	// fan out to 2 workers
-	c1 := CrawlRecords(in)
-	c2 := CrawlRecords(in)
+	c1 := CrawlRecords(in, src)
+	c2 := CrawlRecords(in, src)
 
 	// fan in results
-	recordsCounter := 0
+	recordsCounter, processed := 0, 0
+	var cancelled bool
 	for n := range MergeResults(c1, c2) {
 		recordsCounter += n
+		processed++
+		if !cancelled && !job.JobProgress(processed, len(records)) {
+			// stop feeding the workers, and let them drain
+			cancelled = true
+			close(done)
+		}
 	}
 
 	// let's do a little reporting to the user
-	report := models.Report{
-		ReportType: models.SudocWs,
-	}
-	msg := fmt.Sprintf("Number of local records sent : %d - number of unimarc records received  : %d", len(records), recordsCounter)
+	msg := fmt.Sprintf("Number of local records sent : %d - number of unimarc records received  : %d", processed, recordsCounter)
 	report.Text = append(report.Text, tsname, msg)
-	if recordsCounter == 0 {
+
+	if cancelled {
+		report.Success = false
+		report.Text = append(report.Text, "Cancelled by user")
+		if err := report.ReportCreate(); err != nil {
+			logger.Error.Printf("couldn't create report: %v", err)
+		}
+		return models.ErrJobCancelled
+	}
+
+	if recordsCounter == 0 && len(records) > 0 {
 		report.Success = false
 		report.Text = append(report.Text, "Check the server logs for details.")
 		if err := report.ReportCreate(); err != nil {
 			logger.Error.Printf("couldn't create report: %v", err)
 		}
+		return errors.New("no unimarc record received")
 	}
 
 	report.Success = true
 	if err := report.ReportCreate(); err != nil {
 		logger.Error.Printf("couldn't create report: %v", err)
 	}
+	return nil
 }
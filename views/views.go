@@ -28,10 +28,65 @@ func init() {
 		"templates/tslisting.tmpl",
 	))
 
+	// comparison of the holdings of 2 target services
+	tmpl["compare"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/compare.tmpl",
+		"templates/head.tmpl",
+		"templates/nav.tmpl",
+		"templates/tslisting.tmpl",
+	))
+
+	// review queue of the possible duplicates
+	tmpl["duplicates"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/duplicates.tmpl",
+		"templates/head.tmpl",
+		"templates/nav.tmpl",
+		"templates/tslisting.tmpl",
+	))
+
+	// merge policy page
+	tmpl["mergepolicy"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/head.tmpl",
+		"templates/mergepolicy.tmpl",
+		"templates/nav.tmpl",
+		"templates/tslisting.tmpl",
+	))
+
+	// scheduled exports page
+	tmpl["exportschedules"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/exportschedules.tmpl",
+		"templates/head.tmpl",
+		"templates/nav.tmpl",
+		"templates/tslisting.tmpl",
+	))
+
+	// jobs list page
+	tmpl["jobs"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/head.tmpl",
+		"templates/jobs.tmpl",
+		"templates/nav.tmpl",
+		"templates/tslisting.tmpl",
+	))
+
+	// form to edit a record
+	tmpl["recordform"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/head.tmpl",
+		"templates/nav.tmpl",
+		"templates/recordform.tmpl",
+		"templates/tslisting.tmpl",
+	))
+
 	// record page
 	tmpl["record"] = template.Must(template.ParseFiles(
 		"templates/base.tmpl",
 		"templates/head.tmpl",
+		"templates/marcrecord.tmpl",
 		"templates/nav.tmpl",
 		"templates/record.tmpl",
 		"templates/tslisting.tmpl",
@@ -56,6 +111,24 @@ func init() {
 		"templates/tslisting.tmpl",
 	))
 
+	// snapshot page
+	tmpl["snapshot"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/head.tmpl",
+		"templates/nav.tmpl",
+		"templates/snapshot.tmpl",
+		"templates/tslisting.tmpl",
+	))
+
+	// snapshots of a target service
+	tmpl["snapshots"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/head.tmpl",
+		"templates/nav.tmpl",
+		"templates/snapshots.tmpl",
+		"templates/tslisting.tmpl",
+	))
+
 	// targetservice page
 	tmpl["targetservice"] = template.Must(template.ParseFiles(
 		"templates/base.tmpl",
@@ -75,6 +148,15 @@ func init() {
 		"templates/tsnew.tmpl",
 	))
 
+	// form to edit the export rules of a target service
+	tmpl["tsenrichment"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/head.tmpl",
+		"templates/nav.tmpl",
+		"templates/tslisting.tmpl",
+		"templates/tsenrichment.tmpl",
+	))
+
 	// form to update target service
 	tmpl["tsupdate"] = template.Must(template.ParseFiles(
 		"templates/base.tmpl",
@@ -84,6 +166,15 @@ func init() {
 		"templates/tsupdate.tmpl",
 	))
 
+	// trash page
+	tmpl["trash"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/head.tmpl",
+		"templates/nav.tmpl",
+		"templates/trash.tmpl",
+		"templates/tslisting.tmpl",
+	))
+
 	// upload page
 	tmpl["upload"] = template.Must(template.ParseFiles("templates/upload.tmpl",
 		"templates/base.tmpl",
@@ -92,6 +183,15 @@ func init() {
 		"templates/tslisting.tmpl",
 	))
 
+	// upload preview page
+	tmpl["uploadpreview"] = template.Must(template.ParseFiles(
+		"templates/base.tmpl",
+		"templates/head.tmpl",
+		"templates/nav.tmpl",
+		"templates/tslisting.tmpl",
+		"templates/uploadpreview.tmpl",
+	))
+
 	// user login form
 	tmpl["userlogin"] = template.Must(template.ParseFiles(
 		"templates/base.tmpl",